@@ -13,6 +13,7 @@ ALLOYDB_USER=$(curl -H "Metadata-Flavor: Google" "http://metadata.google.interna
 ALLOYDB_PASSWORD=$(curl -H "Metadata-Flavor: Google" "http://metadata.google.internal/computeMetadata/v1/instance/attributes/ALLOYDB_PASSWORD")
 ALLOYDB_DB=$(curl -H "Metadata-Flavor: Google" "http://metadata.google.internal/computeMetadata/v1/instance/attributes/ALLOYDB_DB")
 ALLOYDB_IAM_USER=$(curl -H "Metadata-Flavor: Google" "http://metadata.google.internal/computeMetadata/v1/instance/attributes/ALLOYDB_IAM_USER")
+ALLOYDB_LOADER_IAM_USER=$(curl -H "Metadata-Flavor: Google" "http://metadata.google.internal/computeMetadata/v1/instance/attributes/ALLOYDB_LOADER_IAM_USER")
 ML_EMBEDDING_MODEL=$(curl -H "Metadata-Flavor: Google" "http://metadata.google.internal/computeMetadata/v1/instance/attributes/ML_EMBEDDING_MODEL")
 ML_GEN_AI_MODEL=$(curl -H "Metadata-Flavor: Google" "http://metadata.google.internal/computeMetadata/v1/instance/attributes/ML_GEN_AI_MODEL")
 ML_MAX_OUTPUT_TOKENS=$(curl -H "Metadata-Flavor: Google" "http://metadata.google.internal/computeMetadata/v1/instance/attributes/ML_MAX_OUTPUT_TOKENS")
@@ -41,6 +42,11 @@ if [ -z "$ALLOYDB_DB" ]; then
   exit 1
 fi
 
+if [ -z "$ALLOYDB_LOADER_IAM_USER" ]; then
+  echo "ALLOYDB_LOADER_IAM_USER not found in metadata"
+  exit 1
+fi
+
 # Use the ALLOYDB_PASS environment variable for the session
 export PGPASSWORD="$ALLOYDB_PASSWORD"
 
@@ -86,9 +92,10 @@ if ! wait_for_database; then
 fi
 
 # Create extensions if the database is ready
+# without google_ml_integration (eg. plain Postgres) the loader and sofhir have to use the openai or local
+# embedding and text generation providers
 if ! psql "host=$ALLOYDB_HOST user=$ALLOYDB_USER dbname=$ALLOYDB_DB" -c "CREATE EXTENSION IF NOT EXISTS google_ml_integration CASCADE"; then
-  echo "Failed to create google_ml_integration extension."
-  exit 1
+  echo "Failed to create google_ml_integration extension. Only the openai and local providers will work."
 fi
 
 if ! psql "host=$ALLOYDB_HOST user=$ALLOYDB_USER dbname=$ALLOYDB_DB" -c "CREATE EXTENSION IF NOT EXISTS vector"; then
@@ -119,9 +126,272 @@ BEGIN
             embedding VECTOR,
             data JSONB
         );
-        GRANT SELECT, INSERT, UPDATE ON public.resources TO "$ALLOYDB_IAM_USER";
+        GRANT SELECT ON public.resources TO "$ALLOYDB_IAM_USER";
+    END IF;
+END \$\$;
+
+-- sofhir's user only reads the rows, the loader's own user writes and deletes them (see the row-level security
+-- below). Earlier versions let sofhir's user write them, when the two were the same user
+REVOKE INSERT, UPDATE, DELETE ON public.resources FROM "$ALLOYDB_IAM_USER";
+
+-- FHIR versionId and meta.lastUpdated of the resource version the summary was generated from.
+-- lastUpdated is used to keep late pubsub deliveries from overwriting a newer version
+ALTER TABLE public.resources ADD COLUMN IF NOT EXISTS versionId VARCHAR(255);
+ALTER TABLE public.resources ADD COLUMN IF NOT EXISTS lastUpdated TIMESTAMPTZ;
+
+-- rows holding chunks of the attachment text (eg. DocumentReference notes) point to their resource with parentId
+ALTER TABLE public.resources ADD COLUMN IF NOT EXISTS parentId VARCHAR(255);
+CREATE INDEX IF NOT EXISTS resources_parentid_idx ON public.resources (parentId);
+
+-- where the summary came from: model, narrative (rendered in the loader, also the fallback when the model fails) or local
+ALTER TABLE public.resources ADD COLUMN IF NOT EXISTS summarySource VARCHAR(32);
+
+-- the provider and model of the embedding (eg. alloydb/textembedding-gecko@001). Retrieval only compares
+-- the query with rows embedded by the same model
+ALTER TABLE public.resources ADD COLUMN IF NOT EXISTS embeddingModel VARCHAR(255);
+UPDATE public.resources SET embeddingModel = 'alloydb/$ML_EMBEDDING_MODEL' WHERE embeddingModel IS NULL AND embedding IS NOT NULL;
+
+-- when the resource happened clinically (eg. the onset of a Condition) with its FHIR precision: year, month, day,
+-- second, millisecond or microsecond. NULL when the resource has none, timestamp is lastUpdated then
+ALTER TABLE public.resources ADD COLUMN IF NOT EXISTS clinicalTime TIMESTAMPTZ;
+ALTER TABLE public.resources ADD COLUMN IF NOT EXISTS clinicalTimePrecision VARCHAR(16);
+CREATE INDEX IF NOT EXISTS resources_patientid_clinicaltime_idx ON public.resources (patientId, clinicalTime);
+
+-- coded facts of the resource for filtering in retrieval without the vector search: its codings as
+-- [{system, code, display}] (eg. LOINC, SNOMED, RxNorm or ICD-10), the codes of its categories, its status,
+-- clinical and verification status (Condition, AllergyIntolerance) and the id of its encounter
+ALTER TABLE public.resources ADD COLUMN IF NOT EXISTS codings JSONB;
+ALTER TABLE public.resources ADD COLUMN IF NOT EXISTS category TEXT[];
+ALTER TABLE public.resources ADD COLUMN IF NOT EXISTS status VARCHAR(64);
+ALTER TABLE public.resources ADD COLUMN IF NOT EXISTS clinicalStatus VARCHAR(64);
+ALTER TABLE public.resources ADD COLUMN IF NOT EXISTS verificationStatus VARCHAR(64);
+ALTER TABLE public.resources ADD COLUMN IF NOT EXISTS encounterId VARCHAR(255);
+CREATE INDEX IF NOT EXISTS resources_codings_idx ON public.resources USING GIN (codings jsonb_path_ops);
+CREATE INDEX IF NOT EXISTS resources_category_idx ON public.resources USING GIN (category);
+CREATE INDEX IF NOT EXISTS resources_patientid_type_idx ON public.resources (patientId, type);
+CREATE INDEX IF NOT EXISTS resources_patientid_status_idx ON public.resources (patientId, clinicalStatus, status);
+CREATE INDEX IF NOT EXISTS resources_encounterid_idx ON public.resources (encounterId);
+
+-- sha256 of the clinically relevant content of the resource (without id, meta and text). A new version with
+-- the same hash keeps its summary and embedding instead of calling the model again
+ALTER TABLE public.resources ADD COLUMN IF NOT EXISTS contentHash VARCHAR(64);
+
+-- the prompt template a model summary was generated with as {version}/{name}, eg. v2/summary.Condition
+ALTER TABLE public.resources ADD COLUMN IF NOT EXISTS promptVersion VARCHAR(255);
+
+-- the provider and model that wrote a model summary, eg. alloydb/text-bison. The reindex command generates
+-- summaries of another model or prompt template again
+ALTER TABLE public.resources ADD COLUMN IF NOT EXISTS summaryModel VARCHAR(255);
+
+-- the embedding of the model being migrated to (SHADOW_EMBEDDING_* in the loader), until the reindex
+-- command promotes it to the embedding of the row. Retrieval uses whichever of the two is of the query's model
+ALTER TABLE public.resources ADD COLUMN IF NOT EXISTS shadowEmbedding VECTOR;
+ALTER TABLE public.resources ADD COLUMN IF NOT EXISTS shadowEmbeddingModel VARCHAR(255);
+CREATE INDEX IF NOT EXISTS resources_shadowembeddingmodel_idx ON public.resources (shadowEmbeddingModel)
+    WHERE shadowEmbeddingModel IS NOT NULL;
+
+-- resources that aren't in any patient's compartment (eg. an Observation of a Group, or a Device without a
+-- patient) are indexed in a table of their own, so patient retrieval never sees them. It has the columns and
+-- indexes of public.resources without a patientId. Columns added to public.resources go here as well
+CREATE TABLE IF NOT EXISTS public.non_patient_resources (LIKE public.resources INCLUDING ALL);
+ALTER TABLE public.non_patient_resources ALTER COLUMN patientId DROP NOT NULL;
+GRANT SELECT ON public.non_patient_resources TO "$ALLOYDB_IAM_USER";
+REVOKE INSERT, UPDATE, DELETE ON public.non_patient_resources FROM "$ALLOYDB_IAM_USER";
+
+-- the meta.security codes of the resource, and those of them that are segmented (SECURITY_LABEL_POLICY in
+-- the loader). rag_context only returns a row with restricted labels to a requester cleared for all of them
+ALTER TABLE public.resources ADD COLUMN IF NOT EXISTS securityLabels TEXT[];
+ALTER TABLE public.resources ADD COLUMN IF NOT EXISTS restrictedLabels TEXT[];
+CREATE INDEX IF NOT EXISTS resources_restrictedlabels_idx ON public.resources USING GIN (restrictedLabels);
+ALTER TABLE public.non_patient_resources ADD COLUMN IF NOT EXISTS securityLabels TEXT[];
+ALTER TABLE public.non_patient_resources ADD COLUMN IF NOT EXISTS restrictedLabels TEXT[];
+CREATE INDEX IF NOT EXISTS non_patient_resources_restrictedlabels_idx ON public.non_patient_resources USING GIN (restrictedLabels);
+
+-- the tenant of the rows, the managing organization of their patient, and the FHIR store they come from.
+-- Row-level security only shows sofhir's user ($ALLOYDB_IAM_USER) the rows of the organization in its
+-- app.organization_id setting, sofhir sets it from the caller's organizationId claim. Rows without an organization
+-- are seen by no tenant. The loader and its commands connect as their own user ($ALLOYDB_LOADER_IAM_USER), which
+-- the policies let read and write the rows of every organization. Nothing a session sets opens the other tenants
+ALTER TABLE public.resources ADD COLUMN IF NOT EXISTS organizationId VARCHAR(255);
+ALTER TABLE public.resources ADD COLUMN IF NOT EXISTS fhirStore TEXT;
+CREATE INDEX IF NOT EXISTS resources_organizationid_patientid_idx ON public.resources (organizationId, patientId);
+ALTER TABLE public.non_patient_resources ADD COLUMN IF NOT EXISTS organizationId VARCHAR(255);
+ALTER TABLE public.non_patient_resources ADD COLUMN IF NOT EXISTS fhirStore TEXT;
+CREATE INDEX IF NOT EXISTS non_patient_resources_organizationid_idx ON public.non_patient_resources (organizationId);
+
+GRANT SELECT, INSERT, UPDATE, DELETE ON public.resources TO "$ALLOYDB_LOADER_IAM_USER";
+GRANT SELECT, INSERT, UPDATE, DELETE ON public.non_patient_resources TO "$ALLOYDB_LOADER_IAM_USER";
+
+ALTER TABLE public.resources ENABLE ROW LEVEL SECURITY;
+DROP POLICY IF EXISTS resources_tenant_isolation ON public.resources;
+CREATE POLICY resources_tenant_isolation ON public.resources FOR SELECT TO "$ALLOYDB_IAM_USER"
+    USING (organizationId = NULLIF(current_setting('app.organization_id', true), ''));
+DROP POLICY IF EXISTS resources_loader ON public.resources;
+CREATE POLICY resources_loader ON public.resources TO "$ALLOYDB_LOADER_IAM_USER"
+    USING (true) WITH CHECK (true);
+ALTER TABLE public.non_patient_resources ENABLE ROW LEVEL SECURITY;
+DROP POLICY IF EXISTS non_patient_resources_tenant_isolation ON public.non_patient_resources;
+CREATE POLICY non_patient_resources_tenant_isolation ON public.non_patient_resources FOR SELECT TO "$ALLOYDB_IAM_USER"
+    USING (organizationId = NULLIF(current_setting('app.organization_id', true), ''));
+DROP POLICY IF EXISTS non_patient_resources_loader ON public.non_patient_resources;
+CREATE POLICY non_patient_resources_loader ON public.non_patient_resources TO "$ALLOYDB_LOADER_IAM_USER"
+    USING (true) WITH CHECK (true);
+
+-- the same resource id can be in more than one FHIR store, and is unique per type within one, so the rows are keyed
+-- by (fhirStore, type, id). Rows saved before the fhirStore column have an empty one, they are matched again once
+-- they're set to their store, eg. UPDATE public.resources SET fhirStore = 'projects/X/.../fhirStores/X' WHERE fhirStore = ''
+UPDATE public.resources SET fhirStore = '' WHERE fhirStore IS NULL;
+ALTER TABLE public.resources ALTER COLUMN fhirStore SET DEFAULT '';
+ALTER TABLE public.resources ALTER COLUMN fhirStore SET NOT NULL;
+UPDATE public.non_patient_resources SET fhirStore = '' WHERE fhirStore IS NULL;
+ALTER TABLE public.non_patient_resources ALTER COLUMN fhirStore SET DEFAULT '';
+ALTER TABLE public.non_patient_resources ALTER COLUMN fhirStore SET NOT NULL;
+DO \$\$
+BEGIN
+    IF NOT EXISTS (
+        SELECT 1
+        FROM information_schema.key_column_usage
+        WHERE table_schema = 'public'
+        AND table_name = 'resources'
+        AND constraint_name = 'resources_pkey'
+        AND column_name = 'fhirstore'
+    ) THEN
+        ALTER TABLE public.resources DROP CONSTRAINT IF EXISTS resources_pkey;
+        ALTER TABLE public.resources ADD PRIMARY KEY (fhirStore, type, id);
+    END IF;
+    IF NOT EXISTS (
+        SELECT 1
+        FROM information_schema.key_column_usage
+        WHERE table_schema = 'public'
+        AND table_name = 'non_patient_resources'
+        AND constraint_name = 'non_patient_resources_pkey'
+        AND column_name = 'fhirstore'
+    ) THEN
+        ALTER TABLE public.non_patient_resources DROP CONSTRAINT IF EXISTS non_patient_resources_pkey;
+        ALTER TABLE public.non_patient_resources ADD PRIMARY KEY (fhirStore, type, id);
+    END IF;
+END \$\$;
+CREATE INDEX IF NOT EXISTS resources_fhirstore_parentid_idx ON public.resources (fhirStore, type, parentId);
+CREATE INDEX IF NOT EXISTS non_patient_resources_fhirstore_parentid_idx ON public.non_patient_resources (fhirStore, type, parentId);
+
+-- the Patient summaries used to hold the number of active problems, rag_context counts them when it's asked now
+UPDATE public.resources SET summary = regexp_replace(summary, ', \d+ active problem\(s\) on record\.', '.')
+WHERE type = 'Patient' AND summary ~ ', \d+ active problem\(s\) on record\.';
+
+-- the prompt template library shared by the loader and sofhir. name is summary, summary.{ResourceType}, rag
+-- or rag.{role}, template is a Go text/template. PROMPT_VERSION selects the version they use
+CREATE TABLE IF NOT EXISTS public.prompt_templates (
+    name VARCHAR(255) NOT NULL,
+    version VARCHAR(64) NOT NULL,
+    template TEXT NOT NULL,
+    createdAt TIMESTAMPTZ NOT NULL DEFAULT now(),
+    PRIMARY KEY (name, version)
+);
+GRANT SELECT ON public.prompt_templates TO "$ALLOYDB_IAM_USER";
+REVOKE INSERT, UPDATE ON public.prompt_templates FROM "$ALLOYDB_IAM_USER";
+GRANT SELECT, INSERT, UPDATE ON public.prompt_templates TO "$ALLOYDB_LOADER_IAM_USER";
+
+-- prior versions of the summaries, copied by the update trigger when a row gets replaced
+CREATE TABLE IF NOT EXISTS public.resources_history (
+    id VARCHAR(255) NOT NULL,
+    versionId VARCHAR(255) NOT NULL,
+    type VARCHAR(255) NOT NULL,
+    patientId VARCHAR(255) NOT NULL,
+    timestamp TIMESTAMP NOT NULL,
+    lastUpdated TIMESTAMPTZ,
+    summary TEXT,
+    data JSONB,
+    archivedAt TIMESTAMPTZ NOT NULL DEFAULT now(),
+    PRIMARY KEY (id, versionId)
+);
+GRANT SELECT ON public.resources_history TO "$ALLOYDB_IAM_USER";
+REVOKE INSERT ON public.resources_history FROM "$ALLOYDB_IAM_USER";
+-- the history of the non-patient resources has no patientId
+ALTER TABLE public.resources_history ALTER COLUMN patientId DROP NOT NULL;
+-- the history is isolated like the rows it was copied from. The update trigger runs as the loader, who archives
+-- the rows of every organization
+ALTER TABLE public.resources_history ADD COLUMN IF NOT EXISTS organizationId VARCHAR(255);
+-- and keyed by the FHIR store of the rows as well
+ALTER TABLE public.resources_history ADD COLUMN IF NOT EXISTS fhirStore TEXT NOT NULL DEFAULT '';
+DO \$\$
+BEGIN
+    IF NOT EXISTS (
+        SELECT 1
+        FROM information_schema.key_column_usage
+        WHERE table_schema = 'public'
+        AND table_name = 'resources_history'
+        AND constraint_name = 'resources_history_pkey'
+        AND column_name = 'fhirstore'
+    ) THEN
+        ALTER TABLE public.resources_history DROP CONSTRAINT IF EXISTS resources_history_pkey;
+        ALTER TABLE public.resources_history ADD PRIMARY KEY (fhirStore, type, id, versionId);
+    END IF;
+END \$\$;
+CREATE INDEX IF NOT EXISTS resources_history_organizationid_idx ON public.resources_history (organizationId);
+GRANT SELECT, INSERT ON public.resources_history TO "$ALLOYDB_LOADER_IAM_USER";
+ALTER TABLE public.resources_history ENABLE ROW LEVEL SECURITY;
+DROP POLICY IF EXISTS resources_history_tenant_isolation ON public.resources_history;
+CREATE POLICY resources_history_tenant_isolation ON public.resources_history FOR SELECT TO "$ALLOYDB_IAM_USER"
+    USING (organizationId = NULLIF(current_setting('app.organization_id', true), ''));
+DROP POLICY IF EXISTS resources_history_loader ON public.resources_history;
+CREATE POLICY resources_history_loader ON public.resources_history TO "$ALLOYDB_LOADER_IAM_USER"
+    USING (true) WITH CHECK (true);
+
+-- events the loader failed to process for good (or ran out of retries on), with the event and the reason
+CREATE TABLE IF NOT EXISTS public.dead_letters (
+    resourceType VARCHAR(255) NOT NULL,
+    resourceId VARCHAR(255) NOT NULL,
+    versionId VARCHAR(255) NOT NULL,
+    action VARCHAR(32) NOT NULL,
+    resourceURI TEXT,
+    payload JSONB,
+    reason TEXT,
+    attempts INT NOT NULL DEFAULT 1,
+    createdAt TIMESTAMPTZ NOT NULL DEFAULT now(),
+    updatedAt TIMESTAMPTZ NOT NULL DEFAULT now(),
+    PRIMARY KEY (resourceType, resourceId, versionId, action)
+);
+REVOKE ALL ON public.dead_letters FROM "$ALLOYDB_IAM_USER";
+GRANT SELECT, INSERT, UPDATE, DELETE ON public.dead_letters TO "$ALLOYDB_LOADER_IAM_USER";
+-- the Pub/Sub messageId is part of the key: a message that couldn't be parsed has no resource to key it by,
+-- so every one of them used to land on the same row. Messages without an id are keyed by a hash of their payload
+ALTER TABLE public.dead_letters ADD COLUMN IF NOT EXISTS messageId VARCHAR(255) NOT NULL DEFAULT '';
+DO \$\$
+BEGIN
+    IF NOT EXISTS (
+        SELECT 1
+        FROM information_schema.key_column_usage
+        WHERE table_schema = 'public'
+        AND table_name = 'dead_letters'
+        AND constraint_name = 'dead_letters_pkey'
+        AND column_name = 'messageid'
+    ) THEN
+        ALTER TABLE public.dead_letters DROP CONSTRAINT IF EXISTS dead_letters_pkey;
+        ALTER TABLE public.dead_letters ADD PRIMARY KEY (resourceType, resourceId, versionId, action, messageId);
     END IF;
 END \$\$;
+
+-- every event the loader sees with the outcome of its latest attempt
+CREATE TABLE IF NOT EXISTS public.processing_ledger (
+    resourceType VARCHAR(255) NOT NULL,
+    resourceId VARCHAR(255) NOT NULL,
+    versionId VARCHAR(255) NOT NULL,
+    action VARCHAR(32) NOT NULL,
+    resourceURI TEXT,
+    patientId VARCHAR(255),
+    status VARCHAR(32) NOT NULL,
+    attempts INT NOT NULL DEFAULT 1,
+    error TEXT,
+    model VARCHAR(255),
+    latencyMs BIGINT,
+    createdAt TIMESTAMPTZ NOT NULL DEFAULT now(),
+    updatedAt TIMESTAMPTZ NOT NULL DEFAULT now(),
+    PRIMARY KEY (resourceType, resourceId, versionId, action)
+);
+CREATE INDEX IF NOT EXISTS processing_ledger_status_idx ON public.processing_ledger (status, updatedAt);
+CREATE INDEX IF NOT EXISTS processing_ledger_patientid_idx ON public.processing_ledger (patientId);
+REVOKE ALL ON public.processing_ledger FROM "$ALLOYDB_IAM_USER";
+GRANT SELECT, INSERT, UPDATE ON public.processing_ledger TO "$ALLOYDB_LOADER_IAM_USER";
 EOF
 
 cat "$temp_file1"
@@ -142,17 +412,58 @@ CREATE OR REPLACE FUNCTION insert_resource_create_embedding()
 	LANGUAGE 'plpgsql'
 AS \$\$
 	BEGIN
-		SELECT embedding('$ML_EMBEDDING_MODEL', NEW.summary)
-		INTO NEW.embedding;
+		-- the loader embeds the summary itself, this only fills in rows that come without one
+		IF NEW.embedding IS NULL THEN
+			SELECT embedding('$ML_EMBEDDING_MODEL', NEW.summary)
+			INTO NEW.embedding;
+			NEW.embeddingModel := 'alloydb/$ML_EMBEDDING_MODEL';
+		END IF;
 
 		RETURN NEW;
 	END \$\$;
 	
-CREATE TRIGGER insert_resource_trigger
+CREATE OR REPLACE TRIGGER insert_resource_trigger
 	BEFORE INSERT
 	ON public.resources
 	FOR EACH ROW
      EXECUTE PROCEDURE insert_resource_create_embedding();
+
+CREATE OR REPLACE FUNCTION update_resource_archive_version()
+	RETURNS trigger
+	LANGUAGE 'plpgsql'
+AS \$\$
+	BEGIN
+		-- only a new summary or version is archived, not a reindexed embedding
+		IF NEW.summary IS NOT DISTINCT FROM OLD.summary AND NEW.versionId IS NOT DISTINCT FROM OLD.versionId THEN
+			RETURN NEW;
+		END IF;
+
+		INSERT INTO public.resources_history (fhirStore, id, versionId, type, patientId, organizationId, timestamp, lastUpdated,
+			summary, data)
+		VALUES (OLD.fhirStore, OLD.id, COALESCE(OLD.versionId, ''), OLD.type, OLD.patientId, OLD.organizationId, OLD.timestamp,
+			OLD.lastUpdated, OLD.summary, OLD.data)
+		ON CONFLICT (fhirStore, type, id, versionId) DO NOTHING;
+
+		RETURN NEW;
+	END \$\$;
+
+CREATE OR REPLACE TRIGGER update_resource_trigger
+	BEFORE UPDATE
+	ON public.resources
+	FOR EACH ROW
+     EXECUTE PROCEDURE update_resource_archive_version();
+
+CREATE OR REPLACE TRIGGER insert_non_patient_resource_trigger
+	BEFORE INSERT
+	ON public.non_patient_resources
+	FOR EACH ROW
+     EXECUTE PROCEDURE insert_resource_create_embedding();
+
+CREATE OR REPLACE TRIGGER update_non_patient_resource_trigger
+	BEFORE UPDATE
+	ON public.non_patient_resources
+	FOR EACH ROW
+     EXECUTE PROCEDURE update_resource_archive_version();
 EOF
 
 cat "$temp_file2"
@@ -167,48 +478,193 @@ fi
 # Create temporary file with SQL statements for creating the rag function
 temp_file3=$(mktemp)
 cat <<EOF > "$temp_file3"
-CREATE OR REPLACE FUNCTION rag(patient_id VARCHAR, input_prompt VARCHAR ) RETURNS TABLE (
+-- how long ago (or how far ahead) a clinical time is, as of now and no finer than its precision,
+-- eg. 3 years ago, 2 months ago, today or in 5 days
+CREATE OR REPLACE FUNCTION recency(clinical_time TIMESTAMPTZ, clinical_time_precision VARCHAR) RETURNS text
+AS \$\$
+DECLARE
+    span interval := age(greatest(now(), clinical_time), least(now(), clinical_time));
+    amount int;
+    unit text;
+BEGIN
+    IF extract(year FROM span) >= 1 THEN
+        amount := extract(year FROM span);
+        unit := 'year';
+    ELSIF clinical_time_precision = 'year' THEN
+        RETURN 'this year';
+    ELSIF extract(month FROM span) >= 1 THEN
+        amount := extract(month FROM span);
+        unit := 'month';
+    ELSIF clinical_time_precision = 'month' THEN
+        RETURN 'this month';
+    ELSIF extract(day FROM span) >= 1 THEN
+        amount := extract(day FROM span);
+        unit := 'day';
+    ELSIF clinical_time_precision = 'day' THEN
+        RETURN 'today';
+    ELSIF extract(hour FROM span) >= 1 THEN
+        amount := extract(hour FROM span);
+        unit := 'hour';
+    ELSE
+        RETURN 'within the hour';
+    END IF;
+
+    IF amount > 1 THEN
+        unit := unit || 's';
+    END IF;
+    IF clinical_time > now() THEN
+        RETURN 'in ' || amount || ' ' || unit;
+    END IF;
+    RETURN amount || ' ' || unit || ' ago';
+END;
+\$\$ LANGUAGE plpgsql STABLE;
+
+DROP FUNCTION IF EXISTS rag_prompt(VARCHAR, VARCHAR);
+DROP FUNCTION IF EXISTS rag_prompt(VARCHAR, VARCHAR, vector, VARCHAR);
+DROP FUNCTION IF EXISTS rag_prompt(VARCHAR, VARCHAR, vector, VARCHAR, VARCHAR[], TIMESTAMPTZ, TIMESTAMPTZ, BOOLEAN,
+    VARCHAR[], VARCHAR[], VARCHAR[]);
+DROP FUNCTION IF EXISTS rag_context(VARCHAR, VARCHAR, vector, VARCHAR, VARCHAR[], TIMESTAMPTZ, TIMESTAMPTZ, BOOLEAN,
+    VARCHAR[], VARCHAR[], VARCHAR[]);
+DROP FUNCTION IF EXISTS rag_prompt(VARCHAR, VARCHAR, vector, VARCHAR, VARCHAR[], TIMESTAMPTZ, TIMESTAMPTZ, BOOLEAN,
+    VARCHAR[], VARCHAR[], VARCHAR[], VARCHAR[]);
+DROP FUNCTION IF EXISTS rag_context(VARCHAR, VARCHAR, vector, VARCHAR, VARCHAR[], TIMESTAMPTZ, TIMESTAMPTZ, BOOLEAN,
+    VARCHAR[], VARCHAR[], VARCHAR[], VARCHAR[]);
+DROP FUNCTION IF EXISTS rag(VARCHAR, VARCHAR);
+DROP FUNCTION IF EXISTS rag(VARCHAR, VARCHAR, VARCHAR[]);
+-- rag_context retrieves the Patient summary and the summaries closest to the input prompt. sofhir embeds the
+-- prompt with its embedding provider, renders the RAG prompt from the context with the rag template of the prompt
+-- library and sends it to the model configured with RAG_LLM_PROVIDER. rag_prompt renders the builtin RAG prompt
+-- for the in-database rag(). Without a query_embedding the prompt is embedded here with $ML_EMBEDDING_MODEL.
+-- Rows are compared by their embedding or, during an embedding migration, their shadow embedding of the same model.
+-- The optional filters narrow the summaries before the vector search, NULL filters keep everything:
+--   resource_types      only these resource types, eg. {Observation}
+--   from_time, to_time  clinical time (lastUpdated when there is none) from, and up to but not including
+--   active_only         only what is ongoing: an active, recurrence or relapse clinical status and not refuted,
+--                       or without a clinical status an active, in-progress or on-hold status
+--   code_systems        a coding in one of these systems, eg. {http://loinc.org}
+--   codes               a coding with one of these codes (in code_systems when it's set as well)
+--   categories          one of these category codes, eg. {vital-signs}
+-- Only the rows of the organization in app.organization_id are seen (row-level security), so the caller sets it
+-- first, eg. SELECT set_config('app.organization_id', 'org-1', true) in the transaction of the query.
+-- clearance is the security labels the requester is cleared for, eg. {R,HIV}. Rows with restricted labels
+-- (see SECURITY_LABEL_POLICY in the loader) are only returned when it has all of them, NULL clears none.
+-- fhir_store is the FHIR store the patient_id is of, eg. projects/X/locations/X/datasets/X/fhirStores/X. Patient ids
+-- are only unique within a store, so the Patient summary, the active problems and the summaries are all of the
+-- patient in that store. NULL takes the patient_id of any store, which only keeps patients apart in a deployment
+-- that indexes a single store.
+CREATE OR REPLACE FUNCTION rag_context(patient_id VARCHAR, input_prompt VARCHAR,
+    query_embedding vector DEFAULT NULL, embedding_model VARCHAR DEFAULT NULL,
+    resource_types VARCHAR[] DEFAULT NULL, from_time TIMESTAMPTZ DEFAULT NULL, to_time TIMESTAMPTZ DEFAULT NULL,
+    active_only BOOLEAN DEFAULT false, code_systems VARCHAR[] DEFAULT NULL, codes VARCHAR[] DEFAULT NULL,
+    categories VARCHAR[] DEFAULT NULL, clearance VARCHAR[] DEFAULT NULL, fhir_store VARCHAR DEFAULT NULL)
+    RETURNS TABLE (patient_context text, summaries text)
+AS \$\$
+DECLARE
+    active_problems bigint;
+BEGIN
+    IF query_embedding IS NULL THEN
+        query_embedding := embedding('$ML_EMBEDDING_MODEL', input_prompt)::vector;
+        embedding_model := 'alloydb/$ML_EMBEDDING_MODEL';
+    END IF;
+
+    -- PII free summary of the Patient resource itself (age band, sex)
+    SELECT string_agg(summary, ' ') INTO patient_context
+    FROM public.resources
+    WHERE patientid = patient_id AND (fhir_store IS NULL OR fhirStore = fhir_store) AND type = 'Patient'
+        AND (restrictedLabels IS NULL OR restrictedLabels <@ COALESCE(clearance, '{}')::TEXT[]);
+
+    -- the active problems are counted now from the indexed Conditions, so the count is never stale and
+    -- Conditions that are excluded, denied by a Consent or restricted beyond the clearance aren't counted
+    SELECT count(*) INTO active_problems
+    FROM public.resources r
+    WHERE patientid = patient_id AND (fhir_store IS NULL OR r.fhirStore = fhir_store) AND type = 'Condition' AND parentId IS NULL
+        AND r.clinicalStatus IN ('active', 'recurrence', 'relapse')
+        AND COALESCE(r.verificationStatus, '') NOT IN ('refuted', 'entered-in-error')
+        AND (r.restrictedLabels IS NULL OR r.restrictedLabels <@ COALESCE(clearance, '{}')::TEXT[]);
+    patient_context := concat_ws(' ', patient_context, active_problems || ' active problem(s) on record.');
+
+    -- the closest summaries, most recent first, each with its clinical date in its own precision and how
+    -- long ago that is. The recency is worked out now rather than stored, so it is right on the day of the question
+    SELECT string_agg(
+        CASE
+          WHEN clinicalTime IS NULL THEN ''
+          ELSE '(' || to_char(clinicalTime AT TIME ZONE 'UTC', CASE clinicalTimePrecision
+                WHEN 'year' THEN 'YYYY'
+                WHEN 'month' THEN 'YYYY-MM'
+                ELSE 'YYYY-MM-DD'
+              END) || ', ' || recency(clinicalTime, clinicalTimePrecision) || ') '
+        END || summary, '|' ORDER BY COALESCE(clinicalTime, subquery_alias.timestamp) DESC) INTO summaries
+    FROM (
+      SELECT
+        summary, clinicalTime, clinicalTimePrecision, r.timestamp
+      FROM
+        public.resources r
+      WHERE 
+        patientid = patient_id AND (fhir_store IS NULL OR r.fhirStore = fhir_store) AND type <> 'Patient'
+        AND (r.embeddingModel = embedding_model OR r.shadowEmbeddingModel = embedding_model)
+        AND (resource_types IS NULL OR r.type = ANY(resource_types))
+        AND (from_time IS NULL OR COALESCE(r.clinicalTime, r.timestamp) >= from_time)
+        AND (to_time IS NULL OR COALESCE(r.clinicalTime, r.timestamp) < to_time)
+        AND (NOT active_only OR CASE
+              WHEN r.clinicalStatus IS NOT NULL THEN r.clinicalStatus IN ('active', 'recurrence', 'relapse')
+                AND COALESCE(r.verificationStatus, '') NOT IN ('refuted', 'entered-in-error')
+              ELSE COALESCE(r.status, '') IN ('active', 'in-progress', 'on-hold')
+            END)
+        AND ((code_systems IS NULL AND codes IS NULL) OR EXISTS (
+              SELECT 1 FROM jsonb_array_elements(r.codings) AS c(coding)
+              WHERE (code_systems IS NULL OR coding->>'system' = ANY(code_systems))
+                AND (codes IS NULL OR coding->>'code' = ANY(codes))))
+        AND (categories IS NULL OR r.category && categories::TEXT[])
+        AND (r.restrictedLabels IS NULL OR r.restrictedLabels <@ COALESCE(clearance, '{}')::TEXT[])
+      ORDER BY
+        (CASE WHEN r.embeddingModel = embedding_model THEN r.embedding ELSE r.shadowEmbedding END <=> query_embedding) ASC
+      LIMIT 50
+    ) AS subquery_alias;
+
+    RETURN NEXT;
+END;
+\$\$ LANGUAGE plpgsql;
+
+-- the builtin RAG prompt, sofhir renders its own from rag_context with the prompt library
+CREATE OR REPLACE FUNCTION rag_prompt(patient_id VARCHAR, input_prompt VARCHAR,
+    query_embedding vector DEFAULT NULL, embedding_model VARCHAR DEFAULT NULL,
+    resource_types VARCHAR[] DEFAULT NULL, from_time TIMESTAMPTZ DEFAULT NULL, to_time TIMESTAMPTZ DEFAULT NULL,
+    active_only BOOLEAN DEFAULT false, code_systems VARCHAR[] DEFAULT NULL, codes VARCHAR[] DEFAULT NULL,
+    categories VARCHAR[] DEFAULT NULL, clearance VARCHAR[] DEFAULT NULL, fhir_store VARCHAR DEFAULT NULL) RETURNS text
+AS \$\$
+DECLARE
+    retrieved record;
+BEGIN
+    SELECT * INTO retrieved FROM rag_context(patient_id, input_prompt, query_embedding, embedding_model,
+        resource_types, from_time, to_time, active_only, code_systems, codes, categories, clearance, fhir_store);
+
+    RETURN 'you are a clinician that can udnerstand patient electronic records and be able to answer users questions. 
+            Based on the patient request we have retrieved a list of records closely related to users prompt. 
+            The retrieved list is a pipe de-limited text of summaries derived from FHIR resources associated to the patient.Important note: hide any PII incvluding, Names, DOB, Address, Email and Phone numbers of Patients from the answer.
+            Today is ' || to_char(now() AT TIME ZONE 'UTC', 'YYYY-MM-DD') || '. Each summary starts with the date of the record and how long ago that was,
+            use those when the answer depends on when something happened.
+            ' || COALESCE(retrieved.patient_context, '') || '
+            Here is the list of summaries from the search:' || COALESCE(retrieved.summaries, '') || '. And the question is: ' || input_prompt;
+END;
+\$\$ LANGUAGE plpgsql;
+
+-- answers the prompt with the model in AlloyDB, kept for callers of the in-database RAG. Restricted rows are
+-- only used with a clearance for them, and fhir_store is the store of the patient_id as in rag_context
+CREATE OR REPLACE FUNCTION rag(patient_id VARCHAR, input_prompt VARCHAR, clearance VARCHAR[] DEFAULT NULL,
+    fhir_store VARCHAR DEFAULT NULL) RETURNS TABLE (
     response json
 )
 AS \$\$
 BEGIN
     RETURN QUERY
-        WITH search_results as (
-          SELECT string_agg(summary, '|') AS retrieved_summaries
-          FROM (
-            SELECT
-              summary
-            FROM
-              public.resources r
-            WHERE 
-              patientid = patient_id
-            ORDER BY
-              (r.embedding <=> embedding('$ML_EMBEDDING_MODEL',input_prompt)::vector) ASC
-            LIMIT 50
-          ) AS subquery_alias
-        ),
-
-        prompt as (
-          select
-              'you are a clinician that can udnerstand patient electronic records and be able to answer users questions. 
-            Based on the patient request we have retrieved a list of records closely related to users prompt. 
-            The retrieved list is a pipe de-limited text of summaries derived from FHIR resources associated to the patient.Important note: hide any PII incvluding, Names, DOB, Address, Email and Phone numbers of Patients from the answer.
-            Here is the list of summaries from the search:' || retrieved_summaries || '. And the question is: ' || input_prompt
-            as prompt_text
-          from
-              search_results
-        )
-    
         select
           ml_predict_row(
             FORMAT('publishers/google/models/%s','$ML_GEN_AI_MODEL'),
             json_build_object(
-              'instances',json_build_object('prompt',prompt_text),
+              'instances',json_build_object('prompt',rag_prompt(patient_id, input_prompt, clearance => clearance, fhir_store => fhir_store)),
               'parameters',json_build_object('maxOutputTokens',$ML_MAX_OUTPUT_TOKENS,'topK',$ML_TOPK,'topP',$ML_TOPP, 'temperature',$ML_TEMPERATURE)
             )
-          ) as response
-        from
-            prompt;
+          ) as response;
 END;
 \$\$ LANGUAGE plpgsql;
 EOF
@@ -216,10 +672,10 @@ EOF
 cat "$temp_file3"
 # execute psql from temp file
 if ! psql -h "$ALLOYDB_HOST" -U "$ALLOYDB_USER" -d "$ALLOYDB_DB" -f "$temp_file3"; then
-  echo "Failed to execute SQL commands for creating the RAG function"
+  echo "Failed to execute SQL commands for creating the RAG functions"
   exit 1
 else
-    echo "Executed SQL successfuly and the RAG function is in place in database $ALLOYDB_DB."
+    echo "Executed SQL successfuly and the RAG functions are in place in database $ALLOYDB_DB."
 fi
 
 
@@ -0,0 +1,196 @@
+package llm
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"os/signal"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+
+	"cloud.google.com/go/alloydbconn"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"golang.org/x/sync/singleflight"
+)
+
+// alloy-db stuff. The loader and sofhir both connect through this package
+var (
+	REGION       = os.Getenv("REGION")
+	PROJECT_ID   = os.Getenv("PROJECT_ID")
+	ADB_IAM_USER = os.Getenv("ADB_IAM_USER")
+	ADB_CLUSTER  = os.Getenv("ADB_CLUSTER")
+	ADB_INSTANCE = os.Getenv("ADB_INSTANCE")
+	ADB_DATABASE = os.Getenv("ADB_DATABASE")
+
+	// optional pool settings. Durations are Go durations (eg. 30m). The pgxpool defaults are used when they're not set
+	ADB_MAX_CONNS           = os.Getenv("ADB_MAX_CONNS")
+	ADB_MIN_CONNS           = os.Getenv("ADB_MIN_CONNS")
+	ADB_MAX_CONN_LIFETIME   = os.Getenv("ADB_MAX_CONN_LIFETIME")
+	ADB_MAX_CONN_IDLE_TIME  = os.Getenv("ADB_MAX_CONN_IDLE_TIME")
+	ADB_HEALTH_CHECK_PERIOD = os.Getenv("ADB_HEALTH_CHECK_PERIOD")
+)
+
+// the AlloyDB dialer and connection pool are created on first use and shared by everything the function
+// instance (or cmd tool) does: the loader's events and backfill workers, sofhir's RAG requests and the models
+var connection struct {
+	sync.Mutex
+	dialer *alloydbconn.Dialer
+	pool   *pgxpool.Pool
+}
+
+// one caller creates the pool while the others wait for it, instead of each dialing their own
+var connecting singleflight.Group
+
+// returns the shared connection pool, creating it on the first call. Callers must not close it
+func GetConnection(ctx context.Context) (*pgxpool.Pool, error) {
+	connection.Lock()
+	pool := connection.pool
+	connection.Unlock()
+	if pool != nil {
+		return pool, nil
+	}
+
+	result, err, _ := connecting.Do("pool", func() (interface{}, error) {
+		return connect(ctx)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return result.(*pgxpool.Pool), nil
+}
+
+// dials AlloyDB and publishes the pool. The lock is only held to publish it, so the callers that already
+// have the pool aren't held up by the dial, and CloseConnection doesn't wait for a database that can't be reached
+func connect(ctx context.Context) (*pgxpool.Pool, error) {
+	connection.Lock()
+	pool := connection.pool
+	connection.Unlock()
+	// published by the previous caller, between the check in GetConnection and this one
+	if pool != nil {
+		return pool, nil
+	}
+
+	// the connector refreshes the IAM token and its client certificate in the background,
+	// so connections opened hours after the pool was created still authenticate
+	dialer, err := alloydbconn.NewDialer(context.Background(), alloydbconn.WithIAMAuthN())
+	if err != nil {
+		return nil, fmt.Errorf("Failed to init Dialer: %v", err)
+	}
+
+	config, err := poolConfig(dialer)
+	if err != nil {
+		dialer.Close()
+		return nil, err
+	}
+
+	pool, err = pgxpool.NewWithConfig(context.Background(), config)
+	if err != nil {
+		dialer.Close()
+		return nil, fmt.Errorf("Failed to Connect to AlloyDB: %v", err)
+	}
+	// fail fast when the database can't be reached, the next call tries again
+	if err := pool.Ping(ctx); err != nil {
+		pool.Close()
+		dialer.Close()
+		return nil, fmt.Errorf("Failed to Connect to AlloyDB: %v", err)
+	}
+	fmt.Println("Connected to AlloyDB. Max connections:", config.MaxConns)
+
+	connection.Lock()
+	connection.dialer = dialer
+	connection.pool = pool
+	connection.Unlock()
+	return pool, nil
+}
+
+func poolConfig(dialer *alloydbconn.Dialer) (*pgxpool.Config, error) {
+	// the connector authenticates the IAM user and encrypts the connection itself
+	dsn := fmt.Sprintf("user=%s dbname=%s sslmode=disable", ADB_IAM_USER, ADB_DATABASE)
+	config, err := pgxpool.ParseConfig(dsn)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to parse pgx config: %v", err)
+	}
+
+	// Tell the driver to use the AlloyDB Go Connector to create connections
+	dbInstance := fmt.Sprintf("projects/%s/locations/%s/clusters/%s/instances/%s",
+		PROJECT_ID, REGION, ADB_CLUSTER, ADB_INSTANCE)
+	config.ConnConfig.DialFunc = func(ctx context.Context, _ string, _ string) (net.Conn, error) {
+		return dialer.Dial(ctx, dbInstance)
+	}
+
+	if ADB_MAX_CONNS != "" {
+		maxConns, err := strconv.Atoi(ADB_MAX_CONNS)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid ADB_MAX_CONNS: %v", err)
+		}
+		config.MaxConns = int32(maxConns)
+	}
+	if ADB_MIN_CONNS != "" {
+		minConns, err := strconv.Atoi(ADB_MIN_CONNS)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid ADB_MIN_CONNS: %v", err)
+		}
+		config.MinConns = int32(minConns)
+	}
+	for _, setting := range []struct {
+		name  string
+		value string
+		set   *time.Duration
+	}{
+		{"ADB_MAX_CONN_LIFETIME", ADB_MAX_CONN_LIFETIME, &config.MaxConnLifetime},
+		{"ADB_MAX_CONN_IDLE_TIME", ADB_MAX_CONN_IDLE_TIME, &config.MaxConnIdleTime},
+		{"ADB_HEALTH_CHECK_PERIOD", ADB_HEALTH_CHECK_PERIOD, &config.HealthCheckPeriod},
+	} {
+		if setting.value == "" {
+			continue
+		}
+		duration, err := time.ParseDuration(setting.value)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid %s: %v", setting.name, err)
+		}
+		*setting.set = duration
+	}
+
+	return config, nil
+}
+
+// checks that AlloyDB can be reached through the shared pool
+func PingConnection(ctx context.Context) error {
+	pool, err := GetConnection(ctx)
+	if err != nil {
+		return err
+	}
+	return pool.Ping(ctx)
+}
+
+// closes the shared pool and dialer, eg. when the instance is shutting down.
+// A later GetConnection opens a new one
+func CloseConnection() {
+	connection.Lock()
+	pool, dialer := connection.pool, connection.dialer
+	connection.pool = nil
+	connection.dialer = nil
+	connection.Unlock()
+	if pool == nil {
+		return
+	}
+	// waits for the queries running on the pool, without holding up the callers opening a new one
+	pool.Close()
+	dialer.Close()
+	fmt.Println("Closed the AlloyDB connection")
+}
+
+// closes the shared pool when Cloud Functions shuts the instance down. The process isn't exited here:
+// the events and requests still running finish in the grace period before the instance is stopped
+func CloseConnectionOnShutdown() {
+	go func() {
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, syscall.SIGTERM)
+		<-signals
+		signal.Stop(signals)
+		CloseConnection()
+	}()
+}
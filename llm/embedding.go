@@ -0,0 +1,333 @@
+package llm
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"math"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"unicode"
+)
+
+// where embeddings come from. The loader and sofhir have to use the same provider and model,
+// the query embedding is only compared with the rows embedded by the same model
+var (
+	EMBEDDING_PROVIDER   = os.Getenv("EMBEDDING_PROVIDER")   // alloydb (default), openai or local
+	EMBEDDING_MODEL      = os.Getenv("EMBEDDING_MODEL")      // defaults to ML_EMBEDDING_MODEL
+	EMBEDDING_ENDPOINT   = os.Getenv("EMBEDDING_ENDPOINT")   // openai only: the base url, eg. http://localhost:8080/v1
+	EMBEDDING_API_KEY    = os.Getenv("EMBEDDING_API_KEY")    // openai only
+	EMBEDDING_DIMENSIONS = os.Getenv("EMBEDDING_DIMENSIONS") // openai: passed on when set, local: defaults to 256
+)
+
+// the model being migrated to, while the rows are reindexed. Rows are embedded with it as well and the
+// embedding is kept in the shadow columns until it's promoted. Not set outside of a migration
+var (
+	SHADOW_EMBEDDING_PROVIDER   = os.Getenv("SHADOW_EMBEDDING_PROVIDER") // like EMBEDDING_PROVIDER
+	SHADOW_EMBEDDING_MODEL      = os.Getenv("SHADOW_EMBEDDING_MODEL")    // required for the alloydb and openai providers
+	SHADOW_EMBEDDING_ENDPOINT   = os.Getenv("SHADOW_EMBEDDING_ENDPOINT")
+	SHADOW_EMBEDDING_API_KEY    = os.Getenv("SHADOW_EMBEDDING_API_KEY")
+	SHADOW_EMBEDDING_DIMENSIONS = os.Getenv("SHADOW_EMBEDDING_DIMENSIONS")
+)
+
+// embedding providers
+const (
+	LOCAL_PROVIDER = "local" // deterministic hashed bag of words, for tests and offline runs. No semantics
+
+	// texts are sent to the provider in batches of at most this many
+	EMBEDDING_BATCH_SIZE = 100
+)
+
+// turns texts into vectors, one for each text in the same order
+type Embedder interface {
+	Embed(ctx context.Context, texts []string) ([][]float32, error)
+	// the provider and model of the embeddings, stored with each row. eg. alloydb/textembedding-gecko@001
+	Model() string
+}
+
+var embedder struct {
+	sync.Mutex
+	embedder Embedder
+}
+
+// returns the configured embedder, creating it on the first call
+func GetEmbedder() (Embedder, error) {
+	embedder.Lock()
+	defer embedder.Unlock()
+	if embedder.embedder != nil {
+		return embedder.embedder, nil
+	}
+
+	model := EMBEDDING_MODEL
+	if model == "" {
+		model = ML_EMBEDDING_MODEL
+	}
+	e, err := newEmbedder("EMBEDDING", EMBEDDING_PROVIDER, model, EMBEDDING_ENDPOINT, EMBEDDING_API_KEY, EMBEDDING_DIMENSIONS)
+	if err != nil {
+		return nil, err
+	}
+	fmt.Println("Embedding with", e.Model())
+	embedder.embedder = e
+	return e, nil
+}
+
+var shadowEmbedder struct {
+	sync.Mutex
+	loaded   bool
+	embedder Embedder
+}
+
+// returns the SHADOW_EMBEDDING_* embedder, or nil when there is no migration going on
+func GetShadowEmbedder() (Embedder, error) {
+	shadowEmbedder.Lock()
+	defer shadowEmbedder.Unlock()
+	if shadowEmbedder.loaded {
+		return shadowEmbedder.embedder, nil
+	}
+
+	if SHADOW_EMBEDDING_PROVIDER != "" || SHADOW_EMBEDDING_MODEL != "" {
+		e, err := newEmbedder("SHADOW_EMBEDDING", SHADOW_EMBEDDING_PROVIDER, SHADOW_EMBEDDING_MODEL, SHADOW_EMBEDDING_ENDPOINT,
+			SHADOW_EMBEDDING_API_KEY, SHADOW_EMBEDDING_DIMENSIONS)
+		if err != nil {
+			return nil, err
+		}
+		fmt.Println("Shadow embedding with", e.Model())
+		shadowEmbedder.embedder = e
+	}
+	shadowEmbedder.loaded = true
+	return shadowEmbedder.embedder, nil
+}
+
+// creates the embedder of a provider. prefix is the prefix of the environment variables it was configured with
+func newEmbedder(prefix string, provider string, model string, endpoint string, apiKey string, dimensionsSetting string) (Embedder, error) {
+	var dimensions int
+	if dimensionsSetting != "" {
+		var err error
+		if dimensions, err = strconv.Atoi(dimensionsSetting); err != nil || dimensions < 1 {
+			return nil, fmt.Errorf("Invalid %s_DIMENSIONS: %s", prefix, dimensionsSetting)
+		}
+	}
+
+	switch strings.ToLower(provider) {
+	case "", ALLOYDB_PROVIDER:
+		if model == "" {
+			return nil, fmt.Errorf("No embedding model is set, set %s_MODEL", prefix)
+		}
+		return &alloyDBEmbedder{model: model}, nil
+	case OPENAI_PROVIDER:
+		if endpoint == "" || model == "" {
+			return nil, fmt.Errorf("%s_ENDPOINT and %s_MODEL are required for the %s provider", prefix, prefix, OPENAI_PROVIDER)
+		}
+		return &openAIEmbedder{endpoint: endpoint, apiKey: apiKey, model: model, dimensions: dimensions}, nil
+	case LOCAL_PROVIDER:
+		if dimensions == 0 {
+			dimensions = 256
+		}
+		return &localEmbedder{dimensions: dimensions}, nil
+	}
+	return nil, fmt.Errorf("Unknown %s_PROVIDER: %s", prefix, provider)
+}
+
+// embeds the texts in batches of EMBEDDING_BATCH_SIZE
+func EmbedTexts(ctx context.Context, texts []string) ([][]float32, string, error) {
+	e, err := GetEmbedder()
+	if err != nil {
+		return nil, "", err
+	}
+	return embedWith(ctx, e, texts)
+}
+
+// embeds the texts with the shadow embedder. Returns no embeddings when there is none
+func EmbedShadowTexts(ctx context.Context, texts []string) ([][]float32, string, error) {
+	e, err := GetShadowEmbedder()
+	if err != nil || e == nil {
+		return nil, "", err
+	}
+	return embedWith(ctx, e, texts)
+}
+
+func embedWith(ctx context.Context, e Embedder, texts []string) ([][]float32, string, error) {
+	var embeddings [][]float32
+	for start := 0; start < len(texts); start += EMBEDDING_BATCH_SIZE {
+		end := min(start+EMBEDDING_BATCH_SIZE, len(texts))
+		batch, err := e.Embed(ctx, texts[start:end])
+		if err != nil {
+			return nil, "", fmt.Errorf("Failed to embed the text with %s: %v", e.Model(), err)
+		}
+		if len(batch) != end-start {
+			return nil, "", fmt.Errorf("%s returned %d embeddings for %d texts", e.Model(), len(batch), end-start)
+		}
+		embeddings = append(embeddings, batch...)
+	}
+	return embeddings, e.Model(), nil
+}
+
+// the pgvector text form of the embedding, eg. [0.1,0.2]. Passed as text and cast to vector in SQL
+func VectorText(embedding []float32) interface{} {
+	if embedding == nil {
+		return nil
+	}
+	values := make([]string, len(embedding))
+	for i, value := range embedding {
+		values[i] = strconv.FormatFloat(float64(value), 'g', -1, 32)
+	}
+	return "[" + strings.Join(values, ",") + "]"
+}
+
+// calls the embedding() function of the google_ml_integration extension in AlloyDB
+type alloyDBEmbedder struct {
+	model string
+}
+
+func (e *alloyDBEmbedder) Model() string {
+	return ALLOYDB_PROVIDER + "/" + e.model
+}
+
+func (e *alloyDBEmbedder) Embed(ctx context.Context, texts []string) ([][]float32, error) {
+	conn, err := GetConnection(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	stmt := `SELECT embedding($1, t.text)::real[] FROM unnest($2::text[]) WITH ORDINALITY AS t(text, n) ORDER BY t.n`
+	rows, err := conn.Query(ctx, stmt, e.model, texts)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var embeddings [][]float32
+	for rows.Next() {
+		var embedding []float32
+		if err := rows.Scan(&embedding); err != nil {
+			return nil, err
+		}
+		embeddings = append(embeddings, embedding)
+	}
+	return embeddings, rows.Err()
+}
+
+// calls the embeddings API of OpenAI or of a compatible server
+type openAIEmbedder struct {
+	endpoint   string
+	apiKey     string
+	model      string
+	dimensions int
+}
+
+type openAIEmbeddingRequest struct {
+	Model      string   `json:"model"`
+	Input      []string `json:"input"`
+	Dimensions int      `json:"dimensions,omitempty"`
+}
+
+type openAIEmbeddingResponse struct {
+	Data []struct {
+		Index     int       `json:"index"`
+		Embedding []float32 `json:"embedding"`
+	} `json:"data"`
+}
+
+func (e *openAIEmbedder) Model() string {
+	return OPENAI_PROVIDER + "/" + e.model
+}
+
+func (e *openAIEmbedder) Embed(ctx context.Context, texts []string) ([][]float32, error) {
+	body, err := json.Marshal(openAIEmbeddingRequest{Model: e.model, Input: texts, Dimensions: e.dimensions})
+	if err != nil {
+		return nil, err
+	}
+
+	url := strings.TrimSuffix(e.endpoint, "/") + "/embeddings"
+	req, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewReader(body))
+	if err != nil {
+		return nil, fmt.Errorf("Failed to create the request: %v", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if e.apiKey != "" {
+		req.Header.Set("Authorization", "Bearer "+e.apiKey)
+	}
+
+	resp, err := openAIClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to call %s: %v", url, err)
+	}
+	defer resp.Body.Close()
+	respBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read the response: %v", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("status %d: %s", resp.StatusCode, respBody)
+	}
+
+	var embeddingResp openAIEmbeddingResponse
+	if err := json.Unmarshal(respBody, &embeddingResp); err != nil {
+		return nil, fmt.Errorf("Failed to parse the response: %v", err)
+	}
+	// the data comes with the index of the input it belongs to
+	embeddings := make([][]float32, len(texts))
+	for _, data := range embeddingResp.Data {
+		if data.Index < 0 || data.Index >= len(texts) {
+			return nil, fmt.Errorf("Embedding index %d out of range", data.Index)
+		}
+		embeddings[data.Index] = data.Embedding
+	}
+	for i, embedding := range embeddings {
+		if embedding == nil {
+			return nil, fmt.Errorf("No embedding returned for text %d", i)
+		}
+	}
+	return embeddings, nil
+}
+
+// hashes the lowercased words of the text into a vector of the configured size and normalizes it.
+// The same text always gives the same vector and texts sharing words are close, which is enough
+// to test retrieval without a model
+type localEmbedder struct {
+	dimensions int
+}
+
+func (e *localEmbedder) Model() string {
+	return fmt.Sprintf("%s/hash-%d", LOCAL_PROVIDER, e.dimensions)
+}
+
+func (e *localEmbedder) Embed(ctx context.Context, texts []string) ([][]float32, error) {
+	embeddings := make([][]float32, len(texts))
+	for i, text := range texts {
+		embedding := make([]float32, e.dimensions)
+		words := strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+			return !unicode.IsLetter(r) && !unicode.IsNumber(r)
+		})
+		for _, word := range words {
+			h := fnv.New64a()
+			h.Write([]byte(word))
+			sum := h.Sum64()
+			// the top bit picks the sign, so unrelated words cancel out rather than add up
+			sign := float32(1)
+			if sum>>63 == 1 {
+				sign = -1
+			}
+			embedding[sum%uint64(e.dimensions)] += sign
+		}
+
+		var norm float64
+		for _, value := range embedding {
+			norm += float64(value) * float64(value)
+		}
+		if norm > 0 {
+			norm = math.Sqrt(norm)
+			for j := range embedding {
+				embedding[j] = float32(float64(embedding[j]) / norm)
+			}
+		}
+		embeddings[i] = embedding
+	}
+	return embeddings, nil
+}
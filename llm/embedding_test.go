@@ -0,0 +1,163 @@
+package llm
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"testing"
+)
+
+// sets the embedding configuration for the test and drops the embedders made with the one before,
+// restoring both when the test is done
+func useEmbeddingConfig(t *testing.T, provider string, dimensions string, shadowProvider string, shadowDimensions string) {
+	configured := []string{EMBEDDING_PROVIDER, EMBEDDING_DIMENSIONS, SHADOW_EMBEDDING_PROVIDER, SHADOW_EMBEDDING_DIMENSIONS}
+	reset := func() {
+		embedder.embedder = nil
+		shadowEmbedder.embedder, shadowEmbedder.loaded = nil, false
+	}
+	t.Cleanup(func() {
+		EMBEDDING_PROVIDER, EMBEDDING_DIMENSIONS = configured[0], configured[1]
+		SHADOW_EMBEDDING_PROVIDER, SHADOW_EMBEDDING_DIMENSIONS = configured[2], configured[3]
+		reset()
+	})
+	EMBEDDING_PROVIDER, EMBEDDING_DIMENSIONS = provider, dimensions
+	SHADOW_EMBEDDING_PROVIDER, SHADOW_EMBEDDING_DIMENSIONS = shadowProvider, shadowDimensions
+	reset()
+}
+
+func TestLocalEmbedderDimensions(t *testing.T) {
+	for _, test := range []struct {
+		dimensions string
+		want       int
+	}{
+		{"", 256},
+		{"64", 64},
+		{"512", 512},
+	} {
+		t.Run(fmt.Sprintf("%q", test.dimensions), func(t *testing.T) {
+			useEmbeddingConfig(t, LOCAL_PROVIDER, test.dimensions, "", "")
+			embeddings, model, err := EmbedTexts(context.Background(), []string{"chest pain", "", "Type 2 diabetes mellitus"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if want := fmt.Sprintf("local/hash-%d", test.want); model != want {
+				t.Errorf("model is %s, want %s", model, want)
+			}
+			if len(embeddings) != 3 {
+				t.Fatalf("%d embeddings for 3 texts", len(embeddings))
+			}
+			for i, embedding := range embeddings {
+				if len(embedding) != test.want {
+					t.Errorf("embedding %d has %d dimensions, want %d", i, len(embedding), test.want)
+				}
+			}
+			// texts with words are normalized, an empty text stays all zeros
+			if norm := vectorNorm(embeddings[0]); math.Abs(norm-1) > 1e-5 {
+				t.Errorf("the norm of the embedding is %f, want 1", norm)
+			}
+			if norm := vectorNorm(embeddings[1]); norm != 0 {
+				t.Errorf("the norm of the empty text's embedding is %f, want 0", norm)
+			}
+		})
+	}
+}
+
+func TestInvalidEmbeddingDimensions(t *testing.T) {
+	for _, dimensions := range []string{"0", "-3", "wide"} {
+		useEmbeddingConfig(t, LOCAL_PROVIDER, dimensions, "", "")
+		if _, err := GetEmbedder(); err == nil {
+			t.Errorf("EMBEDDING_DIMENSIONS=%s was accepted", dimensions)
+		}
+	}
+}
+
+func TestLocalEmbedderIsDeterministic(t *testing.T) {
+	useEmbeddingConfig(t, LOCAL_PROVIDER, "128", "", "")
+	texts := []string{"Chest pain, resolved.", "chest PAIN resolved", "Hemoglobin A1c 7.2 %"}
+
+	// more texts than a batch, so the batches have to line up as well
+	var batched []string
+	for i := 0; i < EMBEDDING_BATCH_SIZE+10; i++ {
+		batched = append(batched, texts[i%len(texts)])
+	}
+	first, _, err := EmbedTexts(context.Background(), texts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, _, err := EmbedTexts(context.Background(), batched)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(second) != len(batched) {
+		t.Fatalf("%d embeddings for %d texts", len(second), len(batched))
+	}
+	for i, embedding := range second {
+		if VectorText(embedding) != VectorText(first[i%len(texts)]) {
+			t.Errorf("text %d was embedded differently the second time", i)
+		}
+	}
+
+	// only the words count, not their case or punctuation
+	if VectorText(first[0]) != VectorText(first[1]) {
+		t.Error("the same words in another case and punctuation were embedded differently")
+	}
+	if VectorText(first[0]) == VectorText(first[2]) {
+		t.Error("different texts have the same embedding")
+	}
+}
+
+func TestShadowEmbedder(t *testing.T) {
+	t.Run("no migration", func(t *testing.T) {
+		useEmbeddingConfig(t, LOCAL_PROVIDER, "32", "", "")
+		shadow, err := GetShadowEmbedder()
+		if err != nil || shadow != nil {
+			t.Fatalf("got a shadow embedder %v without SHADOW_EMBEDDING_*: %v", shadow, err)
+		}
+		embeddings, model, err := EmbedShadowTexts(context.Background(), []string{"chest pain"})
+		if err != nil || embeddings != nil || model != "" {
+			t.Errorf("EmbedShadowTexts returned %d embeddings of %q: %v", len(embeddings), model, err)
+		}
+	})
+
+	t.Run("migration", func(t *testing.T) {
+		useEmbeddingConfig(t, LOCAL_PROVIDER, "32", LOCAL_PROVIDER, "48")
+		embeddings, model, err := EmbedTexts(context.Background(), []string{"chest pain"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		shadowEmbeddings, shadowModel, err := EmbedShadowTexts(context.Background(), []string{"chest pain"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if model != "local/hash-32" || shadowModel != "local/hash-48" {
+			t.Errorf("the models are %s and %s, want local/hash-32 and local/hash-48", model, shadowModel)
+		}
+		if len(embeddings[0]) != 32 || len(shadowEmbeddings[0]) != 48 {
+			t.Errorf("the embeddings have %d and %d dimensions, want 32 and 48", len(embeddings[0]), len(shadowEmbeddings[0]))
+		}
+	})
+
+	t.Run("invalid", func(t *testing.T) {
+		useEmbeddingConfig(t, LOCAL_PROVIDER, "32", "word2vec", "")
+		if _, err := GetShadowEmbedder(); err == nil {
+			t.Error("an unknown SHADOW_EMBEDDING_PROVIDER was accepted")
+		}
+	})
+}
+
+func TestVectorText(t *testing.T) {
+	if got := VectorText(nil); got != nil {
+		t.Errorf("VectorText(nil) is %v, want nil", got)
+	}
+	if got := VectorText([]float32{0.5, -1, 0.1}); got != "[0.5,-1,0.1]" {
+		t.Errorf("VectorText is %v, want [0.5,-1,0.1]", got)
+	}
+}
+
+func vectorNorm(embedding []float32) float64 {
+	var norm float64
+	for _, value := range embedding {
+		norm += float64(value) * float64(value)
+	}
+	return math.Sqrt(norm)
+}
@@ -0,0 +1,91 @@
+package llm
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/google/generative-ai-go/genai"
+	"google.golang.org/api/option"
+)
+
+const (
+	GEMINI_API_KEY_ENV_VAR string = "GEMINI_API_KEY"
+)
+
+// the {USE}_LLM_SAFETY_THRESHOLD values: the lowest harm probability that gets blocked
+var harmBlockThresholds = map[string]genai.HarmBlockThreshold{
+	"none":   genai.HarmBlockNone,
+	"high":   genai.HarmBlockOnlyHigh,
+	"medium": genai.HarmBlockMediumAndAbove,
+	"low":    genai.HarmBlockLowAndAbove,
+}
+
+// calls a Gemini model with the Gemini API
+type geminiGenerator struct {
+	client    *genai.Client
+	model     *genai.GenerativeModel
+	modelName string
+}
+
+func newGeminiGenerator(ctx context.Context, config *GenerationConfig) (*geminiGenerator, error) {
+	if config.APIKey == "" {
+		return nil, fmt.Errorf("Gemini API key is not set or empty")
+	}
+
+	// the client is kept for the life of the instance
+	client, err := genai.NewClient(context.Background(), option.WithAPIKey(config.APIKey))
+	if err != nil {
+		return nil, fmt.Errorf("Failed to genAI client: %v", err)
+	}
+
+	model := client.GenerativeModel(config.Model)
+	if config.MaxOutputTokens != nil {
+		model.SetMaxOutputTokens(*config.MaxOutputTokens)
+	}
+	if config.TopK != nil {
+		model.SetTopK(*config.TopK)
+	}
+	if config.TopP != nil {
+		model.SetTopP(*config.TopP)
+	}
+	if config.Temperature != nil {
+		model.SetTemperature(*config.Temperature)
+	}
+	if threshold, ok := harmBlockThresholds[config.SafetyThreshold]; ok {
+		for _, category := range []genai.HarmCategory{
+			genai.HarmCategoryHateSpeech,
+			genai.HarmCategorySexuallyExplicit,
+			genai.HarmCategoryDangerousContent,
+			genai.HarmCategoryHarassment,
+		} {
+			model.SafetySettings = append(model.SafetySettings, &genai.SafetySetting{Category: category, Threshold: threshold})
+		}
+	}
+
+	return &geminiGenerator{client: client, model: model, modelName: config.Model}, nil
+}
+
+func (g *geminiGenerator) Model() string {
+	return GEMINI_PROVIDER + "/" + g.modelName
+}
+
+func (g *geminiGenerator) GenerateText(ctx context.Context, prompt string) (string, error) {
+	resp, err := g.model.GenerateContent(ctx, genai.Text(prompt))
+	if err != nil {
+		return "", fmt.Errorf("Failed to Generate Content: %v", err)
+	}
+	// only the first candidate is used
+	var content strings.Builder
+	if len(resp.Candidates) > 0 && resp.Candidates[0].Content != nil {
+		for _, part := range resp.Candidates[0].Content.Parts {
+			if text, ok := part.(genai.Text); ok {
+				content.WriteString(string(text))
+			}
+		}
+	}
+	if content.Len() == 0 {
+		return "", fmt.Errorf("The model returned no content")
+	}
+	return content.String(), nil
+}
@@ -0,0 +1,223 @@
+// Package llm holds what the loader and sofhir share to reach the models: the text generators of each use,
+// the embedders and the prompt template library. Both read the same environment variables through it, so a
+// setting means the same in either
+package llm
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// text generation providers
+const (
+	ALLOYDB_PROVIDER = "alloydb" // a Vertex AI model called with ML_PREDICT_ROW in AlloyDB
+	GEMINI_PROVIDER  = "gemini"  // the Gemini API
+	OPENAI_PROVIDER  = "openai"  // any OpenAI compatible chat completions endpoint, eg. a local server
+)
+
+// what a model is used for. Each use is configured with its own {USE}_LLM_* environment variables
+const (
+	SUMMARY_USE = "SUMMARY" // the loader's resource summaries
+	RAG_USE     = "RAG"     // sofhir's answers
+)
+
+// the key of the prompt in the instance ML_PREDICT_ROW sends to the model of a use, {USE}_LLM_PROMPT_KEY when it's set.
+// The summaries have always been sent as the content of a chat instance and the RAG prompts as the prompt of a text one
+var alloyDBPromptKeys = map[string]string{
+	SUMMARY_USE: "content",
+	RAG_USE:     "prompt",
+}
+
+// the model and parameters of the AlloyDB setup, the defaults for every use
+var (
+	ML_EMBEDDING_MODEL   = os.Getenv("ML_EMBEDDING_MODEL")
+	ML_GEN_AI_MODEL      = os.Getenv("ML_GEN_AI_MODEL")
+	ML_MAX_OUTPUT_TOKENS = os.Getenv("ML_MAX_OUTPUT_TOKENS")
+	ML_TOPK              = os.Getenv("ML_TOPK")
+	ML_TOPP              = os.Getenv("ML_TOPP")
+	ML_TEMPERATURE       = os.Getenv("ML_TEMPERATURE")
+)
+
+// generates text for a prompt with the model configured for a use
+type TextGenerator interface {
+	GenerateText(ctx context.Context, prompt string) (string, error)
+	// the provider and model, eg. alloydb/text-bison
+	Model() string
+}
+
+// the model, generation parameters and safety settings for one use. Parameters that are not set
+// are left to the model's defaults
+type GenerationConfig struct {
+	Provider        string
+	Model           string
+	MaxOutputTokens *int32
+	TopK            *int32
+	TopP            *float32
+	Temperature     *float32
+	SafetyThreshold string // gemini only: none, high, medium or low. The model's default when it's not set
+	Endpoint        string // openai only: the base url, eg. http://localhost:8080/v1
+	PromptKey       string // alloydb only: the key of the prompt in the model's instance, eg. prompt or content
+	APIKey          string
+}
+
+// reads the configuration of a use from the environment:
+// {USE}_LLM_PROVIDER, {USE}_LLM_MODEL, {USE}_LLM_MAX_OUTPUT_TOKENS, {USE}_LLM_TOP_K, {USE}_LLM_TOP_P,
+// {USE}_LLM_TEMPERATURE, {USE}_LLM_SAFETY_THRESHOLD, {USE}_LLM_ENDPOINT, {USE}_LLM_API_KEY and {USE}_LLM_PROMPT_KEY.
+// The provider defaults to alloydb, the model and parameters to the ML_* variables of the AlloyDB setup
+func GetGenerationConfig(use string) (*GenerationConfig, error) {
+	setting := func(name string, fallback string) string {
+		if value := os.Getenv(use + "_LLM_" + name); value != "" {
+			return value
+		}
+		return fallback
+	}
+
+	config := &GenerationConfig{
+		Provider:        strings.ToLower(setting("PROVIDER", ALLOYDB_PROVIDER)),
+		Model:           setting("MODEL", ML_GEN_AI_MODEL),
+		SafetyThreshold: strings.ToLower(setting("SAFETY_THRESHOLD", "")),
+		Endpoint:        setting("ENDPOINT", ""),
+		APIKey:          setting("API_KEY", ""),
+		PromptKey:       setting("PROMPT_KEY", alloyDBPromptKeys[use]),
+	}
+	var err error
+	if config.MaxOutputTokens, err = parseInt32(use+"_LLM_MAX_OUTPUT_TOKENS", setting("MAX_OUTPUT_TOKENS", ML_MAX_OUTPUT_TOKENS)); err != nil {
+		return nil, err
+	}
+	if config.TopK, err = parseInt32(use+"_LLM_TOP_K", setting("TOP_K", ML_TOPK)); err != nil {
+		return nil, err
+	}
+	if config.TopP, err = parseFloat32(use+"_LLM_TOP_P", setting("TOP_P", ML_TOPP)); err != nil {
+		return nil, err
+	}
+	if config.Temperature, err = parseFloat32(use+"_LLM_TEMPERATURE", setting("TEMPERATURE", ML_TEMPERATURE)); err != nil {
+		return nil, err
+	}
+
+	switch config.Provider {
+	case ALLOYDB_PROVIDER:
+		if config.PromptKey == "" {
+			config.PromptKey = "prompt"
+		}
+	case GEMINI_PROVIDER:
+		if config.APIKey == "" {
+			config.APIKey = os.Getenv(GEMINI_API_KEY_ENV_VAR)
+		}
+		if _, ok := harmBlockThresholds[config.SafetyThreshold]; !ok && config.SafetyThreshold != "" {
+			return nil, fmt.Errorf("Invalid %s_LLM_SAFETY_THRESHOLD: %s", use, config.SafetyThreshold)
+		}
+	case OPENAI_PROVIDER:
+		if config.Endpoint == "" {
+			return nil, fmt.Errorf("%s_LLM_ENDPOINT is required for the %s provider", use, OPENAI_PROVIDER)
+		}
+	default:
+		return nil, fmt.Errorf("Unknown %s_LLM_PROVIDER: %s", use, config.Provider)
+	}
+	if config.Model == "" {
+		return nil, fmt.Errorf("No model is set for %s, set %s_LLM_MODEL", use, use)
+	}
+	return config, nil
+}
+
+func NewTextGenerator(ctx context.Context, config *GenerationConfig) (TextGenerator, error) {
+	switch config.Provider {
+	case ALLOYDB_PROVIDER:
+		return &alloyDBGenerator{config: config}, nil
+	case GEMINI_PROVIDER:
+		return newGeminiGenerator(ctx, config)
+	case OPENAI_PROVIDER:
+		return &openAIGenerator{config: config}, nil
+	}
+	return nil, fmt.Errorf("Unknown text generation provider: %s", config.Provider)
+}
+
+// generators are created once per use and shared, like the AlloyDB connection
+var textGenerators = struct {
+	sync.Mutex
+	generators map[string]TextGenerator
+}{generators: map[string]TextGenerator{}}
+
+// returns the text generator configured for the use
+func GetTextGenerator(ctx context.Context, use string) (TextGenerator, error) {
+	textGenerators.Lock()
+	defer textGenerators.Unlock()
+	if generator, ok := textGenerators.generators[use]; ok {
+		return generator, nil
+	}
+
+	config, err := GetGenerationConfig(use)
+	if err != nil {
+		return nil, err
+	}
+	generator, err := NewTextGenerator(ctx, config)
+	if err != nil {
+		return nil, err
+	}
+	fmt.Println("Generating", strings.ToLower(use), "text with", generator.Model())
+	textGenerators.generators[use] = generator
+	return generator, nil
+}
+
+// calls the model in AlloyDB with ML_PREDICT_ROW, so the model is reached through the
+// Vertex AI integration of the AlloyDB instance
+type alloyDBGenerator struct {
+	config *GenerationConfig
+}
+
+func (g *alloyDBGenerator) Model() string {
+	return ALLOYDB_PROVIDER + "/" + g.config.Model
+}
+
+func (g *alloyDBGenerator) GenerateText(ctx context.Context, prompt string) (string, error) {
+	conn, err := GetConnection(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	// parameters that are not set are left out, so the model's defaults apply
+	stmt := `SELECT ML_PREDICT_ROW(
+			'publishers/google/models/' || $2,
+			json_build_object('instances',
+				json_build_object($7::text, $1::text),
+				'parameters', json_strip_nulls(json_build_object('maxOutputTokens', $3::numeric,'topK', $4::numeric,'topP', $5::float,'temperature', $6::float))
+			)
+		)->'predictions'->0->>'content'`
+	var content *string
+	err = conn.QueryRow(ctx, stmt, prompt, g.config.Model,
+		g.config.MaxOutputTokens, g.config.TopK, g.config.TopP, g.config.Temperature, g.config.PromptKey).Scan(&content)
+	if err != nil {
+		return "", fmt.Errorf("Failed to call ML_PREDICT_ROW: %v", err)
+	}
+	if content == nil || *content == "" {
+		return "", fmt.Errorf("The model returned no content")
+	}
+	return *content, nil
+}
+
+func parseInt32(name string, value string) (*int32, error) {
+	if value == "" {
+		return nil, nil
+	}
+	parsed, err := strconv.ParseInt(value, 10, 32)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid %s: %v", name, err)
+	}
+	result := int32(parsed)
+	return &result, nil
+}
+
+func parseFloat32(name string, value string) (*float32, error) {
+	if value == "" {
+		return nil, nil
+	}
+	parsed, err := strconv.ParseFloat(value, 32)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid %s: %v", name, err)
+	}
+	result := float32(parsed)
+	return &result, nil
+}
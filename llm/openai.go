@@ -0,0 +1,89 @@
+package llm
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+var openAIClient = &http.Client{Timeout: 2 * time.Minute}
+
+// calls the chat completions API of OpenAI or of a compatible server (eg. vLLM, llama.cpp or Ollama)
+type openAIGenerator struct {
+	config *GenerationConfig
+}
+
+type openAIMessage struct {
+	Role    string `json:"role"`
+	Content string `json:"content"`
+}
+
+type openAIRequest struct {
+	Model       string          `json:"model"`
+	Messages    []openAIMessage `json:"messages"`
+	MaxTokens   *int32          `json:"max_tokens,omitempty"`
+	Temperature *float32        `json:"temperature,omitempty"`
+	TopP        *float32        `json:"top_p,omitempty"`
+	TopK        *int32          `json:"top_k,omitempty"` // not part of the OpenAI API, but understood by most local servers
+}
+
+type openAIResponse struct {
+	Choices []struct {
+		Message openAIMessage `json:"message"`
+	} `json:"choices"`
+}
+
+func (g *openAIGenerator) Model() string {
+	return OPENAI_PROVIDER + "/" + g.config.Model
+}
+
+func (g *openAIGenerator) GenerateText(ctx context.Context, prompt string) (string, error) {
+	body, err := json.Marshal(openAIRequest{
+		Model:       g.config.Model,
+		Messages:    []openAIMessage{{Role: "user", Content: prompt}},
+		MaxTokens:   g.config.MaxOutputTokens,
+		Temperature: g.config.Temperature,
+		TopP:        g.config.TopP,
+		TopK:        g.config.TopK,
+	})
+	if err != nil {
+		return "", err
+	}
+
+	url := strings.TrimSuffix(g.config.Endpoint, "/") + "/chat/completions"
+	req, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewReader(body))
+	if err != nil {
+		return "", fmt.Errorf("Failed to create the request: %v", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if g.config.APIKey != "" {
+		req.Header.Set("Authorization", "Bearer "+g.config.APIKey)
+	}
+
+	resp, err := openAIClient.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("Failed to call %s: %v", url, err)
+	}
+	defer resp.Body.Close()
+	respBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return "", fmt.Errorf("Failed to read the response: %v", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("Failed to Generate Content, status %d: %s", resp.StatusCode, respBody)
+	}
+
+	var completion openAIResponse
+	if err := json.Unmarshal(respBody, &completion); err != nil {
+		return "", fmt.Errorf("Failed to parse the response: %v", err)
+	}
+	if len(completion.Choices) == 0 || completion.Choices[0].Message.Content == "" {
+		return "", fmt.Errorf("The model returned no content")
+	}
+	return completion.Choices[0].Message.Content, nil
+}
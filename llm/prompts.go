@@ -0,0 +1,223 @@
+package llm
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+)
+
+// the prompt template library. Templates are Go text/template, grouped in versions (eg. v2) and named by their use:
+// summary (or summary.{ResourceType}, eg. summary.Condition) and rag (or rag.{role}, eg. rag.patient).
+// The loader and sofhir read the same library, either from files or from public.prompt_templates
+var (
+	PROMPT_VERSION = os.Getenv("PROMPT_VERSION") // the version of the library to use. The builtin templates when it's not set
+	PROMPT_DIR     = os.Getenv("PROMPT_DIR")     // read {PROMPT_DIR}/{version}/{name}.tmpl instead of the database
+)
+
+// prompt template names, a name may be followed by .{variant} for a resource type or role
+const (
+	SUMMARY_PROMPT = "summary" // summarizes a resource, rendered by the loader
+	RAG_PROMPT     = "rag"     // answers a question from the retrieved summaries, rendered by sofhir
+
+	BUILTIN_PROMPT_VERSION = "builtin" // the templates compiled into the loader and sofhir
+)
+
+// the templates of one version of the library by name
+type PromptLibrary struct {
+	Version   string
+	Templates map[string]string
+}
+
+// loads a version of the library from PROMPT_DIR or the database. The builtin version has no templates of
+// its own, every lookup falls back to the builtin templates
+func LoadPromptLibrary(ctx context.Context, version string) (*PromptLibrary, error) {
+	library := &PromptLibrary{Version: version, Templates: map[string]string{}}
+	if version == "" || version == BUILTIN_PROMPT_VERSION {
+		library.Version = BUILTIN_PROMPT_VERSION
+		return library, nil
+	}
+
+	var err error
+	if PROMPT_DIR != "" {
+		library.Templates, err = ReadPromptFiles(filepath.Join(PROMPT_DIR, version))
+	} else {
+		library.Templates, err = readPromptTemplates(ctx, version)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(library.Templates) == 0 {
+		return nil, fmt.Errorf("No prompt templates of version %s", version)
+	}
+	for name, text := range library.Templates {
+		if _, err := parsePrompt(name, text); err != nil {
+			return nil, fmt.Errorf("Invalid prompt template %s/%s: %v", version, name, err)
+		}
+	}
+	return library, nil
+}
+
+// reads the {name}.tmpl files of a directory
+func ReadPromptFiles(dir string) (map[string]string, error) {
+	files, err := filepath.Glob(filepath.Join(dir, "*.tmpl"))
+	if err != nil {
+		return nil, err
+	}
+	templates := map[string]string{}
+	for _, file := range files {
+		text, err := os.ReadFile(file)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to read the prompt template: %v", err)
+		}
+		templates[strings.TrimSuffix(filepath.Base(file), ".tmpl")] = string(text)
+	}
+	return templates, nil
+}
+
+func readPromptTemplates(ctx context.Context, version string) (map[string]string, error) {
+	conn, err := GetConnection(ctx)
+	if err != nil {
+		return nil, err
+	}
+	rows, err := conn.Query(ctx, `SELECT name, template FROM public.prompt_templates WHERE version = $1`, version)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to read the prompt templates: %v", err)
+	}
+	defer rows.Close()
+
+	templates := map[string]string{}
+	for rows.Next() {
+		var name, text string
+		if err := rows.Scan(&name, &text); err != nil {
+			return nil, fmt.Errorf("Unable to read the prompt templates: %v", err)
+		}
+		templates[name] = text
+	}
+	return templates, rows.Err()
+}
+
+// the library is loaded once, like the text generators
+var promptLibrary struct {
+	sync.Mutex
+	library *PromptLibrary
+}
+
+// returns the PROMPT_VERSION library
+func GetPromptLibrary(ctx context.Context) (*PromptLibrary, error) {
+	promptLibrary.Lock()
+	defer promptLibrary.Unlock()
+	if promptLibrary.library != nil {
+		return promptLibrary.library, nil
+	}
+
+	library, err := LoadPromptLibrary(ctx, PROMPT_VERSION)
+	if err != nil {
+		return nil, err
+	}
+	fmt.Println("Using prompt templates", library.Version)
+	promptLibrary.library = library
+	return library, nil
+}
+
+// the template for the use and variant (eg. summary and Condition), or for the use when the library has none
+// for the variant. Returns the name it was found under
+func (library *PromptLibrary) Lookup(use string, variant string) (string, string, bool) {
+	for _, name := range []string{use + "." + variant, use} {
+		if text, ok := library.Templates[name]; ok {
+			return name, text, true
+		}
+	}
+	return "", "", false
+}
+
+func parsePrompt(name string, text string) (*template.Template, error) {
+	return template.New(name).Option("missingkey=error").Parse(text)
+}
+
+// renders a template with the data, eg. the summary or RAG data of the loader and sofhir
+func RenderPrompt(name string, text string, data interface{}) (string, error) {
+	tmpl, err := parsePrompt(name, text)
+	if err != nil {
+		return "", fmt.Errorf("Invalid prompt template %s: %v", name, err)
+	}
+	var prompt bytes.Buffer
+	if err := tmpl.Execute(&prompt, data); err != nil {
+		return "", fmt.Errorf("Failed to render the prompt template %s: %v", name, err)
+	}
+	return prompt.String(), nil
+}
+
+// a template stored in public.prompt_templates
+type PromptTemplate struct {
+	Name      string
+	Version   string
+	Text      string
+	CreatedAt time.Time
+}
+
+// stores the templates as a version of the library. A version is meant to stay as it is once it's in use,
+// so templates that are stored already are left alone unless replace is set. Returns the names saved
+func SavePromptTemplates(ctx context.Context, version string, templates map[string]string, replace bool) ([]string, error) {
+	if version == "" || version == BUILTIN_PROMPT_VERSION {
+		return nil, fmt.Errorf("Invalid prompt version: %q", version)
+	}
+	for name, text := range templates {
+		if _, err := parsePrompt(name, text); err != nil {
+			return nil, fmt.Errorf("Invalid prompt template %s: %v", name, err)
+		}
+	}
+	conn, err := GetConnection(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	stmt := `INSERT INTO public.prompt_templates (name, version, template) VALUES ($1, $2, $3) ON CONFLICT (name, version) DO NOTHING`
+	if replace {
+		stmt = `INSERT INTO public.prompt_templates (name, version, template) VALUES ($1, $2, $3)
+			ON CONFLICT (name, version) DO UPDATE SET template = EXCLUDED.template, createdAt = now()`
+	}
+	var saved []string
+	for name, text := range templates {
+		tag, err := conn.Exec(ctx, stmt, name, version, text)
+		if err != nil {
+			return saved, fmt.Errorf("Unable to save the prompt template %s: %v", name, err)
+		}
+		if tag.RowsAffected() > 0 {
+			saved = append(saved, name)
+		}
+	}
+	sort.Strings(saved)
+	return saved, nil
+}
+
+// lists the stored templates of a version, or of every version when it's empty
+func ListPromptTemplates(ctx context.Context, version string) ([]PromptTemplate, error) {
+	conn, err := GetConnection(ctx)
+	if err != nil {
+		return nil, err
+	}
+	stmt := `SELECT name, version, template, createdAt FROM public.prompt_templates
+		WHERE $1 = '' OR version = $1 ORDER BY version, name`
+	rows, err := conn.Query(ctx, stmt, version)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to list the prompt templates: %v", err)
+	}
+	defer rows.Close()
+
+	var templates []PromptTemplate
+	for rows.Next() {
+		var t PromptTemplate
+		if err := rows.Scan(&t.Name, &t.Version, &t.Text, &t.CreatedAt); err != nil {
+			return nil, fmt.Errorf("Unable to list the prompt templates: %v", err)
+		}
+		templates = append(templates, t)
+	}
+	return templates, rows.Err()
+}
@@ -0,0 +1,353 @@
+// backfill indexes the resources of an existing FHIR store from FHIR Bulk Data ($export) NDJSON files.
+// Every resource goes through the same GetResourceSummary -> SaveSumamry pipeline as the Pub/Sub loader.
+//
+//	go run ./cmd/backfill -dir ./export -fhir-store projects/X/locations/X/datasets/X/fhirStores/X
+//
+// Progress is written to the checkpoint file as it goes, so an interrupted run picks up where it
+// left off when it is started again with the same checkpoint. Resources that fail are appended to the
+// NDJSON file {checkpoint}.failed, which can be backfilled again on its own with -dir. It doesn't end in
+// .ndjson, so a run of a -dir it is in doesn't pick it up.
+//
+// The patient compartment, organization and Consents of a resource are looked up in the FHIR store, so
+// -fhir-store is needed for a -dry-run as well. It only leaves out the model and AlloyDB.
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"fhirgen.ai/llm"
+	"fhirgen.ai/loader/common"
+)
+
+// max size of a single NDJSON line (resource)
+const MAX_LINE_BYTES = 64 * 1024 * 1024
+
+var (
+	dir            = flag.String("dir", "", "directory with the $export NDJSON files (*.ndjson), or a single NDJSON file")
+	fhirStore      = flag.String("fhir-store", "", "FHIR store the resources were exported from: projects/X/locations/X/datasets/X/fhirStores/X")
+	workers        = flag.Int("workers", 4, "number of resources processed at the same time")
+	checkpointPath = flag.String("checkpoint", "backfill.checkpoint.json", "file that records the progress for resuming")
+	dryRun         = flag.Bool("dry-run", false, "build the summaries but don't generate or save anything to AlloyDB")
+	force          = flag.Bool("force", false, "regenerate the summaries even when the same version or content is stored")
+)
+
+// checkpoint holds the number of lines of each file that have been fully processed
+type checkpoint struct {
+	Lines map[string]int `json:"lines"`
+}
+
+// per resource type counts
+type counts struct {
+	Saved     int
+	Unchanged int
+	Excluded  int
+	Failed    int
+}
+
+type job struct {
+	file string
+	line int
+	json string
+}
+
+type backfill struct {
+	ctx        context.Context
+	checkpoint checkpoint
+	failed     *os.File
+
+	mu     sync.Mutex
+	counts map[string]*counts
+	// lines completed beyond the checkpoint of the file being processed, to move the checkpoint
+	// forward only once every line before it is done
+	completed map[int]bool
+}
+
+func main() {
+	flag.Parse()
+	if *dir == "" {
+		log.Fatal("-dir is required")
+	}
+	if *fhirStore == "" {
+		log.Fatal("-fhir-store is required")
+	}
+	if *workers < 1 {
+		log.Fatal("-workers needs to be at least 1")
+	}
+	if err := common.VerifyConfig(); err != nil {
+		log.Fatalf("Invalid configuration: %v", err)
+	}
+
+	files, err := ndjsonFiles(*dir)
+	if err != nil {
+		log.Fatalf("Failed to list NDJSON files: %v", err)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	defer llm.CloseConnection()
+
+	b := &backfill{ctx: ctx, counts: map[string]*counts{}}
+	if err := b.loadCheckpoint(); err != nil {
+		log.Fatalf("Failed to read the checkpoint: %v", err)
+	}
+	b.failed, err = os.OpenFile(*checkpointPath+".failed", os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		log.Fatalf("Failed to open the failed resources file: %v", err)
+	}
+	defer b.failed.Close()
+
+	start := time.Now()
+	for _, file := range files {
+		if err := b.processFile(file); err != nil {
+			log.Printf("Error processing %s: %v", file, err)
+		}
+		if ctx.Err() != nil {
+			log.Print("Interrupted. Run again with the same -checkpoint to resume")
+			break
+		}
+	}
+
+	b.printCounts(time.Since(start))
+}
+
+// the NDJSON files to load, sorted so that the order is the same when resuming
+func ndjsonFiles(path string) ([]string, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	if !info.IsDir() {
+		return []string{path}, nil
+	}
+
+	var files []string
+	err = filepath.WalkDir(path, func(file string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !entry.IsDir() && strings.HasSuffix(entry.Name(), ".ndjson") {
+			files = append(files, file)
+		}
+		return nil
+	})
+	sort.Strings(files)
+	return files, err
+}
+
+func (b *backfill) processFile(file string) error {
+	done := b.checkpoint.Lines[file]
+	fmt.Printf("Processing %s (resuming after line %d)\n", file, done)
+
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	b.completed = map[int]bool{}
+	jobs := make(chan job)
+	var wg sync.WaitGroup
+	for i := 0; i < *workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := range jobs {
+				// a resource cut short by an interrupt isn't done, it's processed again on resume
+				if b.processResource(j) {
+					b.complete(j)
+				}
+			}
+		}()
+	}
+
+	// save the checkpoint every few seconds while the workers are busy
+	ticker := time.NewTicker(5 * time.Second)
+	defer ticker.Stop()
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 0, 1024*1024), MAX_LINE_BYTES)
+	line := 0
+	for scanner.Scan() && b.ctx.Err() == nil {
+		line++
+		if line <= done {
+			continue
+		}
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" {
+			b.complete(job{file: file, line: line})
+			continue
+		}
+		select {
+		case jobs <- job{file: file, line: line, json: text}:
+		case <-b.ctx.Done():
+		}
+		select {
+		case <-ticker.C:
+			b.saveCheckpoint()
+		default:
+		}
+	}
+	close(jobs)
+	wg.Wait()
+	b.saveCheckpoint()
+
+	return scanner.Err()
+}
+
+// runs a single resource through the summary pipeline. Returns false when it was interrupted
+func (b *backfill) processResource(j job) bool {
+	var resource struct {
+		ResourceType string `json:"resourceType"`
+		Id           string `json:"id"`
+		Meta         struct {
+			VersionId string `json:"versionId"`
+		} `json:"meta"`
+	}
+	if err := json.Unmarshal([]byte(j.json), &resource); err != nil || resource.ResourceType == "" || resource.Id == "" {
+		return b.fail(j, "Unknown", fmt.Errorf("not a FHIR resource: %v", err))
+	}
+
+	if _, ok := common.GetHandler(resource.ResourceType); !ok {
+		b.count(resource.ResourceType, func(c *counts) { c.Excluded++ })
+		return true
+	}
+
+	resourceURI := fmt.Sprintf("%s/fhir/%s/%s", strings.TrimSuffix(*fhirStore, "/"), resource.ResourceType, resource.Id)
+	resourceSummary, err := common.GetResourceSummary(b.ctx, resource.ResourceType, resourceURI, resource.Meta.VersionId, j.json)
+	if errors.Is(err, common.ErrResourceExcluded) {
+		b.count(resource.ResourceType, func(c *counts) { c.Excluded++ })
+		return true
+	}
+	if err != nil {
+		return b.fail(j, resource.ResourceType, err)
+	}
+
+	if !*dryRun {
+		resourceSummary.Force = *force
+		if err := common.SaveSumamry(b.ctx, resourceSummary); err != nil {
+			return b.fail(j, resource.ResourceType, err)
+		}
+	}
+	if resourceSummary.Unchanged {
+		b.count(resource.ResourceType, func(c *counts) { c.Unchanged++ })
+		return true
+	}
+	b.count(resource.ResourceType, func(c *counts) { c.Saved++ })
+	return true
+}
+
+// records the resource as failed. An error of an interrupted run isn't the resource's, so it's
+// left for the resume instead and false is returned
+func (b *backfill) fail(j job, resourceType string, err error) bool {
+	if b.ctx.Err() != nil {
+		log.Printf("Interrupted %s:%d (%s): %v", j.file, j.line, resourceType, err)
+		return false
+	}
+	log.Printf("Failed %s:%d (%s): %v", j.file, j.line, resourceType, err)
+	b.count(resourceType, func(c *counts) { c.Failed++ })
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if _, err := b.failed.WriteString(j.json + "\n"); err != nil {
+		log.Printf("Failed to record the failed resource: %v", err)
+	}
+	return true
+}
+
+func (b *backfill) count(resourceType string, update func(c *counts)) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.counts[resourceType] == nil {
+		b.counts[resourceType] = &counts{}
+	}
+	update(b.counts[resourceType])
+}
+
+// marks the line as done and moves the checkpoint of the file forward over the lines done in a row
+func (b *backfill) complete(j job) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.completed[j.line] = true
+	for b.completed[b.checkpoint.Lines[j.file]+1] {
+		delete(b.completed, b.checkpoint.Lines[j.file]+1)
+		b.checkpoint.Lines[j.file]++
+	}
+}
+
+func (b *backfill) loadCheckpoint() error {
+	b.checkpoint = checkpoint{Lines: map[string]int{}}
+	data, err := os.ReadFile(*checkpointPath)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(data, &b.checkpoint); err != nil {
+		return err
+	}
+	if b.checkpoint.Lines == nil {
+		b.checkpoint.Lines = map[string]int{}
+	}
+	return nil
+}
+
+// writes the checkpoint to a temp file first, so that a crash never leaves a partial checkpoint
+func (b *backfill) saveCheckpoint() {
+	b.mu.Lock()
+	data, err := json.MarshalIndent(b.checkpoint, "", "  ")
+	b.mu.Unlock()
+	if err != nil {
+		log.Printf("Failed to save the checkpoint: %v", err)
+		return
+	}
+	tmp := *checkpointPath + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		log.Printf("Failed to save the checkpoint: %v", err)
+		return
+	}
+	if err := os.Rename(tmp, *checkpointPath); err != nil {
+		log.Printf("Failed to save the checkpoint: %v", err)
+	}
+}
+
+func (b *backfill) printCounts(elapsed time.Duration) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	resourceTypes := make([]string, 0, len(b.counts))
+	for resourceType := range b.counts {
+		resourceTypes = append(resourceTypes, resourceType)
+	}
+	sort.Strings(resourceTypes)
+
+	var total counts
+	fmt.Printf("\n%-24s %10s %10s %10s %10s\n", "ResourceType", "Saved", "Unchanged", "Excluded", "Failed")
+	for _, resourceType := range resourceTypes {
+		c := b.counts[resourceType]
+		fmt.Printf("%-24s %10d %10d %10d %10d\n", resourceType, c.Saved, c.Unchanged, c.Excluded, c.Failed)
+		total.Saved += c.Saved
+		total.Unchanged += c.Unchanged
+		total.Excluded += c.Excluded
+		total.Failed += c.Failed
+	}
+	fmt.Printf("%-24s %10d %10d %10d %10d\n", "Total", total.Saved, total.Unchanged, total.Excluded, total.Failed)
+	if *dryRun {
+		fmt.Println("Dry run: nothing was saved to AlloyDB")
+	}
+	fmt.Println("Elapsed:", elapsed.Round(time.Second))
+}
@@ -0,0 +1,116 @@
+// ledger lists the events recorded in the processing ledger and replays selected ones through the
+// same ProcessEvent pipeline as the Pub/Sub loader.
+//
+//	go run ./cmd/ledger list -status failed -type Observation
+//	go run ./cmd/ledger replay -status failed -patient 123
+//	go run ./cmd/ledger replay -status unchanged -type Condition -force
+//
+// A replay fetches the current version of the resource from the FHIR store. Entries that replay
+// successfully have their dead letter removed.
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"text/tabwriter"
+	"time"
+
+	"fhirgen.ai/llm"
+	"fhirgen.ai/loader/common"
+)
+
+func usage() {
+	fmt.Fprintln(os.Stderr, "usage: ledger list|replay [-status s] [-type t] [-patient p] [-limit n]")
+	fmt.Fprintln(os.Stderr, "  replay also takes -dry-run to list what would be replayed and -force to regenerate unchanged summaries")
+	os.Exit(2)
+}
+
+func main() {
+	if len(os.Args) < 2 {
+		usage()
+	}
+	command := os.Args[1]
+	if command != "list" && command != "replay" {
+		usage()
+	}
+
+	flags := flag.NewFlagSet(command, flag.ExitOnError)
+	var filter common.LedgerFilter
+	flags.StringVar(&filter.Status, "status", "", "only entries with this status: indexed, unchanged, deleted, excluded, consent, skipped, retrying or failed")
+	flags.StringVar(&filter.ResourceType, "type", "", "only entries of this resource type")
+	flags.StringVar(&filter.PatientId, "patient", "", "only entries of this patient")
+	flags.IntVar(&filter.Limit, "limit", 100, "at most this many entries, the most recent first. 0 for all")
+	dryRun := flags.Bool("dry-run", false, "replay: list the entries that would be replayed")
+	force := flags.Bool("force", false, "replay: regenerate the summaries even when the same version or content is stored")
+	flags.Parse(os.Args[2:])
+
+	// failures are what gets replayed unless asked otherwise
+	if command == "replay" && filter.Status == "" {
+		filter.Status = common.LEDGER_FAILED
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	defer llm.CloseConnection()
+
+	entries, err := common.ListLedger(ctx, filter)
+	if err != nil {
+		log.Fatalf("Failed to list the ledger: %v", err)
+	}
+	if command == "list" || *dryRun {
+		printEntries(entries)
+		return
+	}
+
+	if err := common.VerifyConfig(); err != nil {
+		log.Fatalf("Invalid configuration: %v", err)
+	}
+	replay(ctx, entries, *force)
+}
+
+func printEntries(entries []common.LedgerEntry) {
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "UPDATED\tTYPE\tID\tVERSION\tACTION\tPATIENT\tSTATUS\tATTEMPTS\tMODEL\tLATENCY\tERROR")
+	for _, entry := range entries {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\t%d\t%s\t%s\t%s\n", entry.UpdatedAt.Format(time.RFC3339),
+			entry.ResourceType, entry.ResourceId, entry.VersionId, entry.Action, entry.PatientId, entry.Status,
+			entry.Attempts, entry.Model, entry.Latency, entry.Error)
+	}
+	w.Flush()
+	fmt.Println(len(entries), "entries")
+}
+
+// replays the entries one at a time and records each attempt in the ledger
+func replay(ctx context.Context, entries []common.LedgerEntry, force bool) {
+	var replayed, failed int
+	for i := range entries {
+		if ctx.Err() != nil {
+			break
+		}
+		entry := entries[i]
+		entry.Error = ""
+
+		start := time.Now()
+		err := common.ProcessEvent(ctx, &entry, force)
+		entry.Latency = time.Since(start)
+		if err != nil {
+			entry.Status = common.LEDGER_FAILED
+			entry.Error = err.Error()
+			common.RecordEvent(ctx, &entry)
+			fmt.Printf("Failed to replay %s/%s %s: %v\n", entry.ResourceType, entry.ResourceId, entry.VersionId, err)
+			failed++
+			continue
+		}
+		common.RecordEvent(ctx, &entry)
+		if err := common.ResolveDeadLetter(ctx, &entry); err != nil {
+			fmt.Println(err)
+		}
+		fmt.Printf("Replayed %s/%s %s: %s\n", entry.ResourceType, entry.ResourceId, entry.VersionId, entry.Status)
+		replayed++
+	}
+	fmt.Println("Replayed:", replayed, "Failed:", failed)
+}
@@ -0,0 +1,243 @@
+// prompts manages the versions of the prompt template library in AlloyDB and compares the summaries
+// two versions generate for a fixed set of resources.
+//
+//	go run ./cmd/prompts load -dir ../prompts/v2 -version v2
+//	go run ./cmd/prompts list -version v2
+//	go run ./cmd/prompts diff -a v1 -b v2 -resources sample.ndjson -fhir-store projects/X/locations/X/datasets/X/fhirStores/X
+//
+// diff reads the versions from PROMPT_DIR when it's set, like the loader. builtin is the version compiled
+// into the loader. Nothing is saved, but every resource is summarized by the model once per version.
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"fhirgen.ai/llm"
+	"fhirgen.ai/loader/common"
+)
+
+// max size of a single NDJSON line (resource)
+const MAX_LINE_BYTES = 64 * 1024 * 1024
+
+func usage() {
+	fmt.Fprintln(os.Stderr, "usage: prompts load -dir d -version v [-replace]")
+	fmt.Fprintln(os.Stderr, "       prompts list [-version v]")
+	fmt.Fprintln(os.Stderr, "       prompts diff -a v -b v -resources f.ndjson -fhir-store s [-limit n]")
+	os.Exit(2)
+}
+
+func main() {
+	if len(os.Args) < 2 {
+		usage()
+	}
+	command := os.Args[1]
+
+	flags := flag.NewFlagSet(command, flag.ExitOnError)
+	dir := flags.String("dir", "", "load: directory with the {name}.tmpl files of the version")
+	version := flags.String("version", "", "load, list: the version of the templates")
+	replace := flags.Bool("replace", false, "load: replace templates that are stored already")
+	a := flags.String("a", llm.BUILTIN_PROMPT_VERSION, "diff: the version to compare from")
+	b := flags.String("b", "", "diff: the version to compare to")
+	resources := flags.String("resources", "", "diff: NDJSON file with the resources to summarize")
+	fhirStore := flags.String("fhir-store", "", "diff: FHIR store of the resources: projects/X/locations/X/datasets/X/fhirStores/X")
+	limit := flags.Int("limit", 20, "diff: at most this many resources")
+	flags.Parse(os.Args[2:])
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	defer llm.CloseConnection()
+
+	switch command {
+	case "load":
+		if *dir == "" || *version == "" {
+			usage()
+		}
+		load(ctx, *dir, *version, *replace)
+	case "list":
+		list(ctx, *version)
+	case "diff":
+		if *b == "" || *resources == "" || *fhirStore == "" {
+			usage()
+		}
+		if err := common.VerifyConfig(); err != nil {
+			log.Fatalf("Invalid configuration: %v", err)
+		}
+		diff(ctx, *a, *b, *resources, *fhirStore, *limit)
+	default:
+		usage()
+	}
+}
+
+func load(ctx context.Context, dir string, version string, replace bool) {
+	templates, err := llm.ReadPromptFiles(dir)
+	if err != nil {
+		log.Fatalf("Failed to read the prompt templates: %v", err)
+	}
+	if len(templates) == 0 {
+		log.Fatalf("No .tmpl files in %s", dir)
+	}
+	saved, err := llm.SavePromptTemplates(ctx, version, templates, replace)
+	if err != nil {
+		log.Fatalf("Failed to save the prompt templates: %v", err)
+	}
+	fmt.Printf("Saved %d of %d templates as version %s: %s\n", len(saved), len(templates), version, strings.Join(saved, ", "))
+	if len(saved) < len(templates) {
+		fmt.Println("The others are stored already, use -replace to replace them")
+	}
+}
+
+func list(ctx context.Context, version string) {
+	templates, err := llm.ListPromptTemplates(ctx, version)
+	if err != nil {
+		log.Fatalf("Failed to list the prompt templates: %v", err)
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "VERSION\tNAME\tCREATED\tCHARS")
+	for _, t := range templates {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%d\n", t.Version, t.Name, t.CreatedAt.Format(time.RFC3339), len(t.Text))
+	}
+	w.Flush()
+	fmt.Println(len(templates), "templates")
+}
+
+// summarizes each resource with both versions and prints the differences word by word,
+// removed words as [-word-] and added ones as {+word+}
+func diff(ctx context.Context, versionA string, versionB string, resources string, fhirStore string, limit int) {
+	libraryA, err := llm.LoadPromptLibrary(ctx, versionA)
+	if err != nil {
+		log.Fatalf("Failed to load the prompt templates %s: %v", versionA, err)
+	}
+	libraryB, err := llm.LoadPromptLibrary(ctx, versionB)
+	if err != nil {
+		log.Fatalf("Failed to load the prompt templates %s: %v", versionB, err)
+	}
+
+	file, err := os.Open(resources)
+	if err != nil {
+		log.Fatalf("Failed to open the resources: %v", err)
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 1024*1024), MAX_LINE_BYTES)
+
+	var compared, differ int
+	for scanner.Scan() && ctx.Err() == nil && (limit == 0 || compared < limit) {
+		line := scanner.Text()
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		var resource struct {
+			ResourceType string `json:"resourceType"`
+			Id           string `json:"id"`
+			Meta         struct {
+				VersionId string `json:"versionId"`
+			} `json:"meta"`
+		}
+		if err := json.Unmarshal([]byte(line), &resource); err != nil || resource.ResourceType == "" {
+			fmt.Println("Skipping a line that is not a FHIR resource:", err)
+			continue
+		}
+		if _, ok := common.GetHandler(resource.ResourceType); !ok {
+			continue
+		}
+
+		resourceURI := fmt.Sprintf("%s/fhir/%s/%s", strings.TrimSuffix(fhirStore, "/"), resource.ResourceType, resource.Id)
+		resourceSummary, err := common.GetResourceSummary(ctx, resource.ResourceType, resourceURI, resource.Meta.VersionId, line)
+		if errors.Is(err, common.ErrResourceExcluded) {
+			continue
+		}
+		if err != nil {
+			fmt.Printf("Failed to prepare %s/%s: %v\n", resource.ResourceType, resource.Id, err)
+			continue
+		}
+		if resourceSummary.SummarySource != common.MODEL_SUMMARY {
+			// the narrative and local summaries don't use a prompt
+			continue
+		}
+
+		summaryA, summaryB := *resourceSummary, *resourceSummary
+		errA := common.GenerateSummaryWith(ctx, libraryA, &summaryA)
+		errB := common.GenerateSummaryWith(ctx, libraryB, &summaryB)
+		compared++
+
+		fmt.Printf("=== %s/%s\n", resource.ResourceType, resource.Id)
+		if errA != nil || errB != nil {
+			fmt.Printf("Failed to generate the summaries: %v %v\n\n", errA, errB)
+			continue
+		}
+		fmt.Printf("--- %s\n+++ %s\n", summaryA.PromptVersion, summaryB.PromptVersion)
+		if summaryA.GeneratedContent == summaryB.GeneratedContent {
+			fmt.Println("(same summary)")
+		} else {
+			differ++
+			fmt.Println(wordDiff(summaryA.GeneratedContent, summaryB.GeneratedContent))
+		}
+		fmt.Println()
+	}
+	if err := scanner.Err(); err != nil {
+		log.Printf("Error reading %s: %v", resources, err)
+	}
+	fmt.Printf("Compared %d resources, %d summaries differ\n", compared, differ)
+}
+
+// the words of b with the words only in a marked [-removed-] and the words only in b marked {+added+},
+// from the longest common subsequence of their words
+func wordDiff(a string, b string) string {
+	wordsA, wordsB := strings.Fields(a), strings.Fields(b)
+
+	// common[i][j] is the length of the longest common subsequence of wordsA[i:] and wordsB[j:]
+	common := make([][]int, len(wordsA)+1)
+	for i := range common {
+		common[i] = make([]int, len(wordsB)+1)
+	}
+	for i := len(wordsA) - 1; i >= 0; i-- {
+		for j := len(wordsB) - 1; j >= 0; j-- {
+			if wordsA[i] == wordsB[j] {
+				common[i][j] = common[i+1][j+1] + 1
+			} else {
+				common[i][j] = max(common[i+1][j], common[i][j+1])
+			}
+		}
+	}
+
+	var out []string
+	var removed, added []string
+	flush := func() {
+		if len(removed) > 0 {
+			out = append(out, "[-"+strings.Join(removed, " ")+"-]")
+		}
+		if len(added) > 0 {
+			out = append(out, "{+"+strings.Join(added, " ")+"+}")
+		}
+		removed, added = nil, nil
+	}
+	i, j := 0, 0
+	for i < len(wordsA) || j < len(wordsB) {
+		switch {
+		case i < len(wordsA) && j < len(wordsB) && wordsA[i] == wordsB[j]:
+			flush()
+			out = append(out, wordsA[i])
+			i++
+			j++
+		case j == len(wordsB) || (i < len(wordsA) && common[i+1][j] >= common[i][j+1]):
+			removed = append(removed, wordsA[i])
+			i++
+		default:
+			added = append(added, wordsB[j])
+			j++
+		}
+	}
+	flush()
+	return strings.Join(out, " ")
+}
@@ -0,0 +1,231 @@
+// reindex brings the stored rows up to the loader's configuration after the summary model, the prompt
+// templates or the embedding model changed. It uses the same environment variables as the loader.
+//
+//	go run ./cmd/reindex status
+//	go run ./cmd/reindex run -rate 5
+//	go run ./cmd/reindex promote
+//
+// run generates the summaries of another model or prompt template again through GetResourceSummary ->
+// SaveSumamry, from the FHIR JSON stored with the row and in the FHIR store the row is of, and embeds the rows
+// of another embedding model. Rows saved without their FHIR store fail until it's set on them.
+// With SHADOW_EMBEDDING_* set the rows are embedded with that model into the shadow columns, which
+// retrieval uses once sofhir is switched to it, until promote makes them the embeddings of their rows.
+// Rows that are done no longer match, so an interrupted run picks up where it stopped when it's started again.
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"text/tabwriter"
+	"time"
+
+	"fhirgen.ai/llm"
+	"fhirgen.ai/loader/common"
+)
+
+func usage() {
+	fmt.Fprintln(os.Stderr, "usage: reindex status")
+	fmt.Fprintln(os.Stderr, "       reindex run [-batch n] [-rate r] [-dry-run]")
+	fmt.Fprintln(os.Stderr, "       reindex promote [-batch n]")
+	os.Exit(2)
+}
+
+// reindex counts
+type counts struct {
+	Summaries  int
+	Embeddings int
+	Skipped    int
+	Failed     int
+}
+
+func main() {
+	if len(os.Args) < 2 {
+		usage()
+	}
+	command := os.Args[1]
+
+	flags := flag.NewFlagSet(command, flag.ExitOnError)
+	batch := flags.Int("batch", 100, "run, promote: rows read (or promoted) at a time")
+	rate := flags.Float64("rate", 5, "run: at most this many rows per second, 0 for no limit")
+	dryRun := flags.Bool("dry-run", false, "run: count what would be reindexed without doing it")
+	flags.Parse(os.Args[2:])
+	if *batch < 1 {
+		log.Fatal("-batch needs to be at least 1")
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	defer llm.CloseConnection()
+
+	target, err := common.GetReindexTarget(ctx)
+	if err != nil {
+		log.Fatalf("Failed to read the configuration: %v", err)
+	}
+	fmt.Println("Summaries:", target.SummaryModel, "Embeddings:", target.EmbeddingModel)
+	if target.ShadowEmbeddingModel != "" {
+		fmt.Println("Migrating the embeddings to:", target.ShadowEmbeddingModel)
+	}
+
+	switch command {
+	case "status":
+		status(ctx, target)
+	case "run":
+		if err := common.VerifyConfig(); err != nil {
+			log.Fatalf("Invalid configuration: %v", err)
+		}
+		run(ctx, target, *batch, *rate, *dryRun)
+	case "promote":
+		promote(ctx, target, *batch)
+	default:
+		usage()
+	}
+}
+
+func status(ctx context.Context, target *common.ReindexTarget) {
+	indexCounts, err := common.ListIndexCounts(ctx)
+	if err != nil {
+		log.Fatalf("Failed to count the rows: %v", err)
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "EMBEDDING\tSHADOW EMBEDDING\tSUMMARY MODEL\tPROMPT\tROWS")
+	for _, c := range indexCounts {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%d\n", c.EmbeddingModel, c.ShadowEmbeddingModel, c.SummaryModel, c.PromptVersion, c.Rows)
+	}
+	w.Flush()
+
+	left, err := common.CountReindexRows(ctx, target)
+	if err != nil {
+		log.Fatalf("Failed to count the rows to reindex: %v", err)
+	}
+	fmt.Println(left, "rows left to reindex")
+}
+
+func run(ctx context.Context, target *common.ReindexTarget, batch int, rate float64, dryRun bool) {
+	// the model and embedding calls are what the rate is for, one per row
+	var ticker *time.Ticker
+	if rate > 0 {
+		ticker = time.NewTicker(time.Duration(float64(time.Second) / rate))
+		defer ticker.Stop()
+	}
+	wait := func(rows int) {
+		for i := 0; ticker != nil && i < rows && ctx.Err() == nil; i++ {
+			select {
+			case <-ticker.C:
+			case <-ctx.Done():
+			}
+		}
+	}
+
+	start := time.Now()
+	var c counts
+	var after common.RowKey
+	for ctx.Err() == nil {
+		rows, err := common.ListReindexRows(ctx, target, after, batch)
+		if err != nil {
+			log.Fatalf("Failed to read the rows to reindex: %v", err)
+		}
+		if len(rows) == 0 {
+			break
+		}
+		after = rows[len(rows)-1].RowKey
+
+		// a new summary is embedded when it's saved, the other rows are only embedded
+		var embed []common.ReindexRow
+		for _, row := range rows {
+			switch {
+			case ctx.Err() != nil:
+			case row.SummaryStale(target) && dryRun:
+				c.Summaries++
+			case row.SummaryStale(target):
+				wait(1)
+				regenerate(ctx, row, &c)
+			case row.EmbeddingStale(target):
+				embed = append(embed, row)
+			}
+		}
+		if dryRun {
+			c.Embeddings += len(embed)
+		} else if len(embed) > 0 && ctx.Err() == nil {
+			wait(len(embed))
+			updated, err := common.ReindexEmbeddings(ctx, target, embed)
+			c.Embeddings += updated
+			if err != nil {
+				log.Printf("Failed to embed %d rows: %v", len(embed)-updated, err)
+				c.Failed += len(embed) - updated
+			} else {
+				// their summary changed since they were read
+				c.Skipped += len(embed) - updated
+			}
+		}
+		fmt.Printf("Reindexed up to %s/%s/%s: %d summaries, %d embeddings, %d skipped, %d failed\n",
+			after.FHIRStore, after.ResourceType, after.Id, c.Summaries, c.Embeddings, c.Skipped, c.Failed)
+	}
+
+	if ctx.Err() != nil {
+		log.Print("Interrupted. Run again to resume")
+	}
+	if dryRun {
+		fmt.Printf("Dry run: %d summaries to generate and %d rows to embed\n", c.Summaries, c.Embeddings)
+		return
+	}
+	fmt.Printf("Generated %d summaries and embedded %d rows, %d skipped, %d failed in %s\n",
+		c.Summaries, c.Embeddings, c.Skipped, c.Failed, time.Since(start).Round(time.Second))
+	if left, err := common.CountReindexRows(context.Background(), target); err == nil {
+		fmt.Println(left, "rows left to reindex")
+	}
+}
+
+// generates the summary of the resource again from the FHIR JSON stored with it, in the FHIR store of the row
+func regenerate(ctx context.Context, row common.ReindexRow, c *counts) {
+	if row.Data == "" {
+		log.Printf("Failed %s/%s: stored without its FHIR JSON", row.ResourceType, row.Id)
+		c.Failed++
+		return
+	}
+	if row.FHIRStore == "" {
+		log.Printf("Failed %s/%s: stored without its FHIR store", row.ResourceType, row.Id)
+		c.Failed++
+		return
+	}
+	resourceURI := fmt.Sprintf("%s/fhir/%s/%s", row.FHIRStore, row.ResourceType, row.Id)
+	resourceSummary, err := common.GetResourceSummary(ctx, row.ResourceType, resourceURI, row.VersionId, row.Data)
+	if errors.Is(err, common.ErrResourceExcluded) {
+		// the loader removes it when the resource changes next
+		c.Skipped++
+		return
+	}
+	if err == nil {
+		resourceSummary.Force = true
+		err = common.SaveSumamry(ctx, resourceSummary)
+	}
+	if err != nil {
+		log.Printf("Failed %s/%s: %v", row.ResourceType, row.Id, err)
+		c.Failed++
+		return
+	}
+	c.Summaries++
+}
+
+func promote(ctx context.Context, target *common.ReindexTarget, batch int) {
+	if target.ShadowEmbeddingModel == "" {
+		log.Fatal("No embedding migration going on, set SHADOW_EMBEDDING_* to the model being migrated to")
+	}
+	var promoted int64
+	for ctx.Err() == nil {
+		n, err := common.PromoteShadowEmbeddings(ctx, target.ShadowEmbeddingModel, batch)
+		if err != nil {
+			log.Fatalf("Failed to promote the shadow embeddings: %v", err)
+		}
+		if n == 0 {
+			break
+		}
+		promoted += n
+		fmt.Println("Promoted", promoted, "rows")
+	}
+	fmt.Printf("Promoted the %s embeddings of %d rows\n", target.ShadowEmbeddingModel, promoted)
+}
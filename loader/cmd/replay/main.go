@@ -0,0 +1,201 @@
+// replay feeds recorded Pub/Sub messages through the same ProcessMessage path as the loader's Cloud Functions,
+// to reproduce an event locally without hand-crafting CloudEvents.
+//
+//	go run ./cmd/replay -events ./message.json
+//	go run ./cmd/replay -events ./events.ndjson -source files -resources ./export -sink stdout
+//	go run ./cmd/replay -events ./events -source files -resources ./export -sink file -out replay.ndjson -generate
+//
+// An event is a MessagePublishedData (the data of the Eventarc CloudEvent, or the body of a push request)
+// or a structured CloudEvent with one as its data. -events takes a .json file with one event, an NDJSON
+// file with one per line, or a directory of those.
+//
+// -source fhir reads the resources from the Cloud Healthcare API like the loader. -source files reads them
+// from the FHIR JSON (a resource or a Bundle) and NDJSON files of -resources, eg. a $export, and answers the
+// loader's searches from them. -sink alloydb saves like the loader. -sink stdout and -sink file write the
+// summaries, deletions, ledger entries and dead letters as NDJSON instead, nothing goes to AlloyDB; the model
+// summary is only generated for them with -generate. A replayed event is never too old to retry, so a
+// transient failure is reported rather than dead-lettered.
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"fhirgen.ai/llm"
+	"fhirgen.ai/loader/common"
+)
+
+// max size of a single NDJSON line
+const MAX_LINE_BYTES = 64 * 1024 * 1024
+
+var (
+	eventsPath = flag.String("events", "", "a .json event, an NDJSON file of events, or a directory of those")
+	source     = flag.String("source", "fhir", "where the resources are read from: fhir (the Cloud Healthcare API) or files")
+	resources  = flag.String("resources", "", "files: a directory of FHIR JSON and NDJSON files, or a single file")
+	sink       = flag.String("sink", "alloydb", "where the outcome goes: alloydb, stdout or file")
+	out        = flag.String("out", "replay.ndjson", "file: the NDJSON file the outcome is appended to")
+	generate   = flag.Bool("generate", false, "stdout and file: generate the model summary with SUMMARY_LLM_PROVIDER")
+)
+
+func main() {
+	flag.Parse()
+	if *eventsPath == "" {
+		log.Fatal("-events is required")
+	}
+	if err := common.VerifyConfig(); err != nil {
+		log.Fatalf("Invalid configuration: %v", err)
+	}
+
+	switch *source {
+	case "fhir":
+	case "files":
+		if *resources == "" {
+			log.Fatal("-resources is required for -source files")
+		}
+		files, err := loadFiles(*resources)
+		if err != nil {
+			log.Fatalf("Failed to load the resources: %v", err)
+		}
+		common.SetFHIRSource(files)
+	default:
+		log.Fatalf("Unknown -source: %s", *source)
+	}
+
+	switch *sink {
+	case "alloydb":
+	case "stdout":
+		common.SetSink(&writerSink{w: os.Stdout, generate: *generate})
+	case "file":
+		f, err := os.OpenFile(*out, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+		if err != nil {
+			log.Fatalf("Failed to open %s: %v", *out, err)
+		}
+		defer f.Close()
+		common.SetSink(&writerSink{w: f, generate: *generate})
+	default:
+		log.Fatalf("Unknown -sink: %s", *sink)
+	}
+
+	files, err := eventFiles(*eventsPath)
+	if err != nil {
+		log.Fatalf("Failed to list the event files: %v", err)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	defer llm.CloseConnection()
+
+	var replayed, failed int
+	for _, file := range files {
+		err := readEvents(file, func(name string, raw []byte) {
+			if ctx.Err() != nil {
+				return
+			}
+			msg, err := parseEvent(raw)
+			if err == nil {
+				// a zero publish time keeps a transient failure from going to the dead letters
+				err = common.ProcessMessage(ctx, msg, raw, time.Time{})
+			}
+			if err != nil {
+				fmt.Printf("Failed to replay %s: %v\n", name, err)
+				failed++
+				return
+			}
+			fmt.Printf("Replayed %s\n", name)
+			replayed++
+		})
+		if err != nil {
+			log.Printf("Error reading %s: %v", file, err)
+		}
+		if ctx.Err() != nil {
+			log.Print("Interrupted")
+			break
+		}
+	}
+	fmt.Println("Replayed:", replayed, "Failed:", failed)
+}
+
+// the .json and .ndjson files of the path, sorted to replay them in a stable order
+func eventFiles(path string) ([]string, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	if !info.IsDir() {
+		return []string{path}, nil
+	}
+
+	var files []string
+	err = filepath.WalkDir(path, func(file string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !entry.IsDir() && (strings.HasSuffix(entry.Name(), ".json") || strings.HasSuffix(entry.Name(), ".ndjson")) {
+			files = append(files, file)
+		}
+		return nil
+	})
+	sort.Strings(files)
+	return files, err
+}
+
+// calls each with the events of the file: the whole of a .json file, or every line of an NDJSON file
+func readEvents(file string, each func(name string, raw []byte)) error {
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if !strings.HasSuffix(file, ".ndjson") {
+		raw, err := io.ReadAll(f)
+		if err != nil {
+			return err
+		}
+		each(file, bytes.TrimSpace(raw))
+		return nil
+	}
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 0, 1024*1024), MAX_LINE_BYTES)
+	line := 0
+	for scanner.Scan() {
+		line++
+		if text := bytes.TrimSpace(scanner.Bytes()); len(text) > 0 {
+			each(fmt.Sprintf("%s:%d", file, line), append([]byte(nil), text...))
+		}
+	}
+	return scanner.Err()
+}
+
+// the Pub/Sub message of a MessagePublishedData, or of the data of a structured CloudEvent
+func parseEvent(raw []byte) (*common.MessagePublishedData, error) {
+	var event struct {
+		common.MessagePublishedData
+		Data *common.MessagePublishedData `json:"data"`
+	}
+	if err := json.Unmarshal(raw, &event); err != nil {
+		return nil, fmt.Errorf("Failed to parse the event: %v", err)
+	}
+	msg := &event.MessagePublishedData
+	if event.Data != nil {
+		msg = event.Data
+	}
+	if len(msg.Message.Data) == 0 {
+		return nil, fmt.Errorf("The event has no Pub/Sub message with a resource name")
+	}
+	return msg, nil
+}
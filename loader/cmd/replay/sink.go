@@ -0,0 +1,72 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sync"
+
+	"fhirgen.ai/llm"
+	"fhirgen.ai/loader/common"
+)
+
+// a line of the NDJSON the stdout and file sinks write, one of the fields is set
+type record struct {
+	Summary    *common.FHIRResourceSumamry `json:"summary,omitempty"`
+	Deleted    *deleted                    `json:"deleted,omitempty"`
+	Event      *common.LedgerEntry         `json:"event,omitempty"`
+	DeadLetter *common.DeadLetter          `json:"deadLetter,omitempty"`
+}
+
+type deleted struct {
+	FHIRStore    string
+	ResourceType string
+	ResourceId   string
+}
+
+// writes the outcome as NDJSON rather than saving it to AlloyDB. The summary is what SaveSumamry gets:
+// the narrative (or local summary) unless generate has the model write it
+type writerSink struct {
+	mu       sync.Mutex
+	w        io.Writer
+	generate bool
+}
+
+func (s *writerSink) SaveSummary(ctx context.Context, resourceSummary *common.FHIRResourceSumamry) error {
+	if s.generate && resourceSummary.SummarySource == common.MODEL_SUMMARY {
+		library, err := llm.GetPromptLibrary(ctx)
+		if err != nil {
+			return err
+		}
+		if err := common.GenerateSummaryWith(ctx, library, resourceSummary); err != nil {
+			return fmt.Errorf("Failed to generate the summary: %v", err)
+		}
+	}
+	return s.write(record{Summary: resourceSummary})
+}
+
+func (s *writerSink) DeleteSummary(ctx context.Context, fhirStore string, resourceType string, resourceId string) error {
+	return s.write(record{Deleted: &deleted{FHIRStore: fhirStore, ResourceType: resourceType, ResourceId: resourceId}})
+}
+
+func (s *writerSink) RecordEvent(ctx context.Context, entry *common.LedgerEntry) {
+	if err := s.write(record{Event: entry}); err != nil {
+		fmt.Println("Failed to record the event:", err)
+	}
+}
+
+func (s *writerSink) SaveDeadLetter(ctx context.Context, deadLetter *common.DeadLetter) error {
+	return s.write(record{DeadLetter: deadLetter})
+}
+
+func (s *writerSink) write(r record) error {
+	line, err := json.Marshal(r)
+	if err != nil {
+		return fmt.Errorf("Failed to marshal the record: %v", err)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, err = s.w.Write(append(line, '\n'))
+	return err
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"fhirgen.ai/loader/common"
+)
+
+// the resources of local FHIR JSON and NDJSON files by type and id, read in place of the FHIR store
+type filesSource struct {
+	resources map[string]string                   // {type}/{id} to the FHIR JSON
+	byType    map[string][]map[string]interface{} // the parsed resources of each type, for searches
+}
+
+// loads the resources of the file or the .json and .ndjson files of the directory. A Bundle's entries
+// are loaded as resources of their own
+func loadFiles(path string) (*filesSource, error) {
+	s := &filesSource{resources: map[string]string{}, byType: map[string][]map[string]interface{}{}}
+	err := filepath.WalkDir(path, func(file string, entry fs.DirEntry, err error) error {
+		if err != nil || entry.IsDir() {
+			return err
+		}
+		switch {
+		case strings.HasSuffix(file, ".ndjson"):
+			return s.loadNDJSON(file)
+		case strings.HasSuffix(file, ".json"):
+			raw, err := os.ReadFile(file)
+			if err != nil {
+				return err
+			}
+			return s.add(raw)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	fmt.Println("Loaded", len(s.resources), "resources from", path)
+	return s, nil
+}
+
+func (s *filesSource) loadNDJSON(file string) error {
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 0, 1024*1024), MAX_LINE_BYTES)
+	for scanner.Scan() {
+		if line := bytes.TrimSpace(scanner.Bytes()); len(line) > 0 {
+			if err := s.add(append([]byte(nil), line...)); err != nil {
+				return fmt.Errorf("%s: %v", file, err)
+			}
+		}
+	}
+	return scanner.Err()
+}
+
+func (s *filesSource) add(raw []byte) error {
+	var resource map[string]interface{}
+	if err := json.Unmarshal(raw, &resource); err != nil {
+		return fmt.Errorf("Failed to parse the resource: %v", err)
+	}
+	resourceType, _ := resource["resourceType"].(string)
+	id, _ := resource["id"].(string)
+	if resourceType == "Bundle" {
+		entries, _ := resource["entry"].([]interface{})
+		for _, entry := range entries {
+			entry, _ := entry.(map[string]interface{})
+			if entry["resource"] == nil {
+				continue
+			}
+			entryJSON, err := json.Marshal(entry["resource"])
+			if err != nil {
+				return err
+			}
+			if err := s.add(entryJSON); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	if resourceType == "" || id == "" {
+		return fmt.Errorf("A resource without a resourceType or id")
+	}
+	s.resources[resourceType+"/"+id] = string(raw)
+	s.byType[resourceType] = append(s.byType[resourceType], resource)
+	return nil
+}
+
+// the resource by the {type}/{id} of its URI, or the searchset Bundle of a search
+func (s *filesSource) GetResource(ctx context.Context, resourceType string, resourceURI string) (string, error) {
+	path := resourceURI
+	if i := strings.LastIndex(path, "/fhir/"); i >= 0 {
+		path = path[i+len("/fhir/"):]
+	}
+	if strings.Contains(path, "?") {
+		return s.search(path)
+	}
+	parts := strings.Split(path, "/")
+	if len(parts) < 2 {
+		return "", &common.StatusError{StatusCode: http.StatusNotFound}
+	}
+	resource, ok := s.resources[parts[0]+"/"+parts[1]]
+	if !ok {
+		return "", &common.StatusError{StatusCode: http.StatusNotFound}
+	}
+	return resource, nil
+}
+
+// the searches the loader makes: _id, patient or subject and status. _count is ignored.
+// A search with any other parameter finds nothing
+func (s *filesSource) search(path string) (string, error) {
+	resourceType, query, _ := strings.Cut(path, "?")
+	params, err := url.ParseQuery(query)
+	if err != nil {
+		return "", &common.StatusError{StatusCode: http.StatusBadRequest}
+	}
+
+	var entries []map[string]interface{}
+	for _, resource := range s.byType[resourceType] {
+		if matches(resource, params) {
+			entries = append(entries, map[string]interface{}{"resource": resource})
+		}
+	}
+	bundle := map[string]interface{}{"resourceType": "Bundle", "type": "searchset", "total": len(entries), "entry": entries}
+	bundleJSON, err := json.Marshal(bundle)
+	return string(bundleJSON), err
+}
+
+func matches(resource map[string]interface{}, params url.Values) bool {
+	for name, values := range params {
+		value := values[0]
+		switch name {
+		case "_count":
+		case "_id":
+			if resource["id"] != value {
+				return false
+			}
+		case "patient", "subject":
+			if !referencesPatient(resource["patient"], value) && !referencesPatient(resource["subject"], value) {
+				return false
+			}
+		case "status":
+			if resource["status"] != value {
+				return false
+			}
+		default:
+			fmt.Println("Unsupported search parameter in the local files:", name)
+			return false
+		}
+	}
+	return true
+}
+
+// a reference to the patient, relative or absolute
+func referencesPatient(element interface{}, patientId string) bool {
+	reference, _ := element.(map[string]interface{})
+	target, _ := reference["reference"].(string)
+	return target == "Patient/"+patientId || strings.HasSuffix(target, "/Patient/"+patientId)
+}
@@ -3,145 +3,520 @@ package common
 import (
 	"context"
 	"fmt"
-	"net"
-	"os"
-	"strconv"
 	"time"
 
-	"cloud.google.com/go/alloydbconn"
+	"fhirgen.ai/llm"
+
 	"github.com/jackc/pgx/v5/pgxpool"
 )
 
-var (
-	REGION       = os.Getenv("REGION")
-	PROJECT_ID   = os.Getenv("PROJECT_ID")
-	ADB_IAM_USER = os.Getenv("ADB_IAM_USER")
-	ADB_CLUSTER  = os.Getenv("ADB_CLUSTER")
-	ADB_INSTANCE = os.Getenv("ADB_INSTANCE")
-	ADB_IP       = os.Getenv("ADB_IP")
-	ADB_PORT     = os.Getenv("ADB_PORT")
-	ADB_DATABASE = os.Getenv("ADB_DATABASE")
-
-	ML_EMBEDDING_MODEL = os.Getenv("ML_EMBEDDING_MODEL")
-	ML_GEN_AI_MODEL    = os.Getenv("ML_GEN_AI_MODEL")
-
-	ML_MAX_OUTPUT_TOKENS = os.Getenv("ML_MAX_OUTPUT_TOKENS")
-	ML_TOPK              = os.Getenv("ML_TOPK")
-	ML_TOPP              = os.Getenv("ML_TOPP")
-	ML_TEMPERATURE       = os.Getenv("ML_TEMPERATURE")
+// the tables of the summary rows. Resources that aren't in any patient's compartment (eg. an Observation
+// of a Group) go to a table of their own with the same columns, so that patient retrieval never sees them
+const (
+	PATIENT_RESOURCES_TABLE     = "public.resources"
+	NON_PATIENT_RESOURCES_TABLE = "public.non_patient_resources"
 )
 
+var RESOURCE_TABLES = []string{PATIENT_RESOURCES_TABLE, NON_PATIENT_RESOURCES_TABLE}
+
+// the table the rows of the resource are saved in
+func resourceTable(resourceSummary *FHIRResourceSumamry) string {
+	if resourceSummary.PatientId == "" {
+		return NON_PATIENT_RESOURCES_TABLE
+	}
+	return PATIENT_RESOURCES_TABLE
+}
+
 func SaveSumamry(ctx context.Context, resourceSummary *FHIRResourceSumamry) error {
+	if s := currentSink(); s != nil {
+		return s.SaveSummary(ctx, resourceSummary)
+	}
 
 	fmt.Println("Saving resource summary to AlloyDB")
 
-	dialer, err := alloydbconn.NewDialer(ctx, alloydbconn.WithIAMAuthN())
+	conn, err := llm.GetConnection(ctx)
 	if err != nil {
-		return fmt.Errorf("Failed to init Dialer: %v", err)
+		return err
+	}
+
+	// skip the model call when we already hold the same or a newer version of the resource.
+	// pubsub delivers at least once and doesn't guarantee ordering, so an event can come again
+	// or an older event can arrive after a newer one. Forced regeneration (eg. a reindex) skips the checks
+	if !resourceSummary.Force {
+		stale, err := isStale(conn, ctx, resourceSummary)
+		if err != nil {
+			return fmt.Errorf("Failed to check the stored version in AlloyDB: %v", err)
+		}
+		if stale {
+			fmt.Println("Stored resource summary is same or newer. Skipping:", resourceSummary.ResourceId, resourceSummary.VersionId)
+			return nil
+		}
+
+		// a new version with the same clinical content, eg. only meta changed. The stored summary
+		// still holds when it came from the same model and prompt template, so only the version is moved forward
+		if resourceSummary.SummarySource == MODEL_SUMMARY {
+			library, err := llm.GetPromptLibrary(ctx)
+			if err != nil {
+				return err
+			}
+			if resourceSummary.PromptVersion, err = SummaryPromptVersion(library, resourceSummary.ResourceType); err != nil {
+				return err
+			}
+			// a generator that can't be created fails in generateSummary, where the narrative fallback applies
+			if generator, err := llm.GetTextGenerator(ctx, llm.SUMMARY_USE); err == nil {
+				resourceSummary.Model = generator.Model()
+			}
+		}
+		unchanged, err := keepUnchanged(conn, ctx, resourceSummary)
+		if err != nil {
+			return fmt.Errorf("Failed to check the stored content hash in AlloyDB: %v", err)
+		}
+		if unchanged {
+			fmt.Println("Content is unchanged. Keeping the stored summary:", resourceSummary.ResourceId, resourceSummary.VersionId)
+			resourceSummary.Unchanged = true
+			return nil
+		}
 	}
 
-	fmt.Println("Got the New Dialer")
+	// the model summary is generated before the upsert, now that we know the version is needed
+	if resourceSummary.SummarySource == MODEL_SUMMARY {
+		err = generateSummary(ctx, resourceSummary)
+		if err != nil && narrativeFallback() && resourceSummary.GeneratedContent != "" {
+			// eg. when the model is throttled. Store the narrative instead
+			fmt.Println("Failed to generate the summary with the model, saving the narrative instead:", err)
+			resourceSummary.SummarySource = NARRATIVE_SUMMARY
+		} else if err != nil {
+			return fmt.Errorf("Failed to generate the summary: %v", err)
+		}
+	}
 
-	port, err := strconv.Atoi(ADB_PORT)
+	// the summary and the attachment chunks are embedded in one batch
+	texts := append([]string{resourceSummary.GeneratedContent}, resourceSummary.Chunks...)
+	embeddings, embeddingModel, err := llm.EmbedTexts(ctx, texts)
 	if err != nil {
-		return fmt.Errorf("Invalid Port: %v", err)
+		return err
 	}
+	// and with the model being migrated to, if any
+	shadowEmbeddings, shadowEmbeddingModel, err := llm.EmbedShadowTexts(ctx, texts)
+	if err != nil {
+		return err
+	}
+	rowEmbeddings := rowEmbeddings{embeddings, embeddingModel, shadowEmbeddings, shadowEmbeddingModel}
 
-	//get the accesstoken for the default cloud fucntion service accont: {PROJECT-ID}@appspot.gserviceaccount.com
-	accessToken, err := GetAccessToken()
+	// the Consent check of GetResourceSummary may be answered from the cache of this instance. The Consents
+	// are searched again before the rows are written, so a Consent applied on another instance in the meantime
+	// keeps the resource out of the index as well
+	denied, err := consentDeniesSummary(ctx, resourceSummary)
 	if err != nil {
-		return fmt.Errorf("failed to obtain access token: %v", err)
+		return err
+	}
+	if denied {
+		if err := deleteData(conn, ctx, resourceSummary.FHIRStore, resourceSummary.ResourceType, resourceSummary.ResourceId); err != nil {
+			return fmt.Errorf("Failed to Delete from AlloyDB: %v", err)
+		}
+		return ErrResourceExcluded
 	}
 
-	dsn := fmt.Sprintf(
-		"host=%s port=%d user=%s password=%s dbname=%s sslmode=require",
-		ADB_IP, port, ADB_IAM_USER, accessToken, ADB_DATABASE)
+	//insert or update the data in AlloyDB
+	saved, err := upsertData(conn, ctx, resourceSummary, rowEmbeddings.at(0))
+	if err != nil {
+		return fmt.Errorf("Failed to Upsert into AlloyDB: %v", err)
+	}
+	if !saved {
+		return nil
+	}
 
-	config, err := pgxpool.ParseConfig(dsn)
+	err = saveChunks(conn, ctx, resourceSummary, rowEmbeddings)
 	if err != nil {
-		return fmt.Errorf("Failed to parse pgx config: %v", err)
+		return fmt.Errorf("Failed to save the attachment chunks into AlloyDB: %v", err)
 	}
+	fmt.Println("Saved resource summary to AlloyDB")
 
-	fmt.Println("Parsed the Config")
+	return nil
+}
 
-	// Tell the driver to use the AlloyDB Go Connector to create connections
-	config.ConnConfig.DialFunc = func(ctx context.Context, _ string, instance string) (net.Conn, error) {
-		dbInstance := fmt.Sprintf("projects/%s/locations/%s/clusters/%s/instances/%s",
-			PROJECT_ID, REGION, ADB_CLUSTER, ADB_INSTANCE)
-		return dialer.Dial(ctx, dbInstance)
+// removes the summary and its embedding for a resource that was deleted in the FHIR store
+// so that the rag() function can no longer retrieve it
+func DeleteSummary(ctx context.Context, fhirStore string, resourceType string, resourceId string) error {
+	if s := currentSink(); s != nil {
+		return s.DeleteSummary(ctx, fhirStore, resourceType, resourceId)
 	}
-	fmt.Println("Defined the DialFunc")
 
-	// Create a DSN string from the config
-	dsnString := config.ConnString()
-	fmt.Println("Created the DSN String")
+	fmt.Println("Deleting resource summary from AlloyDB")
 
-	conn, err := pgxpool.New(ctx, dsnString)
+	conn, err := llm.GetConnection(ctx)
 	if err != nil {
-		return fmt.Errorf("Failed to Connect to AlloyDB: %v", err)
+		return err
 	}
-	defer conn.Close()
 
-	//insert the data to AlloyDB
-	err = insertData(conn, ctx, resourceSummary)
+	err = deleteData(conn, ctx, fhirStore, resourceType, resourceId)
 	if err != nil {
-		return fmt.Errorf("Failed to Insert into AlloyDB: %v", err)
+		return fmt.Errorf("Failed to Delete from AlloyDB: %v", err)
 	}
-	fmt.Println("Saved resource summary to AlloyDB")
+	fmt.Println("Deleted resource summary from AlloyDB")
 
 	return nil
 }
 
-func insertData(conn *pgxpool.Pool, ctx context.Context, resourceSummary *FHIRResourceSumamry) error {
+// checks if the stored row was generated from the same version (by its key and versionId)
+// or a newer one (by meta.lastUpdated)
+func isStale(conn *pgxpool.Pool, ctx context.Context, resourceSummary *FHIRResourceSumamry) (bool, error) {
+
+	// in either table, the resource may have moved in or out of a patient's compartment since
+	var stale bool
+	stmt := `SELECT EXISTS (SELECT 1 FROM public.resources
+			WHERE fhirStore = $4 AND type = $5 AND id = $1 AND (versionId = $2 OR lastUpdated >= $3))
+		OR EXISTS (SELECT 1 FROM public.non_patient_resources
+			WHERE fhirStore = $4 AND type = $5 AND id = $1 AND (versionId = $2 OR lastUpdated >= $3))`
+	err := conn.QueryRow(ctx, stmt, resourceSummary.ResourceId, resourceSummary.VersionId,
+		lastUpdatedTime(resourceSummary), resourceSummary.FHIRStore, resourceSummary.ResourceType).Scan(&stale)
+	if err != nil {
+		return false, err
+	}
+
+	return stale, nil
+}
+
+// moves the stored row (and its chunks) to this version when it holds a summary of the same content
+// from the same summary source, model and prompt template. A narrative stored as the fallback for a failed model call isn't kept.
+// Returns false when there is no such row
+func keepUnchanged(conn *pgxpool.Pool, ctx context.Context, resourceSummary *FHIRResourceSumamry) (bool, error) {
+	handler, ok := GetHandler(resourceSummary.ResourceType)
+	if !ok {
+		return false, fmt.Errorf("Unhandled resource type: %v", resourceSummary.ResourceType)
+	}
+	var data interface{} = resourceSummary.OriginalFHIRJSON
+	if handler.OmitData {
+		data = nil
+	}
+
+	tx, err := conn.Begin(ctx)
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback(ctx)
+
+	table := resourceTable(resourceSummary)
+	stmt := `
+		UPDATE ` + table + ` SET versionId = $2, lastUpdated = $3, data = $4, securityLabels = $9, restrictedLabels = $10,
+			organizationId = $11
+		WHERE fhirStore = $12 AND type = $13 AND id = $1 AND contentHash = $5 AND summarySource = $6 AND promptVersion IS NOT DISTINCT FROM NULLIF($7, '')
+			AND summaryModel IS NOT DISTINCT FROM NULLIF($8, '') AND (lastUpdated IS NULL OR lastUpdated < $3)
+	`
+	tag, err := tx.Exec(ctx, stmt, resourceSummary.ResourceId, resourceSummary.VersionId, lastUpdatedTime(resourceSummary),
+		data, resourceSummary.ContentHash, resourceSummary.SummarySource, resourceSummary.PromptVersion, resourceSummary.Model,
+		resourceSummary.SecurityLabels, resourceSummary.RestrictedLabels, nullIfEmpty(resourceSummary.OrganizationId),
+		resourceSummary.FHIRStore, resourceSummary.ResourceType)
+	if err != nil {
+		return false, err
+	}
+	if tag.RowsAffected() == 0 {
+		return false, nil
+	}
+
+	// the labels are in meta, which the content hash leaves out, and the organization is the patient's,
+	// so they are taken from this version
+	stmt = `UPDATE ` + table + ` SET versionId = $3, lastUpdated = $4, securityLabels = $5, restrictedLabels = $6,
+			organizationId = $7
+		WHERE fhirStore = $8 AND type = $2 AND parentId = $1`
+	_, err = tx.Exec(ctx, stmt, resourceSummary.ResourceId, resourceSummary.ResourceType, resourceSummary.VersionId,
+		lastUpdatedTime(resourceSummary), resourceSummary.SecurityLabels, resourceSummary.RestrictedLabels,
+		nullIfEmpty(resourceSummary.OrganizationId), resourceSummary.FHIRStore)
+	if err != nil {
+		return false, err
+	}
+	return true, tx.Commit(ctx)
+}
+
+// inserts the summary row or replaces the current one for an UpdateResource event.
+// The update_resource_trigger copies the replaced row into public.resources_history
+// keyed by its versionId before it gets overwritten
+func upsertData(conn *pgxpool.Pool, ctx context.Context, resourceSummary *FHIRResourceSumamry, embedding rowEmbedding) (bool, error) {
 
 	id := resourceSummary.ResourceId
 	resourceType := resourceSummary.ResourceType
 	patientId := resourceSummary.PatientId
-	data := resourceSummary.OriginalFHIRJSON
-	epochMicroseconds := int64(resourceSummary.Timestamp)
-	epochSeconds := epochMicroseconds / 1e6
-	timestamp := time.Unix(epochSeconds, 0)
-	timestampStr := timestamp.Format("2006-01-02 15:04:05")
-	prompt := getContentGenPrompt(data)
+	timestamp := time.UnixMicro(resourceSummary.Timestamp).UTC()
+	clinicalTime, clinicalTimePrecision := clinicalTimeColumns(resourceSummary)
+
+	handler, ok := GetHandler(resourceType)
+	if !ok {
+		return false, fmt.Errorf("Unhandled resource type: %v", resourceType)
+	}
+	var data interface{} = resourceSummary.OriginalFHIRJSON
+	if handler.OmitData {
+		data = nil
+	}
+
+	metadata, err := metadataColumns(resourceSummary)
+	if err != nil {
+		return false, err
+	}
+
+	args := []interface{}{id, resourceType, nullIfEmpty(patientId), data, resourceSummary.GeneratedContent,
+		resourceSummary.SummarySource, timestamp, resourceSummary.VersionId, lastUpdatedTime(resourceSummary),
+		llm.VectorText(embedding.embedding), embedding.model, clinicalTime, clinicalTimePrecision}
+	args = append(args, metadata...)
+	// the model and prompt template are only recorded for a summary the model wrote
+	var promptVersion, summaryModel interface{}
+	if resourceSummary.SummarySource == MODEL_SUMMARY {
+		promptVersion, summaryModel = resourceSummary.PromptVersion, resourceSummary.Model
+	}
+	args = append(args, resourceSummary.ContentHash, resourceSummary.Force, promptVersion, summaryModel,
+		llm.VectorText(embedding.shadow), nullIfEmpty(embedding.shadowModel), resourceSummary.SecurityLabels,
+		resourceSummary.RestrictedLabels, nullIfEmpty(resourceSummary.OrganizationId), resourceSummary.FHIRStore)
 
 	// Prepare the SQL statement for inserting a row.
-	// The ML_PREDICT_ROW function is used to call the Text Bison model and generate content for summary column
+	// An update takes the new embeddings along with the new summary. The WHERE clause keeps an older version
+	// that is delivered late from overwriting a newer one. A forced regeneration overwrites the same version
 	stmt := `
-		INSERT INTO public.resources (id, type, patientId, data,summary,timestamp) 
-		VALUES ($1, $2, $3, $4,
-			ML_PREDICT_ROW(
-					'publishers/google/models/' || $7,  
-				    json_build_object('instances', 
- 						json_build_object('content', $6::text),
-						'parameters', json_build_object('maxOutputTokens', $8::numeric,'topK', $9::numeric,'topP', $10::float,'temperature', $11::float)
-					)
-			)->'predictions'->0->>'content',
-		    $5
-		)
+		INSERT INTO ` + resourceTable(resourceSummary) + ` AS r (id, type, patientId, data,summary,summarySource,timestamp, versionId, lastUpdated, embedding, embeddingModel,
+			clinicalTime, clinicalTimePrecision, codings, category, status, clinicalStatus, verificationStatus, encounterId, contentHash, promptVersion,
+			summaryModel, shadowEmbedding, shadowEmbeddingModel, securityLabels, restrictedLabels, organizationId, fhirStore) 
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10::vector, $11, $12, $13, $14::jsonb, $15, $16, $17, $18, $19, $20, $22, $23, $24::vector, $25,
+			$26, $27, $28, $29)
+		ON CONFLICT (fhirStore, type, id) DO UPDATE SET
+			patientId = EXCLUDED.patientId,
+			data = EXCLUDED.data,
+			summary = EXCLUDED.summary,
+			summarySource = EXCLUDED.summarySource,
+			embedding = EXCLUDED.embedding,
+			embeddingModel = EXCLUDED.embeddingModel,
+			timestamp = EXCLUDED.timestamp,
+			clinicalTime = EXCLUDED.clinicalTime,
+			clinicalTimePrecision = EXCLUDED.clinicalTimePrecision,
+			codings = EXCLUDED.codings,
+			category = EXCLUDED.category,
+			status = EXCLUDED.status,
+			clinicalStatus = EXCLUDED.clinicalStatus,
+			verificationStatus = EXCLUDED.verificationStatus,
+			encounterId = EXCLUDED.encounterId,
+			contentHash = EXCLUDED.contentHash,
+			promptVersion = EXCLUDED.promptVersion,
+			summaryModel = EXCLUDED.summaryModel,
+			shadowEmbedding = EXCLUDED.shadowEmbedding,
+			shadowEmbeddingModel = EXCLUDED.shadowEmbeddingModel,
+			securityLabels = EXCLUDED.securityLabels,
+			restrictedLabels = EXCLUDED.restrictedLabels,
+			organizationId = EXCLUDED.organizationId,
+			versionId = EXCLUDED.versionId,
+			lastUpdated = EXCLUDED.lastUpdated
+		WHERE r.lastUpdated IS NULL OR r.lastUpdated < EXCLUDED.lastUpdated
+			OR ($21 AND r.lastUpdated <= EXCLUDED.lastUpdated)
 	`
 	// Execute the SQL statement with the variable values
-	_, err := conn.Exec(ctx, stmt, id, resourceType, patientId, data, timestampStr, prompt,
-		ML_GEN_AI_MODEL, ML_MAX_OUTPUT_TOKENS, ML_TOPK, ML_TOPP, ML_TEMPERATURE)
+	tag, err := conn.Exec(ctx, stmt, args...)
+	if err != nil {
+		return false, fmt.Errorf("Unable to upsert row into AlloyDB: %v", err)
+	}
+	if tag.RowsAffected() == 0 {
+		fmt.Println("Newer version already stored. Row not updated")
+		return false, nil
+	}
+	fmt.Println("Row upserted successfully")
+
+	// the patient's other rows move with the Patient to its new managing organization
+	if resourceType == "Patient" {
+		stmt = `UPDATE ` + PATIENT_RESOURCES_TABLE + ` SET organizationId = $2
+			WHERE patientId = $1 AND fhirStore = $3 AND organizationId IS DISTINCT FROM $2`
+		tag, err = conn.Exec(ctx, stmt, id, nullIfEmpty(resourceSummary.OrganizationId), resourceSummary.FHIRStore)
+		if err != nil {
+			return false, fmt.Errorf("Unable to update the organization of the patient's rows: %v", err)
+		}
+		if tag.RowsAffected() > 0 {
+			fmt.Println("Rows moved to the patient's organization:", tag.RowsAffected())
+		}
+	}
+
+	// an earlier version in the other table, eg. an Observation whose subject changed from a Group to a Patient
+	for _, table := range RESOURCE_TABLES {
+		if table != resourceTable(resourceSummary) {
+			if err := deleteRows(conn, ctx, table, resourceSummary.FHIRStore, resourceType, id); err != nil {
+				return false, err
+			}
+		}
+	}
+	return true, nil
+}
+
+// replaces the chunk rows of the resource with the chunks of the version just saved.
+// Chunk rows carry the attachment text as their summary and its embedding.
+// They are linked to the resource with parentId and their id is {parentId}#{n}, which can't clash
+// with a FHIR id of the same store and type
+func saveChunks(conn *pgxpool.Pool, ctx context.Context, resourceSummary *FHIRResourceSumamry, rowEmbeddings rowEmbeddings) error {
+
+	tx, err := conn.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	table := resourceTable(resourceSummary)
+	stmt := `DELETE FROM ` + table + ` WHERE fhirStore = $3 AND type = $2 AND parentId = $1`
+	_, err = tx.Exec(ctx, stmt, resourceSummary.ResourceId, resourceSummary.ResourceType, resourceSummary.FHIRStore)
+	if err != nil {
+		return fmt.Errorf("Unable to delete chunk rows from AlloyDB: %v", err)
+	}
+
+	// chunks carry the metadata, security labels and organization of their resource, so the retrieval filters apply to them as well
+	timestamp := time.UnixMicro(resourceSummary.Timestamp).UTC()
+	clinicalTime, clinicalTimePrecision := clinicalTimeColumns(resourceSummary)
+	metadata, err := metadataColumns(resourceSummary)
+	if err != nil {
+		return err
+	}
+	stmt = `
+		INSERT INTO ` + table + ` (id, type, patientId, summary, timestamp, versionId, lastUpdated, parentId, embedding, embeddingModel,
+			clinicalTime, clinicalTimePrecision, codings, category, status, clinicalStatus, verificationStatus, encounterId,
+			shadowEmbedding, shadowEmbeddingModel, securityLabels, restrictedLabels, organizationId, fhirStore)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9::vector, $10, $11, $12, $13::jsonb, $14, $15, $16, $17, $18, $19::vector, $20, $21, $22,
+			$23, $24)
+	`
+	for i, chunk := range resourceSummary.Chunks {
+		chunkId := fmt.Sprintf("%s#%d", resourceSummary.ResourceId, i+1)
+		// the first embedding is the summary's
+		embedding := rowEmbeddings.at(i + 1)
+		args := []interface{}{chunkId, resourceSummary.ResourceType, nullIfEmpty(resourceSummary.PatientId), chunk,
+			timestamp, resourceSummary.VersionId, lastUpdatedTime(resourceSummary), resourceSummary.ResourceId,
+			llm.VectorText(embedding.embedding), embedding.model, clinicalTime, clinicalTimePrecision}
+		args = append(args, metadata...)
+		args = append(args, llm.VectorText(embedding.shadow), nullIfEmpty(embedding.shadowModel), resourceSummary.SecurityLabels,
+			resourceSummary.RestrictedLabels, nullIfEmpty(resourceSummary.OrganizationId), resourceSummary.FHIRStore)
+		_, err = tx.Exec(ctx, stmt, args...)
+		if err != nil {
+			return fmt.Errorf("Unable to insert chunk row into AlloyDB: %v", err)
+		}
+	}
+	if len(resourceSummary.Chunks) > 0 {
+		fmt.Println("Chunk rows inserted:", len(resourceSummary.Chunks))
+	}
+
+	return tx.Commit(ctx)
+}
+
+// the clinicalTime and clinicalTimePrecision column values, NULL when the resource has no clinical time
+func clinicalTimeColumns(resourceSummary *FHIRResourceSumamry) (interface{}, interface{}) {
+	if resourceSummary.ClinicalTime.ValueUs == 0 {
+		return nil, nil
+	}
+	return time.UnixMicro(resourceSummary.ClinicalTime.ValueUs).UTC(), resourceSummary.ClinicalTime.Precision
+}
+
+// the codings, category, status, clinicalStatus, verificationStatus and encounterId column values.
+// What the resource doesn't have is NULL
+func metadataColumns(resourceSummary *FHIRResourceSumamry) ([]interface{}, error) {
+	metadata := resourceSummary.Metadata
+	codings, err := codingsJSON(metadata)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to marshal the codings: %v", err)
+	}
+	return []interface{}{codings, metadata.Categories, nullIfEmpty(metadata.Status), nullIfEmpty(metadata.ClinicalStatus),
+		nullIfEmpty(metadata.VerificationStatus), nullIfEmpty(metadata.EncounterId)}, nil
+}
+
+// the embeddings of the texts of a resource (the summary and its chunks) with the configured model,
+// and with the shadow model when a migration is going on
+type rowEmbeddings struct {
+	embeddings       [][]float32
+	model            string
+	shadowEmbeddings [][]float32
+	shadowModel      string
+}
+
+// the embeddings of a single row
+type rowEmbedding struct {
+	embedding   []float32
+	model       string
+	shadow      []float32
+	shadowModel string
+}
+
+func (e rowEmbeddings) at(i int) rowEmbedding {
+	row := rowEmbedding{embedding: e.embeddings[i], model: e.model}
+	if e.shadowEmbeddings != nil {
+		row.shadow, row.shadowModel = e.shadowEmbeddings[i], e.shadowModel
+	}
+	return row
+}
+
+// the column value of an optional text, NULL when it's empty
+func nullIfEmpty(value string) interface{} {
+	if value == "" {
+		return nil
+	}
+	return value
+}
+
+// meta.lastUpdated (in microseconds) of the resource version that the summary was generated from
+func lastUpdatedTime(resourceSummary *FHIRResourceSumamry) time.Time {
+	return time.UnixMicro(resourceSummary.LastUpdated).UTC()
+}
+
+func deleteData(conn *pgxpool.Pool, ctx context.Context, fhirStore string, resourceType string, resourceId string) error {
+
+	// the embedding lives on the same row, so deleting the row removes it from retrieval as well.
+	// the attachment chunk rows of the resource go with it
+	for _, table := range RESOURCE_TABLES {
+		if err := deleteRows(conn, ctx, table, fhirStore, resourceType, resourceId); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// deletes the row of the resource and its chunk rows from the table
+func deleteRows(conn *pgxpool.Pool, ctx context.Context, table string, fhirStore string, resourceType string, resourceId string) error {
+	stmt := `DELETE FROM ` + table + ` WHERE fhirStore = $3 AND type = $2 AND (id = $1 OR parentId = $1)`
+
+	tag, err := conn.Exec(ctx, stmt, resourceId, resourceType, fhirStore)
 	if err != nil {
-		return fmt.Errorf("Unable to insert row into AlloyDB: %v", err)
+		return fmt.Errorf("Unable to delete row from AlloyDB: %v", err)
+	}
+	if tag.RowsAffected() > 0 {
+		fmt.Println("Rows deleted from", table+":", tag.RowsAffected())
 	}
-	fmt.Println("Row inserted successfully")
 
 	return nil
 }
 
-func getContentGenPrompt(fhirJSONString string) string {
-	return "You are a clinician and also an expert on Healthcare data especially FHIR JSON." +
-		"And you are also very sensitive about patient privacy and protecting PII like their names," +
-		"emails, phone numbers, addresses and date of birth. " +
-		"I would like you to summarize the below FHIR JSON into a short paragraph that includes the following info:" +
-		"- convert the timestamp to a string that shows how many years/months/days/hours ago is the data " +
-		"- Any other relationships to other resources based on the references if there are and a " +
-		"- A clinical narrative of what the resource data is all about." +
-		"Include data values and units. " +
-		"Do not include any Personally Identifiable Information like names, emails,phone , addresses and date of birth. " +
-		"Make the final conent to be a paragraph of text so I can use that for" +
-		"generating Emebeddings out of it " +
-		"here is the JOSN:" + fhirJSONString + "" +
-		"important:  Do not include any names of patient's and practitioners in the final content"
+// generates the summary with the PROMPT_VERSION library. GeneratedContent, the fallback narrative
+// until now, is replaced with it
+func generateSummary(ctx context.Context, resourceSummary *FHIRResourceSumamry) error {
+	library, err := llm.GetPromptLibrary(ctx)
+	if err != nil {
+		return err
+	}
+	return GenerateSummaryWith(ctx, library, resourceSummary)
+}
+
+// a stored resource of a patient, as its FHIR JSON
+type patientResource struct {
+	resourceType string
+	id           string
+	data         string
+}
+
+// the stored resources of the patient in the FHIR store that have their FHIR JSON (not the Patient itself, nor chunks)
+func listPatientResources(ctx context.Context, fhirStore string, patientId string) ([]patientResource, error) {
+	conn, err := llm.GetConnection(ctx)
+	if err != nil {
+		return nil, err
+	}
+	stmt := `SELECT type, id, data FROM ` + PATIENT_RESOURCES_TABLE + `
+		WHERE fhirStore = $2 AND patientId = $1 AND parentId IS NULL AND data IS NOT NULL`
+	rows, err := conn.Query(ctx, stmt, patientId, fhirStore)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to list the resources of the patient: %v", err)
+	}
+	defer rows.Close()
+
+	var resources []patientResource
+	for rows.Next() {
+		var resource patientResource
+		if err := rows.Scan(&resource.resourceType, &resource.id, &resource.data); err != nil {
+			return nil, fmt.Errorf("Failed to read a resource of the patient: %v", err)
+		}
+		resources = append(resources, resource)
+	}
+	return resources, rows.Err()
 }
@@ -0,0 +1,325 @@
+package common
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"unicode"
+
+	dtpb "github.com/google/fhir/go/proto/google/fhir/proto/r4/core/datatypes_go_proto"
+	"github.com/ledongthuc/pdf"
+	"golang.org/x/net/html"
+)
+
+const (
+	// attachments bigger than this are skipped
+	MAX_ATTACHMENT_BYTES = 20 * 1024 * 1024
+	// size (in characters) of the chunks that long notes are split into and how much they overlap
+	CHUNK_SIZE    = 2000
+	CHUNK_OVERLAP = 200
+	// how much of the note text is sent to the model along with the resource JSON for the summary
+	MAX_PROMPT_TEXT = 8000
+)
+
+// gets the text out of the attachments. The content is taken from the inline data or fetched from
+// the url when it points to a Binary in the same FHIR store. Attachments with a content type
+// that can't be read are skipped
+func ExtractAttachmentsText(ctx context.Context, attachments []*dtpb.Attachment, resourceURI string) (string, error) {
+	var texts []string
+	for _, attachment := range attachments {
+		contentType := attachment.GetContentType().GetValue()
+		content := attachment.GetData().GetValue()
+		if len(content) == 0 && attachment.GetUrl().GetValue() != "" {
+			binaryContentType, binaryContent, err := getBinary(ctx, attachment.GetUrl().GetValue(), resourceURI)
+			if err != nil {
+				return "", err
+			}
+			content = binaryContent
+			if contentType == "" {
+				contentType = binaryContentType
+			}
+		}
+		if len(content) == 0 {
+			continue
+		}
+		if len(content) > MAX_ATTACHMENT_BYTES {
+			fmt.Println("Skipping attachment bigger than", MAX_ATTACHMENT_BYTES, "bytes:", contentType)
+			continue
+		}
+
+		text, err := extractText(contentType, content)
+		if err != nil {
+			return "", fmt.Errorf("Failed to extract text from %s attachment: %v", contentType, err)
+		}
+		if text = strings.TrimSpace(text); text != "" {
+			texts = append(texts, text)
+		}
+	}
+
+	return strings.Join(texts, "\n\n"), nil
+}
+
+// fetches a Binary from the FHIR store. Relative urls (Binary/{id}) are resolved against the store
+// of the resource. Absolute urls are only followed when they point into the same store, so that
+// the service account token is never sent anywhere else
+func getBinary(ctx context.Context, url string, resourceURI string) (string, []byte, error) {
+	storeURI := fhirStoreURI(resourceURI)
+	binaryURI := storeURI + "/" + strings.TrimPrefix(url, "/")
+	if strings.Contains(url, "://") {
+		storeURL := "https://healthcare.googleapis.com/v1/" + storeURI + "/"
+		if !strings.HasPrefix(url, storeURL) {
+			fmt.Println("Skipping attachment url outside of the FHIR store:", url)
+			return "", nil, nil
+		}
+		binaryURI = strings.TrimPrefix(url, "https://healthcare.googleapis.com/v1/")
+	}
+
+	binaryJSON, err := GetFHIRResource(ctx, "Binary", binaryURI)
+	if err != nil {
+		return "", nil, fmt.Errorf("Failed to get the attachment Binary: %v", err)
+	}
+
+	var binary struct {
+		ContentType string `json:"contentType"`
+		Data        string `json:"data"`
+	}
+	if err := json.Unmarshal([]byte(binaryJSON), &binary); err != nil {
+		return "", nil, fmt.Errorf("Failed to parse the attachment Binary: %v", err)
+	}
+	content, err := base64.StdEncoding.DecodeString(binary.Data)
+	if err != nil {
+		return "", nil, fmt.Errorf("Failed to decode the attachment Binary: %v", err)
+	}
+
+	return binary.ContentType, content, nil
+}
+
+// the FHIR store part of a resource URI. eg. projects/X/locations/X/datasets/X/fhirStores/X/fhir
+func fhirStoreURI(resourceURI string) string {
+	if i := strings.LastIndex(resourceURI, "/fhir/"); i >= 0 {
+		return resourceURI[:i+len("/fhir")]
+	}
+	return resourceURI
+}
+
+// the FHIR store of a resource URI, as the rows are keyed with it. eg. projects/X/locations/X/datasets/X/fhirStores/X
+func fhirStoreOf(resourceURI string) string {
+	return strings.TrimSuffix(fhirStoreURI(resourceURI), "/fhir")
+}
+
+func extractText(contentType string, content []byte) (string, error) {
+	mediaType := strings.ToLower(strings.TrimSpace(strings.Split(contentType, ";")[0]))
+	switch mediaType {
+	case "text/plain", "":
+		return string(content), nil
+	case "text/html", "application/xhtml+xml":
+		return htmlText(content), nil
+	case "text/rtf", "application/rtf":
+		return rtfText(content), nil
+	case "application/pdf":
+		return pdfText(content)
+	default:
+		fmt.Println("Skipping attachment with unsupported content type:", contentType)
+		return "", nil
+	}
+}
+
+// text content of the html, leaving out scripts and styles
+func htmlText(content []byte) string {
+	var text strings.Builder
+	skip := 0
+	tokenizer := html.NewTokenizer(bytes.NewReader(content))
+	for {
+		switch tokenizer.Next() {
+		case html.ErrorToken:
+			return text.String()
+		case html.StartTagToken, html.SelfClosingTagToken:
+			name, _ := tokenizer.TagName()
+			switch string(name) {
+			case "script", "style":
+				skip++
+			case "br", "p", "div", "li", "tr", "h1", "h2", "h3", "h4", "h5", "h6":
+				text.WriteString("\n")
+			case "td", "th":
+				text.WriteString(" ")
+			}
+		case html.EndTagToken:
+			name, _ := tokenizer.TagName()
+			if (string(name) == "script" || string(name) == "style") && skip > 0 {
+				skip--
+			}
+		case html.TextToken:
+			if skip == 0 {
+				text.Write(tokenizer.Text())
+			}
+		}
+	}
+}
+
+// plain text of an RTF document. Control words are dropped, except for paragraph breaks and tabs,
+// and destinations like font and color tables are skipped
+func rtfText(content []byte) string {
+	var text strings.Builder
+	rtf := string(content)
+	depth := 0
+	skipDepth := -1 // depth of the destination group being skipped, -1 when not skipping
+
+	for i := 0; i < len(rtf); i++ {
+		c := rtf[i]
+		switch {
+		case c == '{':
+			depth++
+		case c == '}':
+			if depth == skipDepth {
+				skipDepth = -1
+			}
+			depth--
+		case c == '\\' && i+1 < len(rtf):
+			next := rtf[i+1]
+			switch {
+			case next == '\\' || next == '{' || next == '}':
+				if skipDepth < 0 {
+					text.WriteByte(next)
+				}
+				i++
+			case next == '\'' && i+3 < len(rtf):
+				// \'hh is a character in the document code page
+				if b, err := strconv.ParseUint(rtf[i+2:i+4], 16, 8); err == nil && skipDepth < 0 {
+					text.WriteRune(rune(b))
+				}
+				i += 3
+			case next == '*':
+				// \* marks a destination that readers can ignore
+				if skipDepth < 0 {
+					skipDepth = depth
+				}
+				i++
+			case unicode.IsLetter(rune(next)):
+				j := i + 1
+				for j < len(rtf) && unicode.IsLetter(rune(rtf[j])) {
+					j++
+				}
+				word := rtf[i+1 : j]
+				for j < len(rtf) && (rtf[j] == '-' || unicode.IsDigit(rune(rtf[j]))) {
+					j++
+				}
+				if j < len(rtf) && rtf[j] == ' ' {
+					j++ // the space delimits the control word
+				}
+				i = j - 1
+				switch word {
+				case "fonttbl", "colortbl", "stylesheet", "info", "pict", "header", "footer":
+					if skipDepth < 0 {
+						skipDepth = depth
+					}
+				case "par", "line", "row":
+					if skipDepth < 0 {
+						text.WriteString("\n")
+					}
+				case "tab", "cell":
+					if skipDepth < 0 {
+						text.WriteString("\t")
+					}
+				}
+			default:
+				i++
+			}
+		case c == '\r' || c == '\n':
+			// line breaks in the RTF source aren't part of the text
+		default:
+			if skipDepth < 0 {
+				text.WriteByte(c)
+			}
+		}
+	}
+
+	return text.String()
+}
+
+// the pdf package panics on some malformed or truncated files. A PDF that can't be read won't read
+// on a retry either, so the error is permanent
+func pdfText(content []byte) (text string, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			text, err = "", Permanent(fmt.Errorf("Failed to read the PDF: %v", r))
+		}
+	}()
+
+	reader, err := pdf.NewReader(bytes.NewReader(content), int64(len(content)))
+	if err != nil {
+		return "", Permanent(fmt.Errorf("Failed to read the PDF: %v", err))
+	}
+	plainText, err := reader.GetPlainText()
+	if err != nil {
+		return "", Permanent(fmt.Errorf("Failed to read the PDF: %v", err))
+	}
+	extracted, err := io.ReadAll(plainText)
+	if err != nil {
+		return "", Permanent(fmt.Errorf("Failed to read the PDF: %v", err))
+	}
+	return string(extracted), nil
+}
+
+// the FHIR JSON without the inline data of its attachments, which is of no use to the model
+func withoutAttachmentData(fhirJSONString string) (string, error) {
+	var resource interface{}
+	if err := json.Unmarshal([]byte(fhirJSONString), &resource); err != nil {
+		return "", err
+	}
+	var strip func(node interface{})
+	strip = func(node interface{}) {
+		switch value := node.(type) {
+		case map[string]interface{}:
+			if _, ok := value["contentType"]; ok {
+				delete(value, "data")
+			}
+			for _, child := range value {
+				strip(child)
+			}
+		case []interface{}:
+			for _, child := range value {
+				strip(child)
+			}
+		}
+	}
+	strip(resource)
+
+	stripped, err := json.Marshal(resource)
+	if err != nil {
+		return "", err
+	}
+	return string(stripped), nil
+}
+
+// splits the text into chunks of about CHUNK_SIZE characters on word boundaries.
+// Consecutive chunks overlap by CHUNK_OVERLAP characters so that a sentence on the
+// boundary can still be found in one piece
+func ChunkText(text string) []string {
+	words := strings.Fields(text)
+	var chunks []string
+	for start := 0; start < len(words); {
+		length := 0
+		end := start
+		for end < len(words) && (end == start || length+1+len(words[end]) <= CHUNK_SIZE) {
+			length += len(words[end]) + 1
+			end++
+		}
+		chunks = append(chunks, strings.Join(words[start:end], " "))
+		if end == len(words) {
+			break
+		}
+
+		// step back from the end of the chunk for the overlap with the next one
+		next := end
+		for overlap := 0; next > start+1 && overlap+len(words[next-1])+1 <= CHUNK_OVERLAP; next-- {
+			overlap += len(words[next-1]) + 1
+		}
+		start = next
+	}
+	return chunks
+}
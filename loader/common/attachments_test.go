@@ -0,0 +1,125 @@
+package common
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestChunkText(t *testing.T) {
+	long := strings.Repeat("x", CHUNK_SIZE+10)
+	for _, test := range []struct {
+		name string
+		text string
+		want []string
+	}{
+		{"empty", "", nil},
+		{"only whitespace", " \n\t ", nil},
+		{"shorter than a chunk", "Patient reports\n\tmild  chest pain.", []string{"Patient reports mild chest pain."}},
+		{"exactly a chunk", strings.Repeat("a", CHUNK_SIZE), []string{strings.Repeat("a", CHUNK_SIZE)}},
+		{"a word longer than a chunk", "before " + long + " after", []string{"before", long, "after"}},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			if got := ChunkText(test.text); !reflect.DeepEqual(got, test.want) {
+				t.Errorf("got %d chunks %q, want %d %q", len(got), got, len(test.want), test.want)
+			}
+		})
+	}
+}
+
+// every chunk starts with the last CHUNK_OVERLAP characters of the one before, in whole words
+func TestChunkTextOverlap(t *testing.T) {
+	// words of 5 characters that appear once, so a chunk tells where it starts in the text
+	var words []string
+	for i := 0; i < 1000; i++ {
+		words = append(words, fmt.Sprintf("w%04d", i))
+	}
+	chunks := ChunkText(strings.Join(words, " "))
+	if len(chunks) < 3 {
+		t.Fatalf("got %d chunks, want the text split in several", len(chunks))
+	}
+
+	var rebuilt []string
+	for i, chunk := range chunks {
+		if len(chunk) > CHUNK_SIZE {
+			t.Errorf("chunk %d has %d characters, more than CHUNK_SIZE", i, len(chunk))
+		}
+		chunkWords := strings.Fields(chunk)
+		if i == 0 {
+			rebuilt = chunkWords
+			continue
+		}
+		previous := strings.Fields(chunks[i-1])
+		start := -1
+		for j, word := range previous {
+			if word == chunkWords[0] {
+				start = j
+			}
+		}
+		if start < 0 {
+			t.Fatalf("chunk %d doesn't overlap the one before", i)
+		}
+		overlap := strings.Join(previous[start:], " ")
+		// as many whole words as fit in CHUNK_OVERLAP, with the space after them
+		if len(overlap)+1 > CHUNK_OVERLAP || len(overlap)+1+len("w0000 ") <= CHUNK_OVERLAP {
+			t.Errorf("chunk %d overlaps the one before by %d characters, want the words in %d", i, len(overlap), CHUNK_OVERLAP)
+		}
+		if !strings.HasPrefix(chunk, overlap) {
+			t.Errorf("chunk %d doesn't start with the end of the one before", i)
+		}
+		rebuilt = append(rebuilt, chunkWords[len(previous)-start:]...)
+	}
+	if !reflect.DeepEqual(rebuilt, words) {
+		t.Error("the chunks without their overlap aren't the text")
+	}
+}
+
+func TestRtfText(t *testing.T) {
+	for _, test := range []struct {
+		name string
+		rtf  string
+		want string
+	}{
+		{"plain", `{\rtf1\ansi Chest pain}`, "Chest pain"},
+		{"paragraphs and lines", `{\rtf1 First\par Second\line Third}`, "First\nSecond\nThird"},
+		{"tabs and cells", `{\rtf1 BP\tab 120/80\cell HR\cell}`, "BP\t120/80\tHR\t"},
+		{"formatting control words", `{\rtf1\ansi\deff0\fs24 Mild \b chest\b0  pain}`, "Mild chest pain"},
+		{"control word with a negative parameter", `{\rtf1\li-360 Indented}`, "Indented"},
+		{"font and color tables", `{\rtf1{\fonttbl{\f0\fswiss Arial;}}{\colortbl;\red255\green0\blue0;}\f0 Note}`, "Note"},
+		{"ignorable destination", `{\rtf1{\*\generator Riched20 10.0;}Note}`, "Note"},
+		{"escaped characters", `{\rtf1 a \{b\} c:\\d}`, `a {b} c:\d`},
+		{"hex characters", `{\rtf1 caf\'e9}`, "café"},
+		{"source line breaks", "{\\rtf1 one\r\ntwo}", "onetwo"},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			if got := rtfText([]byte(test.rtf)); got != test.want {
+				t.Errorf("got %q, want %q", got, test.want)
+			}
+		})
+	}
+}
+
+func TestHtmlText(t *testing.T) {
+	for _, test := range []struct {
+		name string
+		html string
+		want string
+	}{
+		{"plain", "Chest pain", "Chest pain"},
+		{"named entities", "BP &lt; 120 &amp; HR &gt; 60", "BP < 120 & HR > 60"},
+		{"numeric entities", "caf&#233; &#x2014; ok", "café — ok"},
+		{"non-breaking space", "2&nbsp;mg", "2\u00a0mg"},
+		{"entities in attributes aren't text", `<a title="&lt;x&gt;">link</a>`, "link"},
+		{"line breaks", "one<br>two<br/>three", "one\ntwo\nthree"},
+		{"blocks", "<div>Note</div><p>Plan</p><ul><li>rest</li></ul>", "\nNote\nPlan\nrest"},
+		{"table cells", "<table><tr><th>BP</th><td>120/80</td></tr></table>", "\n BP 120/80"},
+		{"scripts and styles", "<style>p{color:red}</style>Note<script>var x = '<b>';</script> text", "Note text"},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			if got := htmlText([]byte(test.html)); got != test.want {
+				t.Errorf("got %q, want %q", got, test.want)
+			}
+		})
+	}
+}
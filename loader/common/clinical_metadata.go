@@ -0,0 +1,161 @@
+package common
+
+import (
+	"encoding/json"
+	"strings"
+
+	dtpb "github.com/google/fhir/go/proto/google/fhir/proto/r4/core/datatypes_go_proto"
+	r4pb "github.com/google/fhir/go/proto/google/fhir/proto/r4/core/resources/bundle_and_contained_resource_go_proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+)
+
+// a coding of the resource's code, eg. http://loinc.org 8480-6 Systolic blood pressure
+type Coding struct {
+	System  string `json:"system,omitempty"`
+	Code    string `json:"code"`
+	Display string `json:"display,omitempty"`
+}
+
+// the coded facts of a resource that are stored in columns of their own, so that retrieval can
+// filter on them without the vector search
+type ClinicalMetadata struct {
+	Codings            []Coding
+	Categories         []string // the codes of the categories, eg. vital-signs or problem-list-item
+	Status             string   // status (lifecycleStatus of a Goal) as it appears in FHIR JSON, eg. active
+	ClinicalStatus     string   // eg. active or resolved for a Condition or AllergyIntolerance
+	VerificationStatus string   // eg. confirmed or refuted
+	EncounterId        string
+}
+
+// returns a Metadata func that takes the codings from the code elements of the resource. A code element is
+// a CodeableConcept, a Coding, a list of them or a choice of those, eg. code, vaccineCode or medication.
+// Category, the statuses and the encounter are read from the elements FHIR names them with
+func clinicalMetadata(codeElements ...string) func(contained *r4pb.ContainedResource) ClinicalMetadata {
+	return func(contained *r4pb.ContainedResource) ClinicalMetadata {
+		resource := resourceOf(contained)
+		if resource == nil {
+			return ClinicalMetadata{}
+		}
+		m := resource.ProtoReflect()
+
+		var metadata ClinicalMetadata
+		for _, element := range codeElements {
+			for _, concept := range elementsOf(m, element) {
+				metadata.Codings = append(metadata.Codings, codingsOf(concept)...)
+			}
+		}
+		for _, category := range elementsOf(m, "category") {
+			for _, code := range codesOf(category) {
+				if !contains(metadata.Categories, code) {
+					metadata.Categories = append(metadata.Categories, code)
+				}
+			}
+		}
+		metadata.Status = statusCode(contained)
+		if metadata.Status == "" {
+			metadata.Status = firstCode(elementsOf(m, "lifecycleStatus"))
+		}
+		metadata.ClinicalStatus = firstCode(elementsOf(m, "clinicalStatus"))
+		metadata.VerificationStatus = firstCode(elementsOf(m, "verificationStatus"))
+
+		// the encounter of a DocumentReference is in its context
+		encounters := elementsOf(m, "encounter")
+		if len(encounters) == 0 {
+			encounters = elementsOf(m, "context.encounter")
+		}
+		for _, encounter := range encounters {
+			if reference, ok := encounter.Interface().(*dtpb.Reference); ok && reference.GetEncounterId() != nil {
+				metadata.EncounterId = reference.GetEncounterId().GetValue()
+				break
+			}
+		}
+		return metadata
+	}
+}
+
+// the messages of a (dotted) element of the resource. Lists are flattened, so an element that
+// repeats (eg. category) or sits in a repeating parent gives all of its values
+func elementsOf(m protoreflect.Message, element string) []protoreflect.Message {
+	messages := []protoreflect.Message{m}
+	for _, name := range strings.Split(element, ".") {
+		var next []protoreflect.Message
+		for _, m := range messages {
+			field := m.Descriptor().Fields().ByJSONName(name)
+			if field == nil || field.Kind() != protoreflect.MessageKind || !m.Has(field) {
+				continue
+			}
+			if !field.IsList() {
+				next = append(next, m.Get(field).Message())
+				continue
+			}
+			list := m.Get(field).List()
+			for i := 0; i < list.Len(); i++ {
+				next = append(next, list.Get(i).Message())
+			}
+		}
+		messages = next
+	}
+	return messages
+}
+
+// the codings of a CodeableConcept, a Coding or a choice holding one of them
+func codingsOf(m protoreflect.Message) []Coding {
+	switch value := m.Interface().(type) {
+	case *dtpb.CodeableConcept:
+		var codings []Coding
+		for _, coding := range value.GetCoding() {
+			codings = append(codings, codingsOf(coding.ProtoReflect())...)
+		}
+		return codings
+	case *dtpb.Coding:
+		if value.GetCode().GetValue() == "" {
+			return nil
+		}
+		return []Coding{{
+			System:  value.GetSystem().GetValue(),
+			Code:    value.GetCode().GetValue(),
+			Display: value.GetDisplay().GetValue(),
+		}}
+	}
+
+	// choice types hold their value in a oneof
+	if oneofs := m.Descriptor().Oneofs(); oneofs.Len() == 1 {
+		if field := m.WhichOneof(oneofs.Get(0)); field != nil && field.Kind() == protoreflect.MessageKind {
+			return codingsOf(m.Get(field).Message())
+		}
+	}
+	return nil
+}
+
+// the codes of a concept, or of a generated code message (eg. the category of an AllergyIntolerance)
+func codesOf(m protoreflect.Message) []string {
+	var codes []string
+	for _, coding := range codingsOf(m) {
+		codes = append(codes, coding.Code)
+	}
+	if code := enumCode(m); code != "" {
+		codes = append(codes, code)
+	}
+	return codes
+}
+
+func firstCode(elements []protoreflect.Message) string {
+	for _, element := range elements {
+		if codes := codesOf(element); len(codes) > 0 {
+			return codes[0]
+		}
+	}
+	return ""
+}
+
+// the codings column value, NULL when the resource has no codings
+func codingsJSON(metadata ClinicalMetadata) (interface{}, error) {
+	if len(metadata.Codings) == 0 {
+		return nil, nil
+	}
+	codings, err := json.Marshal(metadata.Codings)
+	if err != nil {
+		return nil, err
+	}
+	return string(codings), nil
+}
@@ -0,0 +1,71 @@
+package common
+
+import (
+	"strings"
+
+	dtpb "github.com/google/fhir/go/proto/google/fhir/proto/r4/core/datatypes_go_proto"
+	r4pb "github.com/google/fhir/go/proto/google/fhir/proto/r4/core/resources/bundle_and_contained_resource_go_proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+)
+
+// when the resource happened clinically (eg. the onset of a Condition or the effective time of an
+// Observation) rather than when it was last updated in the store. FHIR dates can be partial, a 2015
+// onset is stored as the start of 2015 with year precision
+type ClinicalTime struct {
+	ValueUs   int64  // epoch microseconds, 0 when the resource has no clinical time
+	Precision string // year, month, day, second, millisecond or microsecond
+}
+
+// returns a ClinicalTime func that takes the first of the elements that is set. An element is a
+// dateTime, date, instant, a Period (its start) or a choice of those, eg. onset or effective.
+// Nested elements are separated with a dot, eg. context.period
+func clinicalTime(elements ...string) func(contained *r4pb.ContainedResource) ClinicalTime {
+	return func(contained *r4pb.ContainedResource) ClinicalTime {
+		resource := resourceOf(contained)
+		if resource == nil {
+			return ClinicalTime{}
+		}
+		for _, element := range elements {
+			if t := timeOf(elementOf(resource.ProtoReflect(), element)); t.ValueUs != 0 {
+				return t
+			}
+		}
+		return ClinicalTime{}
+	}
+}
+
+// the message of a (dotted) element of the resource, or an invalid message when it isn't set
+func elementOf(m protoreflect.Message, element string) protoreflect.Message {
+	for _, name := range strings.Split(element, ".") {
+		field := m.Descriptor().Fields().ByJSONName(name)
+		if field == nil || field.Kind() != protoreflect.MessageKind || field.IsList() || !m.Has(field) {
+			return nil
+		}
+		m = m.Get(field).Message()
+	}
+	return m
+}
+
+func timeOf(m protoreflect.Message) ClinicalTime {
+	if m == nil || !m.IsValid() {
+		return ClinicalTime{}
+	}
+	switch value := m.Interface().(type) {
+	case *dtpb.DateTime:
+		return ClinicalTime{value.GetValueUs(), strings.ToLower(value.GetPrecision().String())}
+	case *dtpb.Date:
+		return ClinicalTime{value.GetValueUs(), strings.ToLower(value.GetPrecision().String())}
+	case *dtpb.Instant:
+		return ClinicalTime{value.GetValueUs(), strings.ToLower(value.GetPrecision().String())}
+	case *dtpb.Period:
+		return timeOf(value.GetStart().ProtoReflect())
+	}
+
+	// choice types hold their value in a oneof
+	if oneofs := m.Descriptor().Oneofs(); oneofs.Len() == 1 {
+		if field := m.WhichOneof(oneofs.Get(0)); field != nil && field.Kind() == protoreflect.MessageKind {
+			return timeOf(m.Get(field).Message())
+		}
+	}
+	return ClinicalTime{}
+}
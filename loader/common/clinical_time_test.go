@@ -0,0 +1,68 @@
+package common
+
+import (
+	"testing"
+	"time"
+)
+
+func TestClinicalTime(t *testing.T) {
+	// the dates without a time zone are in the one of the store
+	config, err := StoreConfig(testStore + "/fhir/Condition/c1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	location, err := time.LoadLocation(config.TimeZone)
+	if err != nil {
+		t.Fatal(err)
+	}
+	at := func(value string) int64 {
+		parsed, err := time.ParseInLocation(time.RFC3339Nano, value, location)
+		if err != nil {
+			parsed, err = time.ParseInLocation("2006-01-02", value, location)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		return parsed.UnixMicro()
+	}
+
+	for _, test := range []struct {
+		name string
+		json string
+		want ClinicalTime
+	}{
+		{"year", `{"resourceType":"Condition","id":"c1","subject":{"reference":"Patient/p1"},"onsetDateTime":"2015"}`,
+			ClinicalTime{at("2015-01-01"), "year"}},
+		{"month", `{"resourceType":"Condition","id":"c1","subject":{"reference":"Patient/p1"},"onsetDateTime":"2015-03"}`,
+			ClinicalTime{at("2015-03-01"), "month"}},
+		{"day", `{"resourceType":"Condition","id":"c1","subject":{"reference":"Patient/p1"},"onsetDateTime":"2015-03-04"}`,
+			ClinicalTime{at("2015-03-04"), "day"}},
+		{"second", `{"resourceType":"Condition","id":"c1","subject":{"reference":"Patient/p1"},"onsetDateTime":"2015-03-04T10:30:00+02:00"}`,
+			ClinicalTime{at("2015-03-04T08:30:00Z"), "second"}},
+		{"millisecond", `{"resourceType":"Condition","id":"c1","subject":{"reference":"Patient/p1"},"onsetDateTime":"2015-03-04T10:30:00.123Z"}`,
+			ClinicalTime{at("2015-03-04T10:30:00.123Z"), "millisecond"}},
+		{"start of a period", `{"resourceType":"Condition","id":"c1","subject":{"reference":"Patient/p1"},"onsetPeriod":{"start":"2015-03","end":"2016"}}`,
+			ClinicalTime{at("2015-03-01"), "month"}},
+		{"the next element when the first isn't set", `{"resourceType":"Condition","id":"c1","subject":{"reference":"Patient/p1"},"recordedDate":"2016-01-02"}`,
+			ClinicalTime{at("2016-01-02"), "day"}},
+		{"the first element that is set", `{"resourceType":"Condition","id":"c1","subject":{"reference":"Patient/p1"},"onsetDateTime":"2015","recordedDate":"2016-01-02"}`,
+			ClinicalTime{at("2015-01-01"), "year"}},
+		{"a choice without a time", `{"resourceType":"Condition","id":"c1","subject":{"reference":"Patient/p1"},"onsetString":"in childhood"}`, ClinicalTime{}},
+		{"none", `{"resourceType":"Condition","id":"c1","subject":{"reference":"Patient/p1"}}`, ClinicalTime{}},
+		{"instant", `{"resourceType":"Observation","id":"o1","status":"final","code":{"text":"Heart rate"},
+			"issued":"2020-05-06T07:08:09Z"}`, ClinicalTime{at("2020-05-06T07:08:09Z"), "second"}},
+		{"instant with microseconds", `{"resourceType":"Observation","id":"o1","status":"final","code":{"text":"Heart rate"},
+			"issued":"2020-05-06T07:08:09.123456Z"}`, ClinicalTime{at("2020-05-06T07:08:09.123456Z"), "microsecond"}},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			contained, err := UnmarshalResource(test.json, testStore+"/fhir/Condition/c1")
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := handlers[resourceTypeOf(contained)].ClinicalTime(contained)
+			if got != test.want {
+				t.Errorf("got %+v, want %+v", got, test.want)
+			}
+		})
+	}
+}
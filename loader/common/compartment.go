@@ -0,0 +1,160 @@
+package common
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	dtpb "github.com/google/fhir/go/proto/google/fhir/proto/r4/core/datatypes_go_proto"
+	r4pb "github.com/google/fhir/go/proto/google/fhir/proto/r4/core/resources/bundle_and_contained_resource_go_proto"
+)
+
+// the elements that put a resource in a patient's compartment, after the search parameters of the Patient
+// CompartmentDefinition (https://hl7.org/fhir/R4/compartmentdefinition-patient.html), for the resource types
+// the loader handles and those a reference chain can reach the patient through. eg. an Observation is in the
+// compartment of the Patient of its subject or performer
+var patientCompartment = map[string][]string{
+	"AllergyIntolerance":  {"patient", "recorder", "asserter"},
+	"CarePlan":            {"subject", "activity.detail.performer"},
+	"CareTeam":            {"subject", "participant.member"},
+	"Condition":           {"subject", "asserter"},
+	"Device":              {"patient"},
+	"DiagnosticReport":    {"subject"},
+	"DocumentReference":   {"subject", "author"},
+	"Encounter":           {"subject"},
+	"EpisodeOfCare":       {"patient"},
+	"Goal":                {"subject"},
+	"Immunization":        {"patient"},
+	"MedicationRequest":   {"subject"},
+	"MedicationStatement": {"subject"},
+	"Observation":         {"subject", "performer"},
+	"Procedure":           {"subject", "performer.actor"},
+	"RelatedPerson":       {"patient"},
+	"ServiceRequest":      {"subject", "performer"},
+	"Specimen":            {"subject"},
+}
+
+// the elements followed when a resource doesn't reference the patient itself: what it happened in or
+// was done for, eg. the Encounter or the ServiceRequest (basedOn) of an Observation about a Device
+var compartmentChains = []string{"encounter", "context", "context.encounter", "basedOn", "partOf"}
+
+// how many references deep a chain is followed to find the patient
+const MAX_COMPARTMENT_DEPTH = 3
+
+// returns the id of the Patient whose compartment the resource is in, following references to the resources
+// in the compartment (eg. the Device of an Observation, or its Encounter) when it doesn't reference the patient
+// itself. Empty for a resource that isn't in any patient's compartment, eg. an Observation of a Group
+func ResolvePatientId(ctx context.Context, contained *r4pb.ContainedResource, resourceURI string) (string, error) {
+	return resolvePatientId(ctx, contained, resourceURI, MAX_COMPARTMENT_DEPTH, map[string]bool{})
+}
+
+func resolvePatientId(ctx context.Context, contained *r4pb.ContainedResource, resourceURI string, depth int,
+	seen map[string]bool) (string, error) {
+	if patientId := compartmentPatientId(contained); patientId != "" || depth <= 0 {
+		return patientId, nil
+	}
+
+	resourceType := resourceTypeOf(contained)
+	for _, element := range append(patientCompartment[resourceType], compartmentChains...) {
+		for _, ref := range compartmentReferences(contained, element) {
+			referencedType, target := referenceTarget(ref)
+			// contained resources are part of the resource and don't lead anywhere else
+			if _, ok := patientCompartment[referencedType]; !ok || strings.HasPrefix(target, "#") {
+				continue
+			}
+			key, ok := referenceURI(target, resourceURI)
+			if !ok || seen[key] {
+				continue
+			}
+			seen[key] = true
+
+			referencedJSON, err := getReferencedResource(ctx, referencedType, key)
+			if IsPermanent(err) {
+				fmt.Println("Skipping", element, "reference that can't be resolved:", err)
+				continue
+			}
+			if err != nil {
+				// the patient may be behind it, so the resource can't be placed until it resolves
+				return "", fmt.Errorf("Failed to resolve the %s reference for the patient: %w", element, err)
+			}
+			referenced, err := UnmarshalResource(referencedJSON, resourceURI)
+			if err != nil {
+				fmt.Println("Skipping", element, "reference that can't be parsed:", err)
+				continue
+			}
+			patientId, err := resolvePatientId(ctx, referenced, resourceURI, depth-1, seen)
+			if err != nil || patientId != "" {
+				return patientId, err
+			}
+		}
+	}
+	return "", nil
+}
+
+// the patient the resource references in its compartment elements, or the Patient itself
+func compartmentPatientId(contained *r4pb.ContainedResource) string {
+	if patient := contained.GetPatient(); patient != nil {
+		return patient.GetId().GetValue()
+	}
+	for _, element := range patientCompartment[resourceTypeOf(contained)] {
+		for _, ref := range compartmentReferences(contained, element) {
+			if patientId := ref.GetPatientId().GetValue(); patientId != "" {
+				return patientId
+			}
+			// an absolute reference into the store
+			if referencedType, target := referenceTarget(ref); referencedType == "Patient" && ref.GetUri() != nil {
+				return referenceId(target)
+			}
+		}
+	}
+	return ""
+}
+
+// the references in a (dotted) element of the resource
+func compartmentReferences(contained *r4pb.ContainedResource, element string) []*dtpb.Reference {
+	resource := resourceOf(contained)
+	if resource == nil {
+		return nil
+	}
+	var references []*dtpb.Reference
+	for _, m := range elementsOf(resource.ProtoReflect(), element) {
+		if ref, ok := m.Interface().(*dtpb.Reference); ok {
+			references = append(references, ref)
+		}
+	}
+	return references
+}
+
+// the resource type and the reference as it appears in FHIR JSON, eg. Encounter and Encounter/123.
+// A reference to a contained resource is #id
+func referenceTarget(ref *dtpb.Reference) (string, string) {
+	m := ref.ProtoReflect()
+	field := m.WhichOneof(m.Descriptor().Oneofs().ByName("reference"))
+	if field == nil {
+		return "", ""
+	}
+	value := m.Get(field).Message()
+	id := value.Get(value.Descriptor().Fields().ByName("value")).String()
+	switch name := string(field.Name()); name {
+	case "uri":
+		return referenceType(id), id
+	case "fragment":
+		return "", "#" + id
+	default:
+		// the typed ids, eg. medication_request_id
+		var resourceType string
+		for _, part := range strings.Split(strings.TrimSuffix(name, "_id"), "_") {
+			resourceType += strings.ToUpper(part[:1]) + part[1:]
+		}
+		return resourceType, resourceType + "/" + id
+	}
+}
+
+// the id of a relative, versioned or absolute reference
+func referenceId(target string) string {
+	parts := strings.Split(strings.TrimSuffix(target, "/"), "/")
+	if len(parts) >= 4 && parts[len(parts)-2] == "_history" {
+		return parts[len(parts)-3]
+	}
+	return parts[len(parts)-1]
+}
@@ -0,0 +1,114 @@
+package common
+
+import (
+	"context"
+	"testing"
+)
+
+// an Encounter of the chain, partOf the next one. The last one has the patient as its subject
+func chainEncounter(id string, partOf string, patientId string) string {
+	json := `{"resourceType":"Encounter","id":"` + id + `","status":"finished","class":{"code":"AMB"}`
+	if partOf != "" {
+		json += `,"partOf":{"reference":"Encounter/` + partOf + `"}`
+	}
+	if patientId != "" {
+		json += `,"subject":{"reference":"Patient/` + patientId + `"}`
+	}
+	return json + "}"
+}
+
+func TestResolvePatientId(t *testing.T) {
+	// resources of their own for each case, the referenced resources are cached
+	useTestSource(t, testSource{
+		"Device/chain-d1":      `{"resourceType":"Device","id":"chain-d1","patient":{"reference":"Patient/chain-p1"}}`,
+		"Device/chain-d2":      `{"resourceType":"Device","id":"chain-d2"}`,
+		"Encounter/chain-e1":   chainEncounter("chain-e1", "", "chain-p2"),
+		"Encounter/chain-e2-1": chainEncounter("chain-e2-1", "chain-e2-2", ""),
+		"Encounter/chain-e2-2": chainEncounter("chain-e2-2", "chain-e2-3", ""),
+		"Encounter/chain-e2-3": chainEncounter("chain-e2-3", "", "chain-p3"),
+		"Encounter/chain-e3-1": chainEncounter("chain-e3-1", "chain-e3-2", ""),
+		"Encounter/chain-e3-2": chainEncounter("chain-e3-2", "chain-e3-3", ""),
+		"Encounter/chain-e3-3": chainEncounter("chain-e3-3", "chain-e3-4", ""),
+		"Encounter/chain-e3-4": chainEncounter("chain-e3-4", "", "chain-p4"),
+	})
+
+	for _, test := range []struct {
+		name        string
+		observation string
+		want        string
+	}{
+		{"the patient itself", `"subject":{"reference":"Patient/chain-p0"}`, "chain-p0"},
+		{"Device to Patient", `"subject":{"reference":"Device/chain-d1"}`, "chain-p1"},
+		{"a Device without a patient, then the Encounter", `"subject":{"reference":"Device/chain-d2"},
+			"encounter":{"reference":"Encounter/chain-e1"}`, "chain-p2"},
+		{"a missing Device", `"subject":{"reference":"Device/chain-missing"}`, ""},
+		{"a Group", `"subject":{"reference":"Group/chain-g1"}`, ""},
+		// the Observation references the first Encounter, the patient is MAX_COMPARTMENT_DEPTH references away
+		{"at MAX_COMPARTMENT_DEPTH", `"encounter":{"reference":"Encounter/chain-e2-1"}`, "chain-p3"},
+		{"past MAX_COMPARTMENT_DEPTH", `"encounter":{"reference":"Encounter/chain-e3-1"}`, ""},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			resourceURI := testStore + "/fhir/Observation/chain-o1"
+			contained, err := UnmarshalResource(`{"resourceType":"Observation","id":"chain-o1","status":"final",
+				"code":{"text":"Heart rate"},`+test.observation+`}`, resourceURI)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := ResolvePatientId(context.Background(), contained, resourceURI)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != test.want {
+				t.Errorf("the patient is %q, want %q", got, test.want)
+			}
+		})
+	}
+}
+
+// counts the reads of the resources it serves
+type countingSource struct {
+	testSource
+	reads map[string]int
+}
+
+func (s countingSource) GetResource(ctx context.Context, resourceType string, resourceURI string) (string, error) {
+	s.reads[resourceURI]++
+	return s.testSource.GetResource(ctx, resourceType, resourceURI)
+}
+
+// CarePlans based on each other are followed once each. Without the seen guard every CarePlan would be
+// followed again at each level, twice as many times per level
+func TestResolvePatientIdCycle(t *testing.T) {
+	carePlan := func(id string) string {
+		return `{"resourceType":"CarePlan","id":"` + id + `","status":"active","intent":"plan",
+			"subject":{"reference":"Group/cycle-g1"},
+			"basedOn":[{"reference":"CarePlan/cycle-a"},{"reference":"CarePlan/cycle-b"}]}`
+	}
+	source := countingSource{testSource{"CarePlan/cycle-a": carePlan("cycle-a"), "CarePlan/cycle-b": carePlan("cycle-b")}, map[string]int{}}
+	SetFHIRSource(source)
+	t.Cleanup(func() { SetFHIRSource(nil) })
+
+	resourceURI := testStore + "/fhir/Observation/cycle-o1"
+	contained, err := UnmarshalResource(`{"resourceType":"Observation","id":"cycle-o1","status":"final",
+		"code":{"text":"Heart rate"},"subject":{"reference":"Group/cycle-g1"},
+		"basedOn":[{"reference":"CarePlan/cycle-a"}]}`, resourceURI)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// deep enough for the cycle to go on for good without the guard
+	got, err := resolvePatientId(context.Background(), contained, resourceURI, 64, map[string]bool{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != "" {
+		t.Errorf("the patient is %q, want none", got)
+	}
+	if len(source.reads) != 2 {
+		t.Errorf("read %v, want the two CarePlans", source.reads)
+	}
+	for uri, reads := range source.reads {
+		if reads != 1 {
+			t.Errorf("%s was read %d times, want once", uri, reads)
+		}
+	}
+}
@@ -0,0 +1,407 @@
+package common
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	dtpb "github.com/google/fhir/go/proto/google/fhir/proto/r4/core/datatypes_go_proto"
+	r4pb "github.com/google/fhir/go/proto/google/fhir/proto/r4/core/resources/bundle_and_contained_resource_go_proto"
+	cpb "github.com/google/fhir/go/proto/google/fhir/proto/r4/core/resources/consent_go_proto"
+)
+
+// the patient's active privacy Consents (scope patient-privacy) decide whether their resources get indexed.
+// A provision denies or permits the resources it matches by all of its class (resource type), code,
+// securityLabel, data (the resource itself) and period that are set, nested provisions are exceptions to
+// the one they are in. A resource that ends up denied isn't indexed. actor, action and purpose aren't
+// evaluated: the index serves every requester, so a denial to anyone keeps the resource out of it
+const (
+	CONSENT_PRIVACY_SCOPE = "patient-privacy"
+	CONSENT_CACHE_TTL     = 10 * time.Minute
+)
+
+var consentCache = struct {
+	sync.Mutex
+	entries map[string]cachedConsents
+}{entries: map[string]cachedConsents{}}
+
+type cachedConsents struct {
+	consents []*cpb.Consent
+	expires  time.Time
+}
+
+// what a Consent decides for a resource is matched against
+type consentSubject struct {
+	resourceType string
+	id           string
+	codings      []Coding
+	labels       []string
+}
+
+// reports whether an active privacy Consent of the patient denies indexing the resource
+func consentDenies(ctx context.Context, resourceURI string, patientId string, subject consentSubject) (bool, error) {
+	if patientId == "" {
+		return false, nil
+	}
+	consents, err := activeConsents(ctx, resourceURI, patientId)
+	if err != nil {
+		return false, err
+	}
+	return deniedBy(consents, subject), nil
+}
+
+// consentDenies for a summary that is about to be written, with the Consents searched in the FHIR store
+// rather than taken from the cache. The cache of this instance doesn't see a Consent that was applied on
+// another one, whose removal of the denied summaries may already be done
+func consentDeniesSummary(ctx context.Context, resourceSummary *FHIRResourceSumamry) (bool, error) {
+	if resourceSummary.PatientId == "" {
+		return false, nil
+	}
+	resourceURI := resourceSummary.FHIRStore + "/fhir/" + resourceSummary.ResourceType + "/" + resourceSummary.ResourceId
+	consents, err := searchConsents(ctx, resourceURI, resourceSummary.PatientId)
+	if err != nil {
+		return false, err
+	}
+	return deniedBy(consents, consentSubject{resourceType: resourceSummary.ResourceType, id: resourceSummary.ResourceId,
+		codings: resourceSummary.Metadata.Codings, labels: resourceSummary.SecurityLabels}), nil
+}
+
+func deniedBy(consents []*cpb.Consent, subject consentSubject) bool {
+	now := time.Now().UnixMicro()
+	for _, consent := range consents {
+		if denies(consent.GetProvision(), "permit", subject, now) {
+			fmt.Println("Consent", consent.GetId().GetValue(), "denies", subject.resourceType, subject.id)
+			return true
+		}
+	}
+	return false
+}
+
+// the decision of the provision for the subject, or of the exception to it that matches. A provision
+// that doesn't say deny or permit is the same as the one it is in
+func denies(provision *cpb.Consent_Provision, inherited string, subject consentSubject, now int64) bool {
+	if provision == nil || !provisionMatches(provision, subject, now) {
+		return inherited == "deny"
+	}
+	decision := enumCode(provision.GetType().ProtoReflect())
+	if decision == "" {
+		decision = inherited
+	}
+	for _, exception := range provision.GetProvision() {
+		if provisionMatches(exception, subject, now) {
+			return denies(exception, decision, subject, now)
+		}
+	}
+	return decision == "deny"
+}
+
+// all the criteria of the provision that are set match the subject
+func provisionMatches(provision *cpb.Consent_Provision, subject consentSubject, now int64) bool {
+	if !inPeriod(provision.GetPeriod(), now) {
+		return false
+	}
+	if classes := provision.GetClassValue(); len(classes) > 0 {
+		matched := false
+		for _, class := range classes {
+			matched = matched || class.GetCode().GetValue() == subject.resourceType
+		}
+		if !matched {
+			return false
+		}
+	}
+	if concepts := provision.GetCode(); len(concepts) > 0 {
+		matched := false
+		for _, concept := range concepts {
+			for _, coding := range concept.GetCoding() {
+				for _, c := range subject.codings {
+					matched = matched || (c.Code == coding.GetCode().GetValue() &&
+						(coding.GetSystem().GetValue() == "" || c.System == coding.GetSystem().GetValue()))
+				}
+			}
+		}
+		if !matched {
+			return false
+		}
+	}
+	if labels := provision.GetSecurityLabel(); len(labels) > 0 {
+		matched := false
+		for _, label := range labels {
+			matched = matched || contains(subject.labels, label.GetCode().GetValue())
+		}
+		if !matched {
+			return false
+		}
+	}
+	if data := provision.GetData(); len(data) > 0 {
+		matched := false
+		for _, d := range data {
+			referencedType, target := referenceTarget(d.GetReference())
+			matched = matched || (referencedType == subject.resourceType && referenceId(target) == subject.id)
+		}
+		if !matched {
+			return false
+		}
+	}
+	return true
+}
+
+func inPeriod(period *dtpb.Period, now int64) bool {
+	if start := period.GetStart().GetValueUs(); start != 0 && now < start {
+		return false
+	}
+	if end := period.GetEnd().GetValueUs(); end != 0 && now > end {
+		return false
+	}
+	return true
+}
+
+// the patient's active privacy Consents, from the cache or a FHIR search on the store of the resource
+func activeConsents(ctx context.Context, resourceURI string, patientId string) ([]*cpb.Consent, error) {
+	key := fhirStoreURI(resourceURI) + "/Patient/" + patientId
+	consentCache.Lock()
+	cached, ok := consentCache.entries[key]
+	consentCache.Unlock()
+	if ok && time.Now().Before(cached.expires) {
+		return cached.consents, nil
+	}
+	return searchConsents(ctx, resourceURI, patientId)
+}
+
+// the patient's active privacy Consents from a FHIR search, which are cached for the next resources of the patient
+func searchConsents(ctx context.Context, resourceURI string, patientId string) ([]*cpb.Consent, error) {
+	key := fhirStoreURI(resourceURI) + "/Patient/" + patientId
+	searchURI := fmt.Sprintf("%s/Consent?patient=%s&status=active&_count=100", fhirStoreURI(resourceURI), url.QueryEscape(patientId))
+	bundleJSON, err := GetFHIRResource(ctx, "Bundle", searchURI)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to search the Consents of the patient: %w", err)
+	}
+	var bundle struct {
+		Entry []struct {
+			Resource json.RawMessage `json:"resource"`
+		} `json:"entry"`
+	}
+	if err := json.Unmarshal([]byte(bundleJSON), &bundle); err != nil {
+		return nil, fmt.Errorf("failed to parse search Bundle: %v", err)
+	}
+
+	var consents []*cpb.Consent
+	for _, entry := range bundle.Entry {
+		contained, err := UnmarshalResource(string(entry.Resource), resourceURI)
+		if err != nil {
+			// a Consent that can't be read can't be honoured either, so nothing is indexed until it's fixed
+			return nil, Permanent(fmt.Errorf("Failed to parse a Consent of the patient: %v", err))
+		}
+		if consent := contained.GetConsent(); isPrivacyConsent(consent) {
+			consents = append(consents, consent)
+		}
+	}
+
+	consentCache.Lock()
+	defer consentCache.Unlock()
+	if len(consentCache.entries) >= REFERENCE_CACHE_SIZE {
+		consentCache.entries = map[string]cachedConsents{}
+	}
+	consentCache.entries[key] = cachedConsents{consents: consents, expires: time.Now().Add(CONSENT_CACHE_TTL)}
+	return consents, nil
+}
+
+func isPrivacyConsent(consent *cpb.Consent) bool {
+	return consent != nil && enumCode(consent.GetStatus().ProtoReflect()) == "active" &&
+		hasCode(consent.GetScope(), CONSENT_PRIVACY_SCOPE)
+}
+
+// applies a Consent that was created, updated or deleted: the patient's Consents are read again and the
+// stored summaries they deny are removed. Only the rows of the Consent's FHIR store are the patient's, the
+// same patient id can be another patient's in another store. When the Consent is deleted or no longer an
+// active privacy Consent, the resources it denied are indexed again right away, see reindexPatient.
+// Resources that an updated Consent no longer denies come back when they change next or with a backfill.
+// Returns the patient and the number of summaries removed
+func ApplyConsent(ctx context.Context, resourceURI string, action string) (string, int, error) {
+	if action == DELETE_ACTION {
+		patientId, err := deletedConsentPatient(ctx, resourceURI)
+		if err != nil {
+			return "", 0, err
+		}
+		if patientId == "" {
+			// the patient of the deleted Consent isn't known, none of the cached Consents can be trusted
+			fmt.Println("No patient found in the history of the deleted Consent:", resourceURI)
+			consentCache.Lock()
+			consentCache.entries = map[string]cachedConsents{}
+			consentCache.Unlock()
+			return "", 0, nil
+		}
+		consentCache.Lock()
+		delete(consentCache.entries, fhirStoreURI(resourceURI)+"/Patient/"+patientId)
+		consentCache.Unlock()
+		return patientId, 0, reindexPatient(ctx, resourceURI, patientId)
+	}
+
+	consentJSON, err := GetFHIRResource(ctx, "Consent", resourceURI)
+	if err != nil {
+		return "", 0, fmt.Errorf("Erorr Getting the Consent: %w", err)
+	}
+	contained, err := UnmarshalResource(consentJSON, resourceURI)
+	if err != nil {
+		return "", 0, err
+	}
+	patientId := contained.GetConsent().GetPatient().GetPatientId().GetValue()
+	if patientId == "" {
+		return "", 0, nil
+	}
+	consentCache.Lock()
+	delete(consentCache.entries, fhirStoreURI(resourceURI)+"/Patient/"+patientId)
+	consentCache.Unlock()
+	if !isPrivacyConsent(contained.GetConsent()) {
+		// eg. set to inactive, what it denied may be indexed again
+		return patientId, 0, reindexPatient(ctx, resourceURI, patientId)
+	}
+	if currentSink() != nil {
+		// the stored summaries are read from AlloyDB, another sink gets no deletions
+		fmt.Println("Stored summaries are only re-evaluated in AlloyDB")
+		return patientId, 0, nil
+	}
+
+	fhirStore := fhirStoreOf(resourceURI)
+	rows, err := listPatientResources(ctx, fhirStore, patientId)
+	if err != nil {
+		return patientId, 0, err
+	}
+	var removed int
+	for _, row := range rows {
+		resourceURIOfRow := fhirStoreURI(resourceURI) + "/" + row.resourceType + "/" + row.id
+		stored, err := UnmarshalResource(row.data, resourceURIOfRow)
+		if err != nil {
+			fmt.Println("Skipping a stored resource that can't be parsed:", row.resourceType, row.id, err)
+			continue
+		}
+		subject, err := consentSubjectOf(stored, row.resourceType, row.id)
+		if err != nil {
+			return patientId, removed, err
+		}
+		denied, err := consentDenies(ctx, resourceURIOfRow, patientId, subject)
+		if err != nil {
+			return patientId, removed, err
+		}
+		if denied {
+			if err := DeleteSummary(ctx, fhirStore, row.resourceType, row.id); err != nil {
+				return patientId, removed, err
+			}
+			removed++
+		}
+	}
+	return patientId, removed, nil
+}
+
+// the patient of a deleted Consent, from the latest version of it in its history. Empty when there is none
+func deletedConsentPatient(ctx context.Context, resourceURI string) (string, error) {
+	bundleJSON, err := GetFHIRResource(ctx, "Bundle", resourceURI+"/_history")
+	if IsGone(err) {
+		return "", nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("Failed to get the history of the Consent: %w", err)
+	}
+	var bundle struct {
+		Entry []struct {
+			Resource json.RawMessage `json:"resource"`
+		} `json:"entry"`
+	}
+	if err := json.Unmarshal([]byte(bundleJSON), &bundle); err != nil {
+		return "", fmt.Errorf("failed to parse history Bundle: %v", err)
+	}
+	// the newest version first. The one of the delete has no resource
+	for _, entry := range bundle.Entry {
+		if len(entry.Resource) == 0 {
+			continue
+		}
+		contained, err := UnmarshalResource(string(entry.Resource), resourceURI)
+		if err != nil {
+			return "", Permanent(fmt.Errorf("Failed to parse a version of the Consent: %v", err))
+		}
+		if patientId := contained.GetConsent().GetPatient().GetPatientId().GetValue(); patientId != "" {
+			return patientId, nil
+		}
+	}
+	return "", nil
+}
+
+// indexes the resources of the patient's compartment in the FHIR store of the Consent again, eg. after a
+// Consent was deleted. Each one is processed as a notification of its update, so the unchanged ones keep
+// their summary and the ones another Consent still denies are left out. A transient failure is returned for
+// Pub/Sub to deliver the Consent event again, the resources done by then are unchanged the next time
+func reindexPatient(ctx context.Context, resourceURI string, patientId string) error {
+	pageURI := fhirStoreURI(resourceURI) + "/Patient/" + url.PathEscape(patientId) + "/$everything"
+	var reindexed int
+	for pageURI != "" {
+		bundleJSON, err := GetFHIRResource(ctx, "Bundle", pageURI)
+		if err != nil {
+			return fmt.Errorf("Failed to get the resources of the patient: %w", err)
+		}
+		var bundle struct {
+			Link []struct {
+				Relation string `json:"relation"`
+				URL      string `json:"url"`
+			} `json:"link"`
+			Entry []struct {
+				Resource struct {
+					ResourceType string `json:"resourceType"`
+					Id           string `json:"id"`
+					Meta         struct {
+						VersionId string `json:"versionId"`
+					} `json:"meta"`
+				} `json:"resource"`
+			} `json:"entry"`
+		}
+		if err := json.Unmarshal([]byte(bundleJSON), &bundle); err != nil {
+			return fmt.Errorf("failed to parse search Bundle: %v", err)
+		}
+
+		for _, e := range bundle.Entry {
+			// the patient's Consents aren't indexed, applying them again would start another re-index
+			if e.Resource.ResourceType == "" || e.Resource.ResourceType == "Consent" {
+				continue
+			}
+			// as the notification of an update would be, recorded in the ledger and dead-lettered alike
+			var msg MessagePublishedData
+			msg.Message.Attributes.ResourceType = e.Resource.ResourceType
+			msg.Message.Attributes.Action = UPDATE_ACTION
+			msg.Message.Attributes.VersionID = e.Resource.Meta.VersionId
+			msg.Message.Data = []byte(fhirStoreURI(resourceURI) + "/" + e.Resource.ResourceType + "/" + e.Resource.Id)
+			payload, err := json.Marshal(msg)
+			if err != nil {
+				return fmt.Errorf("Failed to marshal the event: %v", err)
+			}
+			if err := ProcessMessage(ctx, &msg, payload, time.Now()); err != nil {
+				return err
+			}
+			reindexed++
+		}
+
+		pageURI = ""
+		for _, link := range bundle.Link {
+			if link.Relation == "next" {
+				// the next page is an absolute URL of the Cloud Healthcare API
+				pageURI = strings.TrimPrefix(link.URL, "https://healthcare.googleapis.com/v1/")
+			}
+		}
+	}
+	fmt.Println("Re-indexed resources of patient", patientId, ":", reindexed)
+	return nil
+}
+
+// what Consents are matched against for the resource: its type and id, codings and security labels
+func consentSubjectOf(contained *r4pb.ContainedResource, resourceType string, id string) (consentSubject, error) {
+	labels, err := securityLabelsOf(contained)
+	if err != nil {
+		return consentSubject{}, err
+	}
+	subject := consentSubject{resourceType: resourceType, id: id, labels: labels.Labels}
+	if handler, ok := handlers[resourceType]; ok && handler.Metadata != nil {
+		subject.codings = handler.Metadata(contained).Codings
+	}
+	return subject, nil
+}
@@ -0,0 +1,58 @@
+package common
+
+import (
+	"context"
+	"testing"
+)
+
+// a deleted Consent no longer denies anything, the resources of its patient are indexed again without waiting
+// for them to change
+func TestDeletedConsentReindexesPatient(t *testing.T) {
+	s := useRecordingSink(t)
+	patient := `{"resourceType":"Patient","id":"consent-patient-1"}`
+	observation := `{"resourceType":"Observation","id":"consent-o1","meta":{"versionId":"2"},"status":"final",
+		"code":{"text":"Heart rate"},"subject":{"reference":"Patient/consent-patient-1"}}`
+	useTestSource(t, testSource{
+		"Patient/consent-patient-1": patient,
+		"Observation/consent-o1":    observation,
+		"Consent/consent-c1/_history": `{"resourceType":"Bundle","type":"history","entry":[
+			{"request":{"method":"DELETE","url":"Consent/consent-c1"}},
+			{"resource":{"resourceType":"Consent","id":"consent-c1","status":"active",
+				"scope":{"coding":[{"system":"http://terminology.hl7.org/CodeSystem/consentscope","code":"patient-privacy"}]},
+				"category":[{"coding":[{"system":"http://loinc.org","code":"59284-0"}]}],
+				"patient":{"reference":"Patient/consent-patient-1"},"policyRule":{"text":"no indexing"},
+				"provision":{"type":"deny"}}}]}`,
+		"Patient/consent-patient-1/$everything": `{"resourceType":"Bundle","type":"searchset","entry":[
+			{"resource":` + patient + `},{"resource":` + observation + `},
+			{"resource":{"resourceType":"Consent","id":"consent-c2"}}]}`,
+	})
+
+	entry := &LedgerEntry{ResourceType: "Consent", Action: DELETE_ACTION, ResourceURI: testStore + "/fhir/Consent/consent-c1"}
+	if err := ProcessEvent(context.Background(), entry, false); err != nil {
+		t.Fatal(err)
+	}
+	if entry.PatientId != "consent-patient-1" {
+		t.Errorf("the patient is %q, want the one of the Consent's last version", entry.PatientId)
+	}
+	saved := map[string]bool{}
+	for _, summary := range s.saved {
+		saved[summary.ResourceType+"/"+summary.ResourceId] = true
+	}
+	if !saved["Patient/consent-patient-1"] || !saved["Observation/consent-o1"] || len(saved) != 2 {
+		t.Errorf("saved %v, want the Patient and the Observation", saved)
+	}
+}
+
+// without a history, the patient of the deleted Consent isn't known and nothing is indexed
+func TestDeletedConsentWithoutHistory(t *testing.T) {
+	s := useRecordingSink(t)
+	useTestSource(t, testSource{})
+
+	entry := &LedgerEntry{ResourceType: "Consent", Action: DELETE_ACTION, ResourceURI: testStore + "/fhir/Consent/consent-c3"}
+	if err := ProcessEvent(context.Background(), entry, false); err != nil {
+		t.Fatal(err)
+	}
+	if entry.PatientId != "" || len(s.saved) != 0 {
+		t.Errorf("the patient is %q and %d summaries were saved, want none", entry.PatientId, len(s.saved))
+	}
+}
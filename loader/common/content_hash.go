@@ -0,0 +1,53 @@
+package common
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// elements of a resource that are left out of its content hash: the server assigned id and meta
+// (versionId, lastUpdated, ...) and the narrative, which is rendered from the data
+var nonClinicalElements = []string{"id", "meta", "text"}
+
+// hash of the clinically relevant content of the FHIR JSON and of the other inputs of the summary, eg. the
+// prompt input and the attachment text. An update that only changes meta or the narrative of the JSON gives
+// the same hash, so the stored summary still holds for it, while a new version of the Binary of a note or of
+// a referenced Medication doesn't.
+// Keys are sorted and numbers are kept as they are written, so equal content always gives the same hash
+func ContentHash(fhirJSONString string, inputs ...string) (string, error) {
+	decoder := json.NewDecoder(strings.NewReader(fhirJSONString))
+	decoder.UseNumber()
+	var resource map[string]interface{}
+	if err := decoder.Decode(&resource); err != nil {
+		return "", Permanent(err)
+	}
+
+	for _, element := range nonClinicalElements {
+		delete(resource, element)
+	}
+	// contained resources keep their id, references to them use it
+	if contained, ok := resource["contained"].([]interface{}); ok {
+		for _, c := range contained {
+			if containedResource, ok := c.(map[string]interface{}); ok {
+				delete(containedResource, "meta")
+				delete(containedResource, "text")
+			}
+		}
+	}
+
+	// encoding/json writes the keys of a map sorted
+	canonical, err := json.Marshal(resource)
+	if err != nil {
+		return "", err
+	}
+	h := sha256.New()
+	h.Write(canonical)
+	// each input is written with its length, so moving text from one input to the next changes the hash
+	for _, input := range inputs {
+		fmt.Fprintf(h, "\n%d:%s", len(input), input)
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
@@ -0,0 +1,83 @@
+package common
+
+import "testing"
+
+const hashedObservation = `{"resourceType":"Observation","id":"o1","meta":{"versionId":"1","lastUpdated":"2024-03-05T11:00:00Z"},
+	"text":{"status":"generated","div":"<div xmlns=\"http://www.w3.org/1999/xhtml\">Heart rate 72</div>"},
+	"contained":[{"resourceType":"Practitioner","id":"dr1","meta":{"versionId":"1"},
+		"text":{"status":"generated","div":"<div xmlns=\"http://www.w3.org/1999/xhtml\">Dr. A</div>"},"active":true}],
+	"status":"final","code":{"text":"Heart rate"},"performer":[{"reference":"#dr1"}],
+	"valueQuantity":{"value":72.0,"unit":"/min"}}`
+
+// the inputs of the summary that ContentHash is given along with the JSON
+var hashedInputs = []string{"prompt input", "attachment text", "narrative"}
+
+func TestContentHash(t *testing.T) {
+	want, err := ContentHash(hashedObservation, hashedInputs...)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct {
+		name   string
+		json   string
+		inputs []string
+		same   bool
+	}{
+		{"another id", `{"resourceType":"Observation","id":"o2","meta":{"versionId":"1","lastUpdated":"2024-03-05T11:00:00Z"},
+			"text":{"status":"generated","div":"<div xmlns=\"http://www.w3.org/1999/xhtml\">Heart rate 72</div>"},
+			"contained":[{"resourceType":"Practitioner","id":"dr1","meta":{"versionId":"1"},
+				"text":{"status":"generated","div":"<div xmlns=\"http://www.w3.org/1999/xhtml\">Dr. A</div>"},"active":true}],
+			"status":"final","code":{"text":"Heart rate"},"performer":[{"reference":"#dr1"}],
+			"valueQuantity":{"value":72.0,"unit":"/min"}}`, hashedInputs, true},
+		{"another meta and narrative", `{"resourceType":"Observation","id":"o1","meta":{"versionId":"7","lastUpdated":"2024-06-01T00:00:00Z","tag":[{"code":"x"}]},
+			"text":{"status":"generated","div":"<div xmlns=\"http://www.w3.org/1999/xhtml\">HR 72/min</div>"},
+			"contained":[{"resourceType":"Practitioner","id":"dr1","meta":{"versionId":"1"},
+				"text":{"status":"generated","div":"<div xmlns=\"http://www.w3.org/1999/xhtml\">Dr. A</div>"},"active":true}],
+			"status":"final","code":{"text":"Heart rate"},"performer":[{"reference":"#dr1"}],
+			"valueQuantity":{"value":72.0,"unit":"/min"}}`, hashedInputs, true},
+		{"another meta and narrative of a contained resource", `{"resourceType":"Observation","id":"o1","meta":{"versionId":"1","lastUpdated":"2024-03-05T11:00:00Z"},
+			"text":{"status":"generated","div":"<div xmlns=\"http://www.w3.org/1999/xhtml\">Heart rate 72</div>"},
+			"contained":[{"resourceType":"Practitioner","id":"dr1","meta":{"versionId":"3"},"active":true}],
+			"status":"final","code":{"text":"Heart rate"},"performer":[{"reference":"#dr1"}],
+			"valueQuantity":{"value":72.0,"unit":"/min"}}`, hashedInputs, true},
+		{"keys in another order and whitespace", `{"valueQuantity":{"unit":"/min","value":72.0},"status":"final",
+			"performer":[{"reference":"#dr1"}],"code":{"text":"Heart rate"},
+			"contained":[{"active":true,"id":"dr1","resourceType":"Practitioner"}],"resourceType":"Observation"}`, hashedInputs, true},
+
+		// the contained resources keep their id, the references to them use it
+		{"another id of a contained resource", `{"resourceType":"Observation","id":"o1",
+			"contained":[{"resourceType":"Practitioner","id":"dr2","active":true}],
+			"status":"final","code":{"text":"Heart rate"},"performer":[{"reference":"#dr1"}],
+			"valueQuantity":{"value":72.0,"unit":"/min"}}`, hashedInputs, false},
+		{"another value", `{"resourceType":"Observation","id":"o1",
+			"contained":[{"resourceType":"Practitioner","id":"dr1","active":true}],
+			"status":"final","code":{"text":"Heart rate"},"performer":[{"reference":"#dr1"}],
+			"valueQuantity":{"value":73.0,"unit":"/min"}}`, hashedInputs, false},
+		{"a number written another way", `{"resourceType":"Observation","id":"o1",
+			"contained":[{"resourceType":"Practitioner","id":"dr1","active":true}],
+			"status":"final","code":{"text":"Heart rate"},"performer":[{"reference":"#dr1"}],
+			"valueQuantity":{"value":72,"unit":"/min"}}`, hashedInputs, false},
+		{"another prompt input", hashedObservation, []string{"prompt input with Medication facts", "attachment text", "narrative"}, false},
+		{"another attachment text", hashedObservation, []string{"prompt input", "new version of the note", "narrative"}, false},
+		{"another narrative", hashedObservation, []string{"prompt input", "attachment text", "amended narrative"}, false},
+		{"text moved between inputs", hashedObservation, []string{"prompt input attachment", "text", "narrative"}, false},
+		{"no inputs", hashedObservation, nil, false},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := ContentHash(test.json, test.inputs...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if (got == want) != test.same {
+				t.Errorf("the hash changed: %v, want %v", got != want, !test.same)
+			}
+		})
+	}
+}
+
+func TestContentHashInvalidJSON(t *testing.T) {
+	if _, err := ContentHash(`{"resourceType":`); !IsPermanent(err) {
+		t.Errorf("got %v, want a permanent error", err)
+	}
+}
@@ -0,0 +1,71 @@
+package common
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+
+	"fhirgen.ai/llm"
+)
+
+// an event that failed permanently or ran out of retries, kept with the reason so it can be looked into
+// and replayed
+type DeadLetter struct {
+	MessageId    string // the Pub/Sub messageId. Part of the key, the messages that couldn't be parsed have nothing else
+	ResourceType string
+	ResourceId   string
+	VersionId    string
+	Action       string
+	ResourceURI  string
+	Payload      []byte // the event as it was received
+	Reason       string
+}
+
+// records the dead letter. The same message failing again updates the reason and counts the attempt.
+// A message without an id (eg. a push request that isn't JSON) is keyed by the hash of its payload
+func SaveDeadLetter(ctx context.Context, deadLetter *DeadLetter) error {
+	if s := currentSink(); s != nil {
+		return s.SaveDeadLetter(ctx, deadLetter)
+	}
+
+	fmt.Println("Saving dead letter to AlloyDB:", deadLetter.MessageId, deadLetter.ResourceType, deadLetter.ResourceId, deadLetter.VersionId)
+
+	conn, err := llm.GetConnection(ctx)
+	if err != nil {
+		return err
+	}
+
+	// payloads that aren't JSON are kept as a JSON string
+	var payload interface{}
+	if json.Valid(deadLetter.Payload) {
+		payload = string(deadLetter.Payload)
+	} else if deadLetter.Payload != nil {
+		quoted, _ := json.Marshal(string(deadLetter.Payload))
+		payload = string(quoted)
+	}
+
+	messageId := deadLetter.MessageId
+	if messageId == "" {
+		messageId = fmt.Sprintf("sha256:%x", sha256.Sum256(deadLetter.Payload))
+	}
+
+	stmt := `
+		INSERT INTO public.dead_letters (resourceType, resourceId, versionId, action, messageId, resourceURI, payload, reason)
+		VALUES ($1, $2, $3, $4, $5, $6, $7::jsonb, $8)
+		ON CONFLICT (resourceType, resourceId, versionId, action, messageId) DO UPDATE SET
+			resourceURI = EXCLUDED.resourceURI,
+			payload = EXCLUDED.payload,
+			reason = EXCLUDED.reason,
+			attempts = public.dead_letters.attempts + 1,
+			updatedAt = now()
+	`
+	_, err = conn.Exec(ctx, stmt, deadLetter.ResourceType, deadLetter.ResourceId, deadLetter.VersionId,
+		deadLetter.Action, messageId, deadLetter.ResourceURI, payload, deadLetter.Reason)
+	if err != nil {
+		return fmt.Errorf("Unable to insert dead letter into AlloyDB: %v", err)
+	}
+	fmt.Println("Saved dead letter to AlloyDB")
+
+	return nil
+}
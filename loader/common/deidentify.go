@@ -0,0 +1,380 @@
+package common
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"unicode"
+)
+
+// de-identification of everything the loader sends to a language model (the prompt, attachment
+// chunks and narratives, which end up in the RAG prompt)
+//   - safe-harbor (default): removes the HIPAA Safe Harbor identifiers and generalizes dates to the year
+//   - limited: removes the identifiers but keeps the dates, like a HIPAA limited data set
+//   - off: sends the resources as they are. Only for deployments where the model may see PHI
+var DEID_POLICY = os.Getenv("DEID_POLICY")
+
+const (
+	DEID_SAFE_HARBOR = "safe-harbor"
+	DEID_LIMITED     = "limited"
+	DEID_OFF         = "off"
+)
+
+// returned when an identifier of the resource is still in the de-identified output.
+// The resource is not sent to the model then
+var ErrIdentifierLeak = errors.New("identifier left after de-identification")
+
+func deidPolicy() string {
+	switch DEID_POLICY {
+	case DEID_LIMITED, DEID_OFF:
+		return DEID_POLICY
+	default:
+		return DEID_SAFE_HARBOR
+	}
+}
+
+// elements that are removed wherever they appear, in the resource and its contained resources
+var identifyingElements = map[string]bool{
+	"identifier":           true,
+	"telecom":              true,
+	"address":              true,
+	"photo":                true,
+	"contact":              true,
+	"birthDate":            true,
+	"deceasedDateTime":     true,
+	"multipleBirthInteger": true,
+	"authorString":         true,
+	"valueAddress":         true,
+	"valueHumanName":       true,
+	"valueContactPoint":    true,
+	"valueIdentifier":      true,
+	"meta":                 true,
+}
+
+// elements holding codes, urls and ids rather than text, which are left alone
+var structuralElements = map[string]bool{
+	"resourceType": true,
+	"id":           true,
+	"system":       true,
+	"code":         true,
+	"version":      true,
+	"contentType":  true,
+	"language":     true,
+	"profile":      true,
+	"unit":         true,
+}
+
+// references to these types point to a person, their ids are removed
+var personTypes = []string{"Patient", "Practitioner", "PractitionerRole", "RelatedPerson", "Person"}
+
+var (
+	emailPattern = regexp.MustCompile(`[\w.+-]+@[\w-]+(\.[\w-]+)+`)
+	ssnPattern   = regexp.MustCompile(`\b\d{3}-\d{2}-\d{4}\b`)
+	phonePattern = regexp.MustCompile(`(\+\d{1,2}[\s.-]?)?\(?\b\d{3}\)?[\s.-]?\d{3}[\s.-]?\d{4}\b`)
+	urlPattern   = regexp.MustCompile(`\b(https?://|www\.)\S+`)
+	ipPattern    = regexp.MustCompile(`\b\d{1,3}(\.\d{1,3}){3}\b`)
+	mrnPattern   = regexp.MustCompile(`(?i)\b(MRN|medical record (number|no\.?)|account (number|no\.?)|acct)[\s:#]*[\w-]*\d[\w-]*`)
+	// birth dates in free text, with the year as birth years can give away an age over 89
+	dobPattern = regexp.MustCompile(`(?i)\b(DOB|D\.O\.B\.|date of birth|born on|born)[\s:]*(\d{1,2}/\d{1,2}/\d{2,4}|\d{4}-\d{2}-\d{2}|\d{4})`)
+	// ages over 89 are grouped together
+	agePattern = regexp.MustCompile(`(?i)\b(9\d|1[0-4]\d)(\s|-)?(years?|yrs?|y/?o)\b`)
+	// 2024-01-02, 2024-01-02T10:30:00Z, 2024-01-02 10:30 UTC. The year is kept
+	isoDatePattern = regexp.MustCompile(`\b(\d{4})-\d{2}(-\d{2})?([T ]\d{2}:\d{2}(:\d{2}(\.\d+)?)?(Z|\s?[+-]\d{2}:?\d{2}|\s[A-Z]{3,5}\b)?)?`)
+	// 01/02/2024, 1/2/24
+	usDatePattern = regexp.MustCompile(`\b\d{1,2}/\d{1,2}/(\d{4}|\d{2})\b`)
+)
+
+// identifiers collects the values that identify the people in a resource: names, contact details,
+// addresses, identifiers and birth dates. They are redacted wherever they show up in free text
+type identifiers map[string]bool
+
+// de-identifies the FHIR JSON (a resource, with its contained resources) for the prompt. known holds
+// identifiers from outside the resource, eg. the name of the patient, for redacting free text
+func DeidentifyJSON(fhirJSONString string, known identifiers) (string, identifiers, error) {
+	var resource interface{}
+	if err := json.Unmarshal([]byte(fhirJSONString), &resource); err != nil {
+		return "", nil, err
+	}
+
+	found := identifiers{}
+	found.collect(resource)
+	for value := range known {
+		found[value] = true
+	}
+	if deidPolicy() == DEID_OFF {
+		return fhirJSONString, found, nil
+	}
+
+	deidentified, err := json.Marshal(deidentifyNode("", resource, found))
+	if err != nil {
+		return "", nil, err
+	}
+	if err := checkLeaks(string(deidentified), found); err != nil {
+		return "", nil, err
+	}
+	return string(deidentified), found, nil
+}
+
+// de-identifies free text, eg. the text of an attachment or a narrative
+func DeidentifyText(text string, found identifiers) (string, error) {
+	if deidPolicy() == DEID_OFF {
+		return text, nil
+	}
+	deidentified := deidentifyText(text, found)
+	if err := checkLeaks(deidentified, found); err != nil {
+		return "", err
+	}
+	return deidentified, nil
+}
+
+// the identifiers of the Patient the resource belongs to, for redacting free text like clinical notes
+// that mention the patient by name
+func patientIdentifiers(ctx context.Context, resourceURI string, patientId string) (identifiers, error) {
+	found := identifiers{}
+	if patientId == "" || deidPolicy() == DEID_OFF {
+		return found, nil
+	}
+	patientJSON, err := GetFHIRResource(ctx, "Patient", fhirStoreURI(resourceURI)+"/Patient/"+patientId)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to get the Patient for de-identification: %v", err)
+	}
+	var patient interface{}
+	if err := json.Unmarshal([]byte(patientJSON), &patient); err != nil {
+		return nil, fmt.Errorf("Failed to parse the Patient for de-identification: %v", err)
+	}
+	found.collect(patient)
+	return found, nil
+}
+
+// walks the JSON and collects the identifying values
+func (found identifiers) collect(node interface{}) {
+	switch value := node.(type) {
+	case map[string]interface{}:
+		for key, child := range value {
+			switch {
+			case key == "name" && !isString(child):
+				// HumanName
+				found.addStrings(child, true, "family", "given", "text")
+			case key == "display" && isReference(value), key == "authorString":
+				found.addStrings(child, true)
+			case key == "telecom" || key == "valueContactPoint":
+				found.addStrings(child, false, "value")
+			case key == "address" || key == "valueAddress":
+				found.addStrings(child, false, "city", "district", "postalCode", "text")
+				found.addAddressLines(child)
+			case key == "identifier" || key == "valueIdentifier":
+				found.addStrings(child, false, "value")
+			case key == "birthDate":
+				found.addStrings(child, false)
+			}
+			found.collect(child)
+		}
+	case []interface{}:
+		for _, child := range value {
+			found.collect(child)
+		}
+	}
+}
+
+// adds the string values of the fields (or of the node itself when no fields are given).
+// Names are added word by word as well, so that "John Smith" also redacts a "Smith" on its own
+func (found identifiers) addStrings(node interface{}, name bool, fields ...string) {
+	switch value := node.(type) {
+	case string:
+		if len(fields) > 0 {
+			return
+		}
+		found.add(value)
+		if name {
+			for _, word := range strings.FieldsFunc(value, func(r rune) bool { return r == ' ' || r == ',' }) {
+				// short words (initials, titles like Dr) are too common in clinical text to be redacted on their own
+				if word = strings.Trim(word, "."); len(word) >= 3 {
+					found.add(word)
+				}
+			}
+		}
+	case []interface{}:
+		for _, child := range value {
+			found.addStrings(child, name, fields...)
+		}
+	case map[string]interface{}:
+		for _, field := range fields {
+			found.addStrings(value[field], name)
+		}
+	}
+}
+
+// street address lines, also word by word without the house numbers and street types,
+// so that "742 Evergreen Terrace" also redacts "Evergreen"
+func (found identifiers) addAddressLines(node interface{}) {
+	var lines identifiers = identifiers{}
+	lines.addStrings(node, false, "line")
+	for line := range lines {
+		found.add(line)
+		for _, word := range strings.Fields(line) {
+			word = strings.Trim(word, ".,#")
+			if len(word) >= 3 && strings.IndexFunc(word, unicode.IsLetter) >= 0 && !streetTypes[strings.ToLower(word)] {
+				found.add(word)
+			}
+		}
+	}
+}
+
+var streetTypes = map[string]bool{
+	"street": true, "avenue": true, "ave": true, "road": true, "drive": true, "lane": true, "court": true,
+	"place": true, "terrace": true, "boulevard": true, "blvd": true, "way": true, "apt": true, "suite": true,
+	"unit": true, "north": true, "south": true, "east": true, "west": true,
+}
+
+func (found identifiers) add(value string) {
+	if value = strings.TrimSpace(value); len(value) >= 2 {
+		found[value] = true
+	}
+}
+
+func deidentifyNode(key string, node interface{}, found identifiers) interface{} {
+	switch value := node.(type) {
+	case map[string]interface{}:
+		// the narrative (text.div) repeats the resource in free text, names included
+		if _, ok := value["div"]; ok {
+			return nil
+		}
+		reference := isReference(value)
+		result := map[string]interface{}{}
+		for childKey, child := range value {
+			switch {
+			case identifyingElements[childKey]:
+				continue
+			case childKey == "name" && !isString(child):
+				continue
+			case childKey == "display" && reference:
+				continue
+			case childKey == "url" && value["contentType"] != nil:
+				// the location of an attachment
+				continue
+			case childKey == "reference" && isString(child):
+				result[childKey] = deidentifyReference(child.(string))
+				continue
+			}
+			if deidentified := deidentifyNode(childKey, child, found); deidentified != nil {
+				result[childKey] = deidentified
+			}
+		}
+		return result
+	case []interface{}:
+		var result []interface{}
+		for _, child := range value {
+			if deidentified := deidentifyNode(key, child, found); deidentified != nil {
+				result = append(result, deidentified)
+			}
+		}
+		if len(result) == 0 {
+			return nil
+		}
+		return result
+	case string:
+		if structuralElements[key] {
+			return value
+		}
+		return deidentifyText(value, found)
+	default:
+		return value
+	}
+}
+
+// references to people keep their type only. eg. Patient/123 becomes Patient
+func deidentifyReference(reference string) string {
+	for _, personType := range personTypes {
+		if strings.HasPrefix(reference, personType+"/") || strings.Contains(reference, "/"+personType+"/") {
+			return personType
+		}
+	}
+	if strings.HasPrefix(reference, "urn:") {
+		return "urn"
+	}
+	return reference
+}
+
+func deidentifyText(text string, found identifiers) string {
+	// longest first, so that "John Smith" is redacted before "John"
+	values := make([]string, 0, len(found))
+	for value := range found {
+		values = append(values, value)
+	}
+	sort.Slice(values, func(i, j int) bool { return len(values[i]) > len(values[j]) })
+	for _, value := range values {
+		text = redact(text, value)
+	}
+
+	text = dobPattern.ReplaceAllString(text, "$1 [date]")
+	text = emailPattern.ReplaceAllString(text, "[email]")
+	text = urlPattern.ReplaceAllString(text, "[url]")
+	text = ssnPattern.ReplaceAllString(text, "[id]")
+	text = mrnPattern.ReplaceAllString(text, "[id]")
+	text = ipPattern.ReplaceAllString(text, "[ip]")
+	text = phonePattern.ReplaceAllString(text, "[phone]")
+	text = agePattern.ReplaceAllString(text, "90+ $3")
+
+	if deidPolicy() == DEID_SAFE_HARBOR {
+		text = isoDatePattern.ReplaceAllString(text, "$1")
+		text = usDatePattern.ReplaceAllStringFunc(text, func(date string) string {
+			if year := date[strings.LastIndex(date, "/")+1:]; len(year) == 4 {
+				return year
+			}
+			return "[date]"
+		})
+	}
+	return text
+}
+
+// replaces the value with [redacted] wherever it appears as a whole word
+func redact(text string, value string) string {
+	pattern := identifierPattern(value)
+	// a match takes the character around it, so repeat for values that follow each other
+	for pattern.MatchString(text) {
+		text = pattern.ReplaceAllString(text, "${1}[redacted]${2}")
+	}
+	return text
+}
+
+// matches the value as a whole word as written, in upper case or capitalized. eg. Smith, SMITH
+func identifierPattern(value string) *regexp.Regexp {
+	variants := []string{regexp.QuoteMeta(value), regexp.QuoteMeta(strings.ToUpper(value))}
+	if runes := []rune(strings.ToLower(value)); len(runes) > 0 {
+		variants = append(variants, regexp.QuoteMeta(strings.ToUpper(string(runes[0]))+string(runes[1:])))
+	}
+	return regexp.MustCompile(`(^|[^\pL\pN])(?:` + strings.Join(variants, "|") + `)($|[^\pL\pN])`)
+}
+
+// the final guard: none of the identifiers may be left in what is sent to the model
+func checkLeaks(text string, found identifiers) error {
+	for value := range found {
+		if len(value) >= 3 && identifierPattern(value).MatchString(text) {
+			return fmt.Errorf("%w: a %d character value", ErrIdentifierLeak, len(value))
+		}
+	}
+	return nil
+}
+
+func isString(node interface{}) bool {
+	_, ok := node.(string)
+	return ok
+}
+
+// a Reference has a reference, identifier or display but, unlike a Coding, no code
+func isReference(node map[string]interface{}) bool {
+	if _, ok := node["code"]; ok {
+		return false
+	}
+	if _, ok := node["system"]; ok {
+		return false
+	}
+	_, hasReference := node["reference"]
+	_, hasDisplay := node["display"]
+	return hasReference || hasDisplay
+}
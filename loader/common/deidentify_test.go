@@ -0,0 +1,106 @@
+package common
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// a Patient full of identifiers, and the resources of the patient that carry them again in their notes
+const deidPatient = `{"resourceType":"Patient","id":"p1","meta":{"lastUpdated":"2024-01-02T03:04:05Z"},
+	"name":[{"family":"Smithers","given":["Johnathan","Quincy"]}],
+	"telecom":[{"system":"phone","value":"555-867-5309"},{"system":"email","value":"jsmithers@example.com"}],
+	"address":[{"line":["742 Evergreen Terrace"],"city":"Springfield","postalCode":"49007"}],
+	"identifier":[{"system":"urn:oid:1.2.36.146.595.217.0.1","value":"MRN7654321"}],"gender":"male","birthDate":"1931-04-15"}`
+
+// the note names the patient the way notes do, in other letter cases and formats than the Patient
+const deidNote = "JOHNATHAN SMITHERS (MRN7654321), DOB 04/15/1931, lives at 742 Evergreen Terrace in Springfield 49007. " +
+	"Reached at 555.867.5309 or jsmithers@example.com on 2024-03-05 10:30 UTC. Quincy Smithers was seen by Dr. Kiddo."
+
+func TestDeidentification(t *testing.T) {
+	note := base64.StdEncoding.EncodeToString([]byte(deidNote))
+	useTestSource(t, testSource{"Patient/p1": deidPatient})
+
+	resources := []struct {
+		resourceType string
+		id           string
+		json         string
+	}{
+		{"DocumentReference", "d1", `{"resourceType":"DocumentReference","id":"d1","meta":{"lastUpdated":"2024-03-05T11:00:00Z"},
+			"text":{"status":"generated","div":"<div xmlns=\"http://www.w3.org/1999/xhtml\">Note for Johnathan Smithers</div>"},
+			"identifier":[{"value":"DOC-99887766"}],"status":"current","type":{"text":"Progress note"},
+			"subject":{"reference":"Patient/p1","display":"Johnathan Smithers"},
+			"author":[{"reference":"Practitioner/dr1","display":"Dr. Beatrix Kiddo"}],"date":"2024-03-05T10:30:00Z",
+			"description":"Johnathan seen by Dr. Kiddo on 03/05/2024, 93 year old, call (555) 867-5309, SSN 123-45-6789",
+			"content":[{"attachment":{"contentType":"text/plain","url":"https://example.com/notes/jsmithers.txt","data":"` + note + `"}}]}`},
+		{"DiagnosticReport", "r1", `{"resourceType":"DiagnosticReport","id":"r1","meta":{"lastUpdated":"2024-03-05T11:00:00Z"},
+			"status":"final","code":{"text":"Chest X-ray"},"effectiveDateTime":"2024-03-05T10:30:00Z",
+			"subject":{"reference":"Patient/p1","display":"Smithers, Johnathan"},
+			"performer":[{"reference":"Practitioner/dr1","display":"Beatrix Kiddo, MD"}],
+			"conclusion":"No acute findings for Mr. Smithers",
+			"presentedForm":[{"contentType":"text/plain","data":"` + note + `"}]}`},
+		{"Observation", "o1", `{"resourceType":"Observation","id":"o1","meta":{"lastUpdated":"2024-03-05T11:00:00Z"},
+			"status":"final","code":{"text":"Heart rate"},"effectiveDateTime":"2024-03-05T10:30:00Z",
+			"subject":{"reference":"Patient/p1","display":"Johnathan Smithers"},
+			"performer":[{"reference":"Practitioner/dr1","display":"Dr. Beatrix Kiddo"}],
+			"valueQuantity":{"value":72,"unit":"/min"},
+			"note":[{"authorString":"Quincy Smithers","text":"Johnathan Smithers reported palpitations, call back on 555-867-5309"}]}`},
+	}
+
+	// names, MRNs, phone numbers, emails, addresses, ids of people and the other Safe Harbor identifiers
+	leaked := []string{"Johnathan", "Smithers", "Quincy", "Kiddo", "Beatrix", "MRN7654321", "DOC-99887766",
+		"555-867-5309", "555.867.5309", "(555) 867-5309", "jsmithers", "Evergreen", "Springfield", "49007",
+		"123-45-6789", "93 year", "Patient/p1", "Practitioner/dr1", "<div", "example.com", "1931"}
+
+	for _, policy := range []struct {
+		name   string
+		leaked []string
+	}{
+		{DEID_SAFE_HARBOR, append(leaked, "03/05/2024", "2024-03-05", "10:30")},
+		{DEID_LIMITED, leaked},
+	} {
+		for _, resource := range resources {
+			t.Run(policy.name+"/"+resource.resourceType, func(t *testing.T) {
+				defer func(configured string) { DEID_POLICY = configured }(DEID_POLICY)
+				DEID_POLICY = policy.name
+
+				resourceURI := testStore + "/fhir/" + resource.resourceType + "/" + resource.id
+				summary, err := GetResourceSummary(context.Background(), resource.resourceType, resourceURI, "1", resource.json)
+				if err != nil {
+					t.Fatalf("GetResourceSummary: %v", err)
+				}
+				if handler := handlers[resource.resourceType]; handler.Attachments != nil && len(summary.Chunks) == 0 {
+					t.Fatal("the attachment text wasn't extracted")
+				}
+
+				outputs := map[string]string{"PromptInput": summary.PromptInput, "GeneratedContent": summary.GeneratedContent}
+				for i, chunk := range summary.Chunks {
+					outputs[fmt.Sprintf("Chunks[%d]", i)] = chunk
+				}
+				for field, output := range outputs {
+					for _, value := range policy.leaked {
+						if strings.Contains(strings.ToLower(output), strings.ToLower(value)) {
+							t.Errorf("%s has %q: %s", field, value, output)
+						}
+					}
+				}
+			})
+		}
+	}
+}
+
+// nothing is touched when de-identification is off
+func TestDeidentificationOff(t *testing.T) {
+	defer func(configured string) { DEID_POLICY = configured }(DEID_POLICY)
+	DEID_POLICY = DEID_OFF
+
+	deidentified, _, err := DeidentifyJSON(deidPatient, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(deidentified, "Smithers") || !strings.Contains(deidentified, "MRN7654321") {
+		t.Errorf("the identifiers were removed with DEID_POLICY off: %s", deidentified)
+	}
+}
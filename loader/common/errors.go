@@ -0,0 +1,60 @@
+package common
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+)
+
+// an error that retrying won't fix, eg. a resource that isn't valid FHIR or a type without a handler.
+// Errors that aren't marked permanent are taken as transient and the event is delivered again
+type PermanentError struct {
+	Err error
+}
+
+func (e *PermanentError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *PermanentError) Unwrap() error {
+	return e.Err
+}
+
+func Permanent(err error) error {
+	if err == nil {
+		return nil
+	}
+	return &PermanentError{Err: err}
+}
+
+// a FHIR API call that didn't return 200 OK
+type StatusError struct {
+	StatusCode int
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("unexpected status code: %v", e.StatusCode)
+}
+
+// reports whether the error is permanent. A resource that is gone or a request the FHIR API rejects
+// won't get any better on a retry, throttling and server errors will
+func IsPermanent(err error) bool {
+	var permanent *PermanentError
+	if errors.As(err, &permanent) || errors.Is(err, ErrIdentifierLeak) {
+		return true
+	}
+	var status *StatusError
+	if errors.As(err, &status) {
+		switch status.StatusCode {
+		case http.StatusBadRequest, http.StatusNotFound, http.StatusGone, http.StatusUnprocessableEntity:
+			return true
+		}
+	}
+	return false
+}
+
+// reports whether the FHIR API says the resource doesn't exist (anymore)
+func IsGone(err error) bool {
+	var status *StatusError
+	return errors.As(err, &status) && (status.StatusCode == http.StatusNotFound || status.StatusCode == http.StatusGone)
+}
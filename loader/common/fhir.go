@@ -5,17 +5,20 @@ import (
 	"encoding/json"
 	"fmt"
 	"net/http"
-
-	"github.com/google/fhir/go/fhirversion"
-	"github.com/google/fhir/go/jsonformat"
-	r4pb "github.com/google/fhir/go/proto/google/fhir/proto/r4/core/resources/bundle_and_contained_resource_go_proto"
+	"strings"
 
 	"cloud.google.com/go/compute/metadata"
+	"golang.org/x/oauth2/google"
 )
 
 // gets FHIR Resources usign API
 
 func GetFHIRResource(ctx context.Context, resourceType string, resourceURI string) (string, error) {
+	// eg. the local files of the replay command
+	if source := currentFHIRSource(); source != nil {
+		return source.GetResource(ctx, resourceType, resourceURI)
+	}
+
 	// Authenticate with the FHIR server to obtain an access token
 	accessToken, err := GetAccessToken()
 	if err != nil {
@@ -36,6 +39,8 @@ func GetFHIRResource(ctx context.Context, resourceType string, resourceURI strin
 
 	// Set the authorization header with the access token
 	req.Header.Set("Authorization", "Bearer "+accessToken)
+	// Binary resources come back as FHIR JSON rather than the raw content
+	req.Header.Set("Accept", "application/fhir+json")
 
 	// Make the HTTP request
 	resp, err := client.Do(req)
@@ -47,7 +52,7 @@ func GetFHIRResource(ctx context.Context, resourceType string, resourceURI strin
 
 	// Check the status code of the response
 	if resp.StatusCode != http.StatusOK {
-		return "", fmt.Errorf("unexpected status code: %v", resp.StatusCode)
+		return "", &StatusError{StatusCode: resp.StatusCode}
 	}
 
 	var fhirData map[string]interface{}
@@ -67,6 +72,12 @@ func GetFHIRResource(ctx context.Context, resourceType string, resourceURI strin
 	return fhirString, nil
 }
 
+// the resource id is the last part of the resource URI. eg. projects/X/.../fhir/Observation/{id}
+func ResourceIdFromURI(resourceURI string) string {
+	parts := strings.Split(resourceURI, "/")
+	return parts[len(parts)-1]
+}
+
 // Struct to represent the JSON response
 type TokenResponse struct {
 	AccessToken string `json:"access_token"`
@@ -91,116 +102,239 @@ func GetAccessToken() (string, error) {
 		return tokenResp.AccessToken, nil
 	}
 
-	// If not running on Google Cloud, return an error
-	return "", fmt.Errorf("not running on Google Cloud Platform")
+	// outside of Google Cloud (eg. the backfill command) use the Application Default Credentials
+	tokenSource, err := google.DefaultTokenSource(context.Background(), "https://www.googleapis.com/auth/cloud-platform")
+	if err != nil {
+		return "", fmt.Errorf("not running on Google Cloud Platform and no default credentials: %v", err)
+	}
+	token, err := tokenSource.Token()
+	if err != nil {
+		return "", fmt.Errorf("failed to obtain access token: %v", err)
+	}
+	return token.AccessToken, nil
 }
 
+// where the summary of a resource comes from
+const (
+	MODEL_SUMMARY     = "model"     // generated with the SUMMARY_LLM_PROVIDER model when the row is saved
+	LOCAL_SUMMARY     = "local"     // built in the loader. GeneratedContent is saved as is
+	NARRATIVE_SUMMARY = "narrative" // rendered from the resource by the handler's Narrative. GeneratedContent is saved as is
+)
+
 type FHIRResourceSumamry struct {
 	ResourceId       string
 	PatientId        string
+	OrganizationId   string // the managing organization of the patient, the tenant of the rows
+	FHIRStore        string // the store the resource comes from, projects/X/locations/X/datasets/X/fhirStores/X
 	ResourceType     string
-	Timestamp        int64
-	GeneratedContent string
+	Timestamp        int64        // the clinical time, or meta.lastUpdated when there is none (epoch microseconds)
+	ClinicalTime     ClinicalTime // zero when the resource has no clinical time
+	Metadata         ClinicalMetadata
+	VersionId        string
+	LastUpdated      int64
+	GeneratedContent string // the summary unless SummarySource is model, then the fallback narrative
+	SummarySource    string
+	Model            string // the provider and model that wrote a model summary, eg. alloydb/text-bison
+	PromptVersion    string // the prompt template of a model summary as {version}/{name}, eg. v2/summary.Condition
 	OriginalFHIRJSON string
+	PromptInput      string   // what the model gets to summarize. The de-identified FHIR JSON with the attachment text if any
+	Chunks           []string // text of the attachments in chunks, each stored in a row of its own
+	ContentHash      string   // ContentHash of the FHIR JSON and the other inputs of the summary
+	SecurityLabels   []string // the meta.security codes of the resource
+	RestrictedLabels []string // the segmented ones, rag() only returns the rows to requesters cleared for all of them
+	Force            bool     // regenerate the summary even when the same version or content is stored
+	Unchanged        bool     // set by SaveSumamry when the stored summary was kept for the same content
 }
 
-// Generate content for the FHIR resource and build,return the FHIRResourceSumamry struct
-func GetResourceSummary(ctx context.Context, resourceType, resourceId string, fhirJSONString string) (*FHIRResourceSumamry, error) {
-	const (
-		timeZone = "America/Chicago"
-	)
-	um, err := jsonformat.NewUnmarshaller(timeZone, fhirversion.R4)
+// Generate content for the FHIR resource and build,return the FHIRResourceSumamry struct.
+// versionId is only used when the resource has no meta.versionId
+func GetResourceSummary(ctx context.Context, resourceType, resourceURI, versionId string, fhirJSONString string) (*FHIRResourceSumamry, error) {
+	// in the FHIR version and time zone of its store, see FHIR_STORES
+	contained, err := UnmarshalResource(fhirJSONString, resourceURI)
 	if err != nil {
-		return nil, fmt.Errorf("Failed to create FHIR unmarshaller: %v", err)
+		return nil, err
 	}
-	fmt.Println("Created New FHIR R4 Unmarshaller")
-	unmarshalled, err := um.Unmarshal([]byte(fhirJSONString))
-	if err != nil {
-		return nil, fmt.Errorf("Failed to unmarshall FHIR JSON: %v", err)
-	}
-	fmt.Println("nmarshalled FHIR JSON")
-	contained := unmarshalled.(*r4pb.ContainedResource)
-
-	var patientId string
-	var timestamp int64
-	switch resourceType {
-	case "Condition":
-		condition := contained.GetCondition()
-		patientId = condition.GetSubject().GetPatientId().GetValue()
-		timestamp = condition.GetMeta().GetLastUpdated().GetValueUs()
-	case "Observation":
-		observation := contained.GetObservation()
-		patientId = observation.GetSubject().GetPatientId().GetValue()
-		timestamp = observation.GetMeta().GetLastUpdated().GetValueUs()
-	case "MedicationRequest":
-		medicationRequest := contained.GetMedicationRequest()
-		patientId = medicationRequest.GetSubject().GetPatientId().GetValue()
-		timestamp = medicationRequest.GetMeta().GetLastUpdated().GetValueUs()
-	case "Encounter":
-		encounter := contained.GetEncounter()
-		patientId = encounter.GetSubject().GetPatientId().GetValue()
-		timestamp = encounter.GetMeta().GetLastUpdated().GetValueUs()
-	case "CarePlan":
-		carePlan := contained.GetCarePlan()
-		patientId = carePlan.GetSubject().GetPatientId().GetValue()
-		timestamp = carePlan.GetMeta().GetLastUpdated().GetValueUs()
-	case "AllergyIntolerance":
-		allergyIntolerance := contained.GetAllergyIntolerance()
-		patientId = allergyIntolerance.GetPatient().GetPatientId().GetValue()
-		timestamp = allergyIntolerance.GetMeta().GetLastUpdated().GetValueUs()
-	case "Procedure":
-		procedure := contained.GetProcedure()
-		patientId = procedure.GetSubject().GetPatientId().GetValue()
-		timestamp = procedure.GetMeta().GetLastUpdated().GetValueUs()
-	case "Immunization":
-		immunization := contained.GetImmunization()
-		patientId = immunization.GetPatient().GetPatientId().GetValue()
-		timestamp = immunization.GetMeta().GetLastUpdated().GetValueUs()
-	case "ServiceRequest":
-		serviceRequest := contained.GetServiceRequest()
-		patientId = serviceRequest.GetSubject().GetPatientId().GetValue()
-		timestamp = serviceRequest.GetMeta().GetLastUpdated().GetValueUs()
-
-	// Add cases for other resource types as needed
-	default:
+	fmt.Println("Unmarshalled FHIR JSON")
+
+	handler, ok := GetHandler(resourceType)
+	if !ok {
 		fmt.Println("Unhandled resource type:", resourceType)
-		return nil, fmt.Errorf("Unhandled resource type: %v", resourceType)
+		return nil, Permanent(fmt.Errorf("Unhandled resource type: %v", resourceType))
+	}
+	if !handler.Include(contained) {
+		return nil, ErrResourceExcluded
+	}
+
+	// the patient whose compartment the resource is in. A resource in none of them (eg. an Observation
+	// of a Group) is indexed without one, in the non-patient table
+	patientId, err := ResolvePatientId(ctx, contained, resourceURI)
+	if err != nil {
+		return nil, err
+	}
+	if patientId == "" {
+		fmt.Println("Resource is not in a patient compartment:", resourceType, resourceURI)
+	}
+	// the tenant of the rows, see tenant.go
+	organizationId, err := PatientOrganizationId(ctx, contained, resourceURI, patientId)
+	if err != nil {
+		return nil, err
+	}
+	// used to order versions of the resource when pubsub delivers them out of order
+	lastUpdated := metaLastUpdated(contained)
+	// the current version is fetched, which is newer than the version of the event when events come
+	// out of order. The summary is stamped with the version it's generated from
+	if fetched := metaVersionId(contained); fetched != "" {
+		if versionId != "" && fetched != versionId {
+			fmt.Println("Fetched version", fetched, "of", resourceType, "for the event of version", versionId)
+		}
+		versionId = fetched
+	}
+
+	// the row is stamped with when it happened, or when it was last updated when we don't know that
+	var clinical ClinicalTime
+	if handler.ClinicalTime != nil {
+		clinical = handler.ClinicalTime(contained)
+	}
+	timestamp := clinical.ValueUs
+	if timestamp == 0 {
+		timestamp = lastUpdated
+	}
+
+	// codes, category, statuses and encounter for filtering in retrieval
+	var metadata ClinicalMetadata
+	if handler.Metadata != nil {
+		metadata = handler.Metadata(contained)
+	}
+
+	// meta.security labels exclude the resource or restrict who retrieves it, see SECURITY_LABEL_POLICY,
+	// and a Consent of the patient may deny indexing it
+	labels, err := securityLabelsOf(contained)
+	if err != nil {
+		return nil, Permanent(err)
+	}
+	if len(labels.Excluded) > 0 {
+		fmt.Println("Resource is excluded by its security labels:", resourceType, resourceURI, labels.Excluded)
+		return nil, ErrResourceExcluded
+	}
+	denied, err := consentDenies(ctx, resourceURI, patientId, consentSubject{resourceType: resourceType,
+		id: ResourceIdFromURI(resourceURI), codings: metadata.Codings, labels: labels.Labels})
+	if err != nil {
+		return nil, err
+	}
+	if denied {
+		return nil, ErrResourceExcluded
+	}
+
+	// the text of the attachments is extracted and chunked for retrieval
+	var text string
+	if handler.Attachments != nil {
+		text, err = ExtractAttachmentsText(ctx, handler.Attachments(contained), resourceURI)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// nothing that identifies a person goes to the model. Notes often name the patient, so the
+	// patient's identifiers are redacted from the attachment text as well
+	known := identifiers{}
+	if text != "" {
+		known, err = patientIdentifiers(ctx, resourceURI, patientId)
+		if err != nil {
+			return nil, err
+		}
+	}
+	// the base64 data of attachments is of no use to the model and would carry the note as is
+	promptInput, err := withoutAttachmentData(fhirJSONString)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to remove attachment data: %v", err)
+	}
+	promptInput, found, err := DeidentifyJSON(promptInput, known)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to de-identify the FHIR JSON: %w", err)
+	}
+
+	// facts from the resources it references, eg. the drug and strength of the Medication of a MedicationRequest
+	var related []string
+	if handler.Summarize == nil {
+		for _, facts := range ResolveReferences(ctx, fhirJSONString, resourceURI) {
+			facts, err = DeidentifyText(facts, found)
+			if err != nil {
+				return nil, fmt.Errorf("Failed to de-identify the referenced resources: %w", err)
+			}
+			related = append(related, facts)
+		}
+	}
+	if len(related) > 0 {
+		promptInput += "\nReferenced resources:\n" + strings.Join(related, "\n")
 	}
 
-	//!!## This is causing an issue with quotas on Gemini API cals.
-	//     and it now done in AlloyDB SQL Insert using built in AI functions
-	// fmt.Println("Generating the Contnet")
-	// generatedConent, err := GenerateContent(ctx, GetContentGenPrompt(fhirJSONString))
-	// if err != nil {
-	// 	return nil, fmt.Errorf("Failed to Generate Content: %v", err)
-	// }
-	// fmt.Println("Generated the Contnet")
+	// the note text goes to the model along with the JSON and is stored in chunks
+	var chunks []string
+	if text != "" {
+		text, err = DeidentifyText(text, found)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to de-identify the attachment text: %w", err)
+		}
+		chunks = ChunkText(text)
+		promptText := text
+		if len(promptText) > MAX_PROMPT_TEXT {
+			promptText = strings.ToValidUTF8(promptText[:MAX_PROMPT_TEXT], "")
+		}
+		promptInput += "\nText of the attachment:\n" + promptText
+	}
 
-	generatedConent := "This is a generated content for the FHIR resource" //dummy content
+	// the narrative is the summary when it's the selected source, otherwise it's kept as the fallback
+	// for when the model fails. Either way it ends up in the RAG prompt
+	var generatedConent string
+	summarySource := MODEL_SUMMARY
+	if handler.Narrative != nil {
+		generatedConent, err = DeidentifyText(handler.Narrative(contained), found)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to de-identify the narrative: %w", err)
+		}
+		if len(related) > 0 {
+			generatedConent += " " + strings.Join(related, " ")
+		}
+		if SUMMARY_SOURCE == NARRATIVE_SUMMARY {
+			summarySource = NARRATIVE_SUMMARY
+		}
+	}
+	if handler.Summarize != nil {
+		generatedConent, err = handler.Summarize(ctx, contained, resourceURI)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to Summarize the %s: %v", resourceType, err)
+		}
+		summarySource = LOCAL_SUMMARY
+	}
+
+	// the JSON alone doesn't cover what the summary and chunks are made of: the prompt input has the facts of the
+	// referenced resources and the attachment text, which change without a new version of the resource, and the
+	// chunks are made of the whole text. The JSON is still hashed for the columns taken from it, eg. the clinical
+	// time, which the de-identified prompt input may only have the year of
+	contentHash, err := ContentHash(fhirJSONString, promptInput, text, generatedConent)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to hash the FHIR JSON: %w", err)
+	}
 
 	fhirResourceSummary := FHIRResourceSumamry{
-		ResourceId:       resourceId,
+		ResourceId:       ResourceIdFromURI(resourceURI),
 		ResourceType:     resourceType,
 		PatientId:        patientId,
+		OrganizationId:   organizationId,
+		FHIRStore:        fhirStoreOf(resourceURI),
 		Timestamp:        timestamp,
+		ClinicalTime:     clinical,
+		Metadata:         metadata,
+		VersionId:        versionId,
+		LastUpdated:      lastUpdated,
 		GeneratedContent: generatedConent,
+		SummarySource:    summarySource,
 		OriginalFHIRJSON: fhirJSONString,
+		PromptInput:      promptInput,
+		Chunks:           chunks,
+		ContentHash:      contentHash,
+		SecurityLabels:   labels.Labels,
+		RestrictedLabels: labels.Restricted,
 	}
 	return &fhirResourceSummary, nil
 }
-
-func GetContentGenPrompt(fhirJSONString string) string {
-	return "You are a clinician and also an expert on Healthcare data especially FHIR JSON. \n" +
-		"And you are also very sensitive about patient privacy and protecting PII like their names \n" +
-		"emails, phone numbers, addresses and date of birth. \n" +
-		"I would like you to summarize the below FHIR JSON into a short paragraph that includes the following info:\n" +
-		"- convert the timestamp to a string that shows how many years/months/days/hours ago is the data \n" +
-		"- Any other relationships to other resources based on the references if there are and a \n" +
-		"- A clinical narrative of what the resource data is all about\n" +
-		"Include data values and units. \n" +
-		"Do not include any Personally Identifiable Information like names, emails,phone , addresses and date of birth \n" +
-		"Make the final conent to be a paragraph of text so I can use that for \n" +
-		"generating Emebeddings out of it\n" +
-		"here is the JOSN:\n" + fhirJSONString + "\n" +
-		"important:  Do not include any names of patient's and practitioners in the final content"
-}
@@ -0,0 +1,560 @@
+package common
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	dtpb "github.com/google/fhir/go/proto/google/fhir/proto/r4/core/datatypes_go_proto"
+	r4pb "github.com/google/fhir/go/proto/google/fhir/proto/r4/core/resources/bundle_and_contained_resource_go_proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+)
+
+// the handlers extract everything from R4 resources, whatever the version of the FHIR store. A resource of
+// another version is converted to R4 JSON before it's parsed: the elements the handlers read that were renamed
+// or restructured are moved to their R4 place (eg. R5 Encounter.actualPeriod to period, STU3 Condition.context
+// to encounter), and what R4 doesn't have is dropped. The stored FHIR JSON and the prompt keep the original version
+
+// a JSON object of a resource or one of its elements
+type jsonObject = map[string]interface{}
+
+// the conversion of a resource of a version to R4, by resource type
+type r4Converter func(resource jsonObject)
+
+// converters by version. A resource type without one only loses what R4 doesn't have
+var r4Converters = map[string]map[string]r4Converter{
+	FHIR_STU3: stu3Converters,
+	FHIR_R4B:  {}, // the resources the handlers read are the same as in R4
+	FHIR_R5:   r5Converters,
+}
+
+// converts a resource of the FHIR version to R4 JSON. R4 resources are returned as they are
+func ConvertToR4(fhirJSONString string, version string) (string, error) {
+	if version == FHIR_R4 {
+		return fhirJSONString, nil
+	}
+	converters, ok := r4Converters[version]
+	if !ok {
+		return "", fmt.Errorf("Unsupported FHIR version: %s", version)
+	}
+
+	// numbers are kept as they are written, eg. decimals with trailing zeros
+	decoder := json.NewDecoder(strings.NewReader(fhirJSONString))
+	decoder.UseNumber()
+	var resource jsonObject
+	if err := decoder.Decode(&resource); err != nil {
+		return "", err
+	}
+
+	convertResource(resource, converters)
+	if !pruneResource(resource) {
+		return "", fmt.Errorf("%v is not an R4 resource", resource["resourceType"])
+	}
+	converted, err := json.Marshal(resource)
+	if err != nil {
+		return "", err
+	}
+	return string(converted), nil
+}
+
+func convertResource(resource jsonObject, converters map[string]r4Converter) {
+	if convert, ok := converters[stringOf(resource["resourceType"])]; ok {
+		convert(resource)
+	}
+	for _, contained := range objectsOf(resource["contained"]) {
+		convertResource(contained, converters)
+	}
+}
+
+var (
+	containedResourceDescriptor = (&r4pb.ContainedResource{}).ProtoReflect().Descriptor()
+	codeableConceptDescriptor   = (&dtpb.CodeableConcept{}).ProtoReflect().Descriptor()
+	referenceDescriptor         = (&dtpb.Reference{}).ProtoReflect().Descriptor()
+)
+
+// drops what the R4 resource doesn't have. Returns false when R4 has no such resource type
+func pruneResource(resource jsonObject) bool {
+	resourceType := stringOf(resource["resourceType"])
+	fields := containedResourceDescriptor.Oneofs().ByName("oneof_resource").Fields()
+	for i := 0; i < fields.Len(); i++ {
+		if md := fields.Get(i).Message(); string(md.Name()) == resourceType {
+			prune(resource, md)
+			return true
+		}
+	}
+	return false
+}
+
+// drops the elements of the object that the R4 message doesn't have, or that don't fit it. A single
+// value where R4 has a list becomes a list, and of a list where R4 has a single value the first is kept
+func prune(object jsonObject, md protoreflect.MessageDescriptor) {
+	for key, value := range object {
+		if key == "resourceType" {
+			continue
+		}
+		field, choice := fieldOf(md, strings.TrimPrefix(key, "_"))
+		if field == nil {
+			delete(object, key)
+			continue
+		}
+		// the extensions of a primitive (eg. _birthDate) are kept as they are
+		if strings.HasPrefix(key, "_") || field.Kind() != protoreflect.MessageKind {
+			continue
+		}
+		element := field.Message()
+		if choice != nil {
+			element = choice.Message()
+		}
+
+		var values []interface{}
+		if list, ok := value.([]interface{}); ok {
+			values = list
+		} else {
+			values = []interface{}{value}
+		}
+		if !field.IsList() && len(values) > 1 {
+			values = values[:1]
+		}
+		var kept []interface{}
+		for _, value := range values {
+			// contained resources are ContainedResources in an Any
+			if element.FullName() == containedResourceDescriptor.FullName() || element.FullName() == "google.protobuf.Any" {
+				if resource, ok := value.(jsonObject); ok && pruneResource(resource) {
+					kept = append(kept, resource)
+				}
+			} else if value = pruneElement(value, element); value != nil {
+				kept = append(kept, value)
+			}
+		}
+
+		switch {
+		case len(kept) == 0:
+			delete(object, key)
+		case field.IsList():
+			object[key] = kept
+		default:
+			object[key] = kept[0]
+		}
+	}
+}
+
+// the value as the R4 element, nil when it doesn't fit
+func pruneElement(value interface{}, md protoreflect.MessageDescriptor) interface{} {
+	object, isObject := value.(jsonObject)
+	if isPrimitive(md) {
+		// eg. an R5 CodeableConcept where R4 has a code
+		if isObject || value == nil {
+			return nil
+		}
+		return value
+	}
+	if !isObject {
+		return nil
+	}
+
+	// an R5 CodeableReference where R4 has a CodeableConcept or a Reference
+	switch md.FullName() {
+	case codeableConceptDescriptor.FullName():
+		if concept, ok := object["concept"].(jsonObject); ok {
+			object = concept
+		}
+	case referenceDescriptor.FullName():
+		if reference, ok := object["reference"].(jsonObject); ok {
+			object = reference
+		}
+	}
+	prune(object, md)
+	if len(object) == 0 {
+		return nil
+	}
+	return object
+}
+
+// the field of a JSON key, and for a choice (eg. valueQuantity of value) the field of its type
+func fieldOf(md protoreflect.MessageDescriptor, key string) (protoreflect.FieldDescriptor, protoreflect.FieldDescriptor) {
+	if field := md.Fields().ByJSONName(key); field != nil {
+		// a choice only appears with its type
+		if isChoice(field) {
+			return nil, nil
+		}
+		return field, nil
+	}
+	fields := md.Fields()
+	for i := 0; i < fields.Len(); i++ {
+		field := fields.Get(i)
+		if !isChoice(field) || !strings.HasPrefix(key, field.JSONName()) {
+			continue
+		}
+		choices := field.Message().Oneofs().ByName("choice").Fields()
+		for j := 0; j < choices.Len(); j++ {
+			choice := choices.Get(j)
+			name := choice.JSONName()
+			if key == field.JSONName()+strings.ToUpper(name[:1])+name[1:] {
+				return field, choice
+			}
+		}
+	}
+	return nil, nil
+}
+
+func isChoice(field protoreflect.FieldDescriptor) bool {
+	return field.Kind() == protoreflect.MessageKind && field.Message().Oneofs().ByName("choice") != nil
+}
+
+// primitives and codes are JSON values rather than objects. Dates and times are stored as value_us
+func isPrimitive(md protoreflect.MessageDescriptor) bool {
+	for _, name := range []protoreflect.Name{"value", "value_us"} {
+		if value := md.Fields().ByName(name); value != nil && value.Kind() != protoreflect.MessageKind {
+			return true
+		}
+	}
+	return false
+}
+
+// STU3 to R4
+var stu3Converters = map[string]r4Converter{
+	"AllergyIntolerance": func(r jsonObject) {
+		codeToConcept(r, "clinicalStatus", "http://terminology.hl7.org/CodeSystem/allergyintolerance-clinical")
+		codeToConcept(r, "verificationStatus", "http://terminology.hl7.org/CodeSystem/allergyintolerance-verification")
+		rename(r, "assertedDate", "recordedDate")
+	},
+	"CarePlan": func(r jsonObject) {
+		rename(r, "context", "encounter")
+		mapCode(r, "status", map[string]string{"suspended": "on-hold", "cancelled": "revoked"})
+	},
+	"Condition": func(r jsonObject) {
+		codeToConcept(r, "clinicalStatus", "http://terminology.hl7.org/CodeSystem/condition-clinical")
+		if r["verificationStatus"] == "unknown" {
+			delete(r, "verificationStatus")
+		}
+		codeToConcept(r, "verificationStatus", "http://terminology.hl7.org/CodeSystem/condition-ver-status")
+		rename(r, "context", "encounter")
+		rename(r, "assertedDate", "recordedDate")
+	},
+	"DiagnosticReport": func(r jsonObject) {
+		rename(r, "context", "encounter")
+		rename(r, "codedDiagnosis", "conclusionCode")
+		rename(r, "image", "media")
+		// performer was {role, actor}
+		var performers []interface{}
+		for _, performer := range objectsOf(r["performer"]) {
+			if actor, ok := performer["actor"]; ok {
+				performers = append(performers, actor)
+			}
+		}
+		set(r, "performer", performers)
+	},
+	"DocumentReference": func(r jsonObject) {
+		rename(r, "indexed", "date")
+		rename(r, "class", "category")
+	},
+	"Encounter": func(r jsonObject) {
+		rename(r, "reason", "reasonCode")
+	},
+	"Goal": func(r jsonObject) {
+		// the achievement states of status became active in lifecycleStatus
+		mapCode(r, "status", map[string]string{"in-progress": "active", "on-target": "active", "ahead-of-target": "active",
+			"behind-target": "active", "sustaining": "active", "achieved": "completed"})
+		rename(r, "status", "lifecycleStatus")
+	},
+	"Immunization": func(r jsonObject) {
+		rename(r, "date", "occurrenceDateTime")
+		if r["notGiven"] == true {
+			r["status"] = "not-done"
+		}
+		if explanation, ok := r["explanation"].(jsonObject); ok {
+			set(r, "reasonCode", explanation["reason"])
+			set(r, "statusReason", explanation["reasonNotGiven"])
+		}
+		// practitioner was {role, actor}
+		var performers []interface{}
+		for _, practitioner := range objectsOf(r["practitioner"]) {
+			performers = append(performers, jsonObject{"function": practitioner["role"], "actor": practitioner["actor"]})
+		}
+		set(r, "performer", performers)
+	},
+	"Medication": func(r jsonObject) {
+		for _, ingredient := range objectsOf(r["ingredient"]) {
+			rename(ingredient, "amount", "strength")
+		}
+	},
+	"MedicationRequest": func(r jsonObject) {
+		rename(r, "context", "encounter")
+		// requester was {agent, onBehalfOf}
+		if requester, ok := r["requester"].(jsonObject); ok {
+			set(r, "requester", requester["agent"])
+		}
+	},
+	"MedicationStatement": func(r jsonObject) {
+		if r["taken"] == "n" {
+			r["status"] = "not-taken"
+		}
+	},
+	"Observation": func(r jsonObject) {
+		rename(r, "context", "encounter")
+		if comment, ok := r["comment"]; ok {
+			r["note"] = []interface{}{jsonObject{"text": comment}}
+		}
+	},
+	"Procedure": func(r jsonObject) {
+		rename(r, "context", "encounter")
+		mapCode(r, "status", map[string]string{"suspended": "on-hold", "aborted": "stopped"})
+		if r["notDone"] == true {
+			r["status"] = "not-done"
+		}
+		rename(r, "notDoneReason", "statusReason")
+	},
+}
+
+// R5 to R4
+var r5Converters = map[string]r4Converter{
+	"AllergyIntolerance": func(r jsonObject) {
+		// type became a CodeableConcept
+		if concept, ok := r["type"].(jsonObject); ok {
+			set(r, "type", conceptCode(concept))
+		}
+	},
+	"CarePlan": func(r jsonObject) {
+		for _, activity := range objectsOf(r["activity"]) {
+			rename(activity, "plannedActivityReference", "reference")
+		}
+	},
+	"Condition": func(r jsonObject) {
+		// evidence became CodeableReferences
+		concepts, references := splitCodeableReferences(r["evidence"])
+		var evidence []interface{}
+		for _, concept := range concepts {
+			evidence = append(evidence, jsonObject{"code": []interface{}{concept}})
+		}
+		for _, reference := range references {
+			evidence = append(evidence, jsonObject{"detail": []interface{}{reference}})
+		}
+		set(r, "evidence", evidence)
+	},
+	"DocumentReference": func(r jsonObject) {
+		// context became the references of the encounters, its other elements moved up
+		context := jsonObject{}
+		set(context, "encounter", r["context"])
+		for _, key := range []string{"period", "facilityType", "practiceSetting"} {
+			set(context, key, r[key])
+			delete(r, key)
+		}
+		concepts, _ := splitCodeableReferences(r["event"])
+		set(context, "event", concepts)
+		delete(r, "event")
+		set(r, "context", context)
+		for _, relatesTo := range objectsOf(r["relatesTo"]) {
+			if concept, ok := relatesTo["code"].(jsonObject); ok {
+				set(relatesTo, "code", conceptCode(concept))
+			}
+		}
+	},
+	"Encounter": func(r jsonObject) {
+		// class became a list of CodeableConcepts
+		for _, class := range objectsOf(r["class"]) {
+			if codings := objectsOf(class["coding"]); len(codings) > 0 {
+				r["class"] = codings[0]
+				break
+			}
+		}
+		rename(r, "actualPeriod", "period")
+		rename(r, "admission", "hospitalization")
+		mapCode(r, "status", map[string]string{"on-hold": "onleave", "discharged": "finished", "completed": "finished",
+			"discontinued": "finished"})
+		for _, participant := range objectsOf(r["participant"]) {
+			rename(participant, "actor", "individual")
+		}
+		// reason became a list of {use, value} with the CodeableReferences in value
+		var reasons []interface{}
+		for _, reason := range objectsOf(r["reason"]) {
+			if values, ok := reason["value"].([]interface{}); ok {
+				reasons = append(reasons, values...)
+			}
+		}
+		r["reason"] = reasons
+		splitReason(r)
+	},
+	"Goal": func(r jsonObject) {
+		concepts, references := splitCodeableReferences(r["outcome"])
+		set(r, "outcomeCode", concepts)
+		set(r, "outcomeReference", references)
+		delete(r, "outcome")
+	},
+	"Immunization": func(r jsonObject) {
+		splitReason(r)
+		for _, protocol := range objectsOf(r["protocolApplied"]) {
+			rename(protocol, "doseNumber", "doseNumberString")
+			rename(protocol, "seriesDoses", "seriesDosesString")
+		}
+	},
+	"Medication": func(r jsonObject) {
+		rename(r, "doseForm", "form")
+		rename(r, "marketingAuthorizationHolder", "manufacturer")
+		for _, ingredient := range objectsOf(r["ingredient"]) {
+			splitCodeableReference(ingredient, "item")
+			rename(ingredient, "strengthRatio", "strength")
+		}
+	},
+	"MedicationRequest": func(r jsonObject) {
+		splitCodeableReference(r, "medication")
+		splitReason(r)
+		mapCode(r, "status", map[string]string{"ended": "completed"})
+		rename(r, "reported", "reportedBoolean")
+	},
+	"MedicationStatement": func(r jsonObject) {
+		splitCodeableReference(r, "medication")
+		splitReason(r)
+		rename(r, "encounter", "context")
+		// status became the status of the record, whether it's taken is its adherence
+		if r["status"] != "entered-in-error" {
+			status := "unknown"
+			if adherence, ok := r["adherence"].(jsonObject); ok {
+				code, _ := adherence["code"].(jsonObject)
+				switch adherenceCode := conceptCode(code); {
+				case strings.HasPrefix(adherenceCode, "taking"):
+					status = "active"
+				case adherenceCode == "not-taking":
+					status = "not-taken"
+				case strings.HasPrefix(adherenceCode, "on-hold"):
+					status = "on-hold"
+				case strings.HasPrefix(adherenceCode, "stopped"):
+					status = "stopped"
+				}
+			}
+			r["status"] = status
+		}
+	},
+	"Practitioner": func(r jsonObject) {
+		// communication became {language, preferred}
+		var languages []interface{}
+		for _, communication := range objectsOf(r["communication"]) {
+			if language, ok := communication["language"]; ok {
+				languages = append(languages, language)
+			}
+		}
+		set(r, "communication", languages)
+	},
+	"Procedure": func(r jsonObject) {
+		for key := range r {
+			if strings.HasPrefix(key, "occurrence") {
+				rename(r, key, "performed"+strings.TrimPrefix(key, "occurrence"))
+			}
+		}
+		splitReason(r)
+	},
+	"ServiceRequest": func(r jsonObject) {
+		splitReason(r)
+	},
+}
+
+// moves from to to, unless to is set already, along with the extensions of a primitive (_from)
+func rename(object jsonObject, from string, to string) {
+	for _, prefix := range []string{"", "_"} {
+		if value, ok := object[prefix+from]; ok {
+			if _, set := object[prefix+to]; !set {
+				object[prefix+to] = value
+			}
+			delete(object, prefix+from)
+		}
+	}
+}
+
+// sets the key to the value, or removes it when the value is empty
+func set(object jsonObject, key string, value interface{}) {
+	switch v := value.(type) {
+	case nil:
+		delete(object, key)
+	case []interface{}:
+		if len(v) == 0 {
+			delete(object, key)
+			return
+		}
+		object[key] = v
+	case jsonObject:
+		if len(v) == 0 {
+			delete(object, key)
+			return
+		}
+		object[key] = v
+	default:
+		object[key] = v
+	}
+}
+
+// a code of the system that became a CodeableConcept
+func codeToConcept(object jsonObject, key string, system string) {
+	if code, ok := object[key].(string); ok {
+		object[key] = jsonObject{"coding": []interface{}{jsonObject{"system": system, "code": code}}}
+	}
+}
+
+func mapCode(object jsonObject, key string, codes map[string]string) {
+	if code, ok := codes[stringOf(object[key])]; ok {
+		object[key] = code
+	}
+}
+
+// the code of the first coding of a CodeableConcept in JSON
+func conceptCode(concept jsonObject) string {
+	for _, coding := range objectsOf(concept["coding"]) {
+		if code := stringOf(coding["code"]); code != "" {
+			return code
+		}
+	}
+	return ""
+}
+
+// the concepts and the references of a list of R5 CodeableReferences
+func splitCodeableReferences(value interface{}) ([]interface{}, []interface{}) {
+	var concepts, references []interface{}
+	for _, codeableReference := range objectsOf(value) {
+		if concept, ok := codeableReference["concept"]; ok {
+			concepts = append(concepts, concept)
+		}
+		if reference, ok := codeableReference["reference"]; ok {
+			references = append(references, reference)
+		}
+	}
+	return concepts, references
+}
+
+// an R5 CodeableReference that was the choice of a CodeableConcept and a Reference in R4, eg. medication
+func splitCodeableReference(object jsonObject, key string) {
+	concepts, references := splitCodeableReferences(object[key])
+	if len(concepts) > 0 {
+		object[key+"CodeableConcept"] = concepts[0]
+	} else if len(references) > 0 {
+		object[key+"Reference"] = references[0]
+	}
+	delete(object, key)
+}
+
+// the R5 reason CodeableReferences to reasonCode and reasonReference
+func splitReason(object jsonObject) {
+	concepts, references := splitCodeableReferences(object["reason"])
+	set(object, "reasonCode", concepts)
+	set(object, "reasonReference", references)
+	delete(object, "reason")
+}
+
+// the JSON objects of a value that is an object or a list of them
+func objectsOf(value interface{}) []jsonObject {
+	switch v := value.(type) {
+	case jsonObject:
+		return []jsonObject{v}
+	case []interface{}:
+		var objects []jsonObject
+		for _, item := range v {
+			if object, ok := item.(jsonObject); ok {
+				objects = append(objects, object)
+			}
+		}
+		return objects
+	}
+	return nil
+}
+
+func stringOf(value interface{}) string {
+	s, _ := value.(string)
+	return s
+}
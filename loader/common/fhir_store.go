@@ -0,0 +1,133 @@
+package common
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"time"
+	// the FHIR store time zones are loaded from the binary, the Cloud Functions image may not have them
+	_ "time/tzdata"
+
+	"github.com/google/fhir/go/fhirversion"
+	"github.com/google/fhir/go/jsonformat"
+	r4pb "github.com/google/fhir/go/proto/google/fhir/proto/r4/core/resources/bundle_and_contained_resource_go_proto"
+)
+
+// the FHIR version of the stores and the time zone their dates without one are in, eg. a 2015-02-07 onset.
+// FHIR_STORES sets them per store as {store}:{version}:{timeZone} separated with ;, eg.
+// projects/X/locations/X/datasets/X/fhirStores/X:R5:Europe/Berlin. An empty part is the default
+var (
+	FHIR_VERSION   = os.Getenv("FHIR_VERSION")   // STU3, R4 (default), R4B or R5
+	FHIR_TIME_ZONE = os.Getenv("FHIR_TIME_ZONE") // an IANA time zone, defaults to America/Chicago
+	FHIR_STORES    = os.Getenv("FHIR_STORES")
+)
+
+// FHIR versions. The handlers read R4, resources of the other versions are converted to it. See ConvertToR4
+const (
+	FHIR_STU3 = "STU3"
+	FHIR_R4   = "R4"
+	FHIR_R4B  = "R4B"
+	FHIR_R5   = "R5"
+
+	DEFAULT_TIME_ZONE = "America/Chicago"
+)
+
+// the FHIR version and time zone of a FHIR store
+type FHIRStoreConfig struct {
+	Version  string
+	TimeZone string
+}
+
+// the configuration of the store the resource is in, FHIR_VERSION and FHIR_TIME_ZONE unless FHIR_STORES sets it
+func StoreConfig(resourceURI string) (FHIRStoreConfig, error) {
+	defaults, stores, err := storeConfigs()
+	if err != nil {
+		return FHIRStoreConfig{}, err
+	}
+	config, matched := defaults, ""
+	for store, storeConfig := range stores {
+		// the store of a resource URI is followed by /fhir/{type}/{id}
+		if strings.HasPrefix(resourceURI, store+"/") && len(store) > len(matched) {
+			config, matched = storeConfig, store
+		}
+	}
+	return config, nil
+}
+
+// checks FHIR_VERSION, FHIR_TIME_ZONE and FHIR_STORES
+func VerifyStoreConfigs() error {
+	_, _, err := storeConfigs()
+	return err
+}
+
+// the default configuration and the configuration of each store in FHIR_STORES
+func storeConfigs() (FHIRStoreConfig, map[string]FHIRStoreConfig, error) {
+	defaults, err := storeConfig(firstNonEmpty(FHIR_VERSION, FHIR_R4), firstNonEmpty(FHIR_TIME_ZONE, DEFAULT_TIME_ZONE))
+	if err != nil {
+		return FHIRStoreConfig{}, nil, err
+	}
+
+	stores := map[string]FHIRStoreConfig{}
+	for _, setting := range strings.Split(FHIR_STORES, ";") {
+		if strings.TrimSpace(setting) == "" {
+			continue
+		}
+		parts := strings.SplitN(strings.TrimSpace(setting), ":", 3)
+		for len(parts) < 3 {
+			parts = append(parts, "")
+		}
+		store := strings.TrimSuffix(parts[0], "/")
+		if store == "" {
+			return FHIRStoreConfig{}, nil, fmt.Errorf("Invalid FHIR_STORES setting, no store: %s", setting)
+		}
+		config, err := storeConfig(firstNonEmpty(parts[1], defaults.Version), firstNonEmpty(parts[2], defaults.TimeZone))
+		if err != nil {
+			return FHIRStoreConfig{}, nil, fmt.Errorf("Invalid FHIR_STORES setting for %s: %v", store, err)
+		}
+		stores[store] = config
+	}
+	return defaults, stores, nil
+}
+
+func storeConfig(version string, timeZone string) (FHIRStoreConfig, error) {
+	version = strings.ToUpper(version)
+	switch version {
+	case FHIR_STU3, FHIR_R4, FHIR_R4B, FHIR_R5:
+	default:
+		return FHIRStoreConfig{}, fmt.Errorf("Unsupported FHIR version: %s", version)
+	}
+	if _, err := time.LoadLocation(timeZone); err != nil {
+		return FHIRStoreConfig{}, fmt.Errorf("Invalid time zone %s: %v", timeZone, err)
+	}
+	return FHIRStoreConfig{Version: version, TimeZone: timeZone}, nil
+}
+
+// parses a resource of the store of resourceURI. It's converted to R4 first when the store is of another version
+func UnmarshalResource(fhirJSONString string, resourceURI string) (*r4pb.ContainedResource, error) {
+	config, err := StoreConfig(resourceURI)
+	if err != nil {
+		return nil, err
+	}
+	r4JSON, err := ConvertToR4(fhirJSONString, config.Version)
+	if err != nil {
+		return nil, Permanent(fmt.Errorf("Failed to convert the %s resource to R4: %v", config.Version, err))
+	}
+	um, err := jsonformat.NewUnmarshaller(config.TimeZone, fhirversion.R4)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to create FHIR unmarshaller: %v", err)
+	}
+	unmarshalled, err := um.Unmarshal([]byte(r4JSON))
+	if err != nil {
+		return nil, Permanent(fmt.Errorf("Failed to unmarshall FHIR JSON: %v", err))
+	}
+	return unmarshalled.(*r4pb.ContainedResource), nil
+}
+
+func firstNonEmpty(values ...string) string {
+	for _, value := range values {
+		if value != "" {
+			return value
+		}
+	}
+	return ""
+}
@@ -0,0 +1,211 @@
+package common
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	dtpb "github.com/google/fhir/go/proto/google/fhir/proto/r4/core/datatypes_go_proto"
+	r4pb "github.com/google/fhir/go/proto/google/fhir/proto/r4/core/resources/bundle_and_contained_resource_go_proto"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+)
+
+// semicolon separated list of the resource types the loader indexes. eg. Condition;Observation
+// All the registered resource types are indexed when it's not set
+var INCLUDED_RESOURCE_TYPES = os.Getenv("INCLUDED_RESOURCE_TYPES")
+
+// returned by GetResourceSummary when the handler's inclusion filter rejects the resource, and by SaveSumamry
+// when a Consent denies it
+var ErrResourceExcluded = errors.New("resource is excluded from indexing")
+
+// ResourceHandler holds everything that is specific to a FHIR resource type
+// for turning a resource into a summary row
+type ResourceHandler struct {
+	ResourceType string
+
+	// returns when the resource happened clinically, eg. the onset of a Condition. The row is stamped with
+	// it and with meta.lastUpdated when the resource has none. Optional, eg. a Patient has no clinical time
+	ClinicalTime func(contained *r4pb.ContainedResource) ClinicalTime
+
+	// returns the codings, category, statuses and encounter of the resource, stored in columns that
+	// retrieval filters on. Optional, eg. a Patient has none of them
+	Metadata func(contained *r4pb.ContainedResource) ClinicalMetadata
+
+	// builtin template of the summary prompt (text/template, {{.Resource}} is the FHIR JSON). A summary
+	// template in the prompt library takes its place
+	PromptTemplate string
+
+	// decides if the resource gets indexed at all. eg. to leave out entered-in-error data
+	Include func(contained *r4pb.ContainedResource) bool
+
+	// builds the summary locally instead of prompting the model, so nothing from the
+	// resource is sent to the model. resourceURI is the full URI of the resource in the FHIR store
+	Summarize func(ctx context.Context, contained *r4pb.ContainedResource, resourceURI string) (string, error)
+
+	// renders the summary from the coded data of the resource without the model. It is the summary
+	// when SUMMARY_SOURCE is narrative and the fallback when the model fails. Required unless Summarize is set
+	Narrative func(contained *r4pb.ContainedResource) string
+
+	// attachments holding the text of the resource. eg. the note of a DocumentReference.
+	// The text is extracted, given to the model with the JSON and stored in chunks of their own
+	Attachments func(contained *r4pb.ContainedResource) []*dtpb.Attachment
+
+	// leaves the FHIR JSON out of the data column. eg. for resources that are mostly PII
+	OmitData bool
+
+	// minimal FHIR JSON for the type with subject/patient "Patient/example", used by the contract test in handlers_test.go.
+	// The patient of a resource comes from the Patient compartment of its type, see patientCompartment
+	Sample string
+}
+
+var handlers = map[string]*ResourceHandler{}
+
+// registers the handler for its resource type. Registering a type twice is a programming error
+func RegisterHandler(handler *ResourceHandler) {
+	if handler == nil || handler.ResourceType == "" {
+		panic("common: RegisterHandler called with an empty handler")
+	}
+	if _, dup := handlers[handler.ResourceType]; dup {
+		panic("common: RegisterHandler called twice for " + handler.ResourceType)
+	}
+	handlers[handler.ResourceType] = handler
+}
+
+// returns the handler for the resource type if the type is registered and enabled
+func GetHandler(resourceType string) (*ResourceHandler, bool) {
+	handler, ok := handlers[resourceType]
+	if !ok || !isEnabled(resourceType) {
+		return nil, false
+	}
+	return handler, true
+}
+
+// registered resource types, sorted
+func HandledResourceTypes() []string {
+	resourceTypes := make([]string, 0, len(handlers))
+	for resourceType := range handlers {
+		resourceTypes = append(resourceTypes, resourceType)
+	}
+	sort.Strings(resourceTypes)
+	return resourceTypes
+}
+
+func isEnabled(resourceType string) bool {
+	if strings.TrimSpace(INCLUDED_RESOURCE_TYPES) == "" {
+		return true
+	}
+	return contains(strings.Split(INCLUDED_RESOURCE_TYPES, ";"), resourceType)
+}
+
+// checks the configuration the handlers depend on: the FHIR stores and the security label policy.
+// The handlers themselves are checked by the contract test in handlers_test.go, the de-identification
+// by the ones in deidentify_test.go
+func VerifyConfig() error {
+	if err := VerifyStoreConfigs(); err != nil {
+		return err
+	}
+	if err := VerifySecurityPolicy(); err != nil {
+		return err
+	}
+	if deidPolicy() == DEID_OFF {
+		fmt.Println("DEID_POLICY is off: resources are sent to the model as they are")
+	}
+	return nil
+}
+
+// the resource set on the ContainedResource oneof
+func resourceOf(contained *r4pb.ContainedResource) proto.Message {
+	m := contained.ProtoReflect()
+	field := m.WhichOneof(m.Descriptor().Oneofs().ByName("oneof_resource"))
+	if field == nil {
+		return nil
+	}
+	return m.Get(field).Message().Interface()
+}
+
+func resourceTypeOf(contained *r4pb.ContainedResource) string {
+	resource := resourceOf(contained)
+	if resource == nil {
+		return ""
+	}
+	return string(resource.ProtoReflect().Descriptor().Name())
+}
+
+// common fields shared by the generated resource protos
+type metaResource interface {
+	GetMeta() *dtpb.Meta
+}
+
+// meta.lastUpdated of the resource
+func metaLastUpdated(contained *r4pb.ContainedResource) int64 {
+	if resource, ok := resourceOf(contained).(metaResource); ok {
+		return resource.GetMeta().GetLastUpdated().GetValueUs()
+	}
+	return 0
+}
+
+// meta.versionId of the resource, empty when it has none
+func metaVersionId(contained *r4pb.ContainedResource) string {
+	if resource, ok := resourceOf(contained).(metaResource); ok {
+		return resource.GetMeta().GetVersionId().GetValue()
+	}
+	return ""
+}
+
+// the status code of the resource as it appears in FHIR JSON. eg. entered-in-error
+func statusCode(contained *r4pb.ContainedResource) string {
+	resource := resourceOf(contained)
+	if resource == nil {
+		return ""
+	}
+	m := resource.ProtoReflect()
+	field := m.Descriptor().Fields().ByName("status")
+	if field == nil || !m.Has(field) {
+		return ""
+	}
+	return enumCode(m.Get(field).Message())
+}
+
+// the FHIR code of a generated code message (eg. Patient_GenderCode) as it appears in FHIR JSON
+func enumCode(code protoreflect.Message) string {
+	if !code.IsValid() {
+		return ""
+	}
+	valueField := code.Descriptor().Fields().ByName("value")
+	if valueField == nil || valueField.Kind() != protoreflect.EnumKind {
+		return ""
+	}
+	value := valueField.Enum().Values().ByNumber(code.Get(valueField).Enum())
+	if value == nil || value.Number() == 0 {
+		return ""
+	}
+	return strings.ReplaceAll(strings.ToLower(string(value.Name())), "_", "-")
+}
+
+// leaves out resources that were recorded by mistake
+func notEnteredInError(contained *r4pb.ContainedResource) bool {
+	return statusCode(contained) != "entered-in-error"
+}
+
+// true when any coding of the concept has the code
+func hasCode(concept *dtpb.CodeableConcept, code string) bool {
+	for _, coding := range concept.GetCoding() {
+		if coding.GetCode().GetValue() == code {
+			return true
+		}
+	}
+	return false
+}
+
+func contains(values []string, target string) bool {
+	for _, value := range values {
+		if strings.TrimSpace(value) == target {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,123 @@
+package common
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+
+	"fhirgen.ai/llm"
+
+	"github.com/google/fhir/go/fhirversion"
+	"github.com/google/fhir/go/jsonformat"
+	r4pb "github.com/google/fhir/go/proto/google/fhir/proto/r4/core/resources/bundle_and_contained_resource_go_proto"
+	"google.golang.org/protobuf/proto"
+)
+
+const testStore = "projects/p/locations/l/datasets/d/fhirStores/s"
+
+// a FHIR store of the resources by {type}/{id}. Searches find nothing
+type testSource map[string]string
+
+func (s testSource) GetResource(ctx context.Context, resourceType string, resourceURI string) (string, error) {
+	path := resourceURI[strings.LastIndex(resourceURI, "/fhir/")+len("/fhir/"):]
+	if strings.Contains(path, "?") {
+		return `{"resourceType":"Bundle","type":"searchset","total":0}`, nil
+	}
+	if resource, ok := s[path]; ok {
+		return resource, nil
+	}
+	return "", &StatusError{StatusCode: http.StatusNotFound}
+}
+
+// serves the resources in place of the Cloud Healthcare API until the test is done
+func useTestSource(t *testing.T, source testSource) {
+	SetFHIRSource(source)
+	t.Cleanup(func() { SetFHIRSource(nil) })
+}
+
+// the contract every registered handler has to hold up, checked with its sample resource
+func TestHandlers(t *testing.T) {
+	useTestSource(t, testSource{"Patient/example": handlers["Patient"].Sample})
+	um, err := jsonformat.NewUnmarshaller("UTC", fhirversion.R4)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, resourceType := range HandledResourceTypes() {
+		handler := handlers[resourceType]
+		t.Run(resourceType, func(t *testing.T) {
+			if handler.Include == nil {
+				t.Fatal("Include is required")
+			}
+			if _, ok := patientCompartment[resourceType]; !ok && resourceType != "Patient" {
+				t.Error("the type has no elements in patientCompartment")
+			}
+			if handler.Summarize == nil && handler.Narrative == nil {
+				t.Error("Narrative is required when there is no Summarize")
+			}
+			prompt, err := llm.RenderPrompt(resourceType, handler.PromptTemplate, SummaryPromptData{ResourceType: resourceType, Resource: handler.Sample})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !strings.Contains(prompt, handler.Sample) {
+				t.Error("PromptTemplate needs {{.Resource}} for the FHIR JSON")
+			}
+
+			unmarshalled, err := um.Unmarshal([]byte(handler.Sample))
+			if err != nil {
+				t.Fatalf("invalid sample: %v", err)
+			}
+			contained := unmarshalled.(*r4pb.ContainedResource)
+			if got := resourceTypeOf(contained); got != resourceType {
+				t.Fatalf("sample is a %s", got)
+			}
+			if got := compartmentPatientId(contained); got != "example" {
+				t.Errorf("the patient of the sample is %q, want %q", got, "example")
+			}
+			if handler.ClinicalTime != nil && handler.ClinicalTime(contained).ValueUs == 0 {
+				t.Error("ClinicalTime returned no time for the sample")
+			}
+			if !handler.Include(contained) {
+				t.Error("Include rejected the sample")
+			}
+			if handler.Narrative != nil && handler.Narrative(contained) == "" {
+				t.Error("Narrative is empty for the sample")
+			}
+
+			// the conversion from the other versions keeps everything R4 has, so the sample is the same after it
+			converted, err := ConvertToR4(handler.Sample, FHIR_R4B)
+			if err != nil {
+				t.Fatalf("failed to convert the sample: %v", err)
+			}
+			reparsed, err := um.Unmarshal([]byte(converted))
+			if err != nil || !proto.Equal(reparsed, contained) {
+				t.Errorf("the sample changed when it was converted to R4: %v", err)
+			}
+
+			// and the sample makes a summary row of the patient
+			var sample struct{ Id string }
+			if err := json.Unmarshal([]byte(handler.Sample), &sample); err != nil {
+				t.Fatal(err)
+			}
+			resourceURI := testStore + "/fhir/" + resourceType + "/" + sample.Id
+			summary, err := GetResourceSummary(context.Background(), resourceType, resourceURI, "1", handler.Sample)
+			if err != nil {
+				t.Fatalf("GetResourceSummary: %v", err)
+			}
+			if summary.PatientId != "example" {
+				t.Errorf("PatientId is %q, want %q", summary.PatientId, "example")
+			}
+			if summary.Timestamp == 0 {
+				t.Error("the row has no timestamp")
+			}
+			if summary.GeneratedContent == "" {
+				t.Error("the summary or fallback narrative is empty")
+			}
+			if summary.PromptInput == "" || summary.ContentHash == "" {
+				t.Error("the prompt input or content hash is empty")
+			}
+		})
+	}
+}
@@ -0,0 +1,151 @@
+package common
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"fhirgen.ai/llm"
+)
+
+// the outcome of the latest attempt at an event
+const (
+	LEDGER_INDEXED   = "indexed"   // the summary is stored (or the same version already was)
+	LEDGER_UNCHANGED = "unchanged" // the content is the same as the stored summary's (eg. only meta changed), the summary was kept
+	LEDGER_DELETED   = "deleted"   // a DeleteResource removed the summary
+	LEDGER_EXCLUDED  = "excluded"  // the resource is excluded from indexing, any stored summary was removed
+	LEDGER_SKIPPED   = "skipped"   // a resource type without a handler or not in INCLUDED_RESOURCE_TYPES
+	LEDGER_CONSENT   = "consent"   // a Consent was applied, the summaries it denies were removed
+	LEDGER_RETRYING  = "retrying"  // failed with a transient error, pubsub delivers it again
+	LEDGER_FAILED    = "failed"    // failed for good, the event is in the dead letters
+)
+
+// a row of public.processing_ledger, one per event (resource version and action)
+type LedgerEntry struct {
+	ResourceType string
+	ResourceId   string
+	VersionId    string
+	Action       string
+	ResourceURI  string
+	PatientId    string
+	Status       string
+	Attempts     int
+	Error        string
+	Model        string // the provider and model of the summary, or its source when it's not from a model
+	Latency      time.Duration
+	UpdatedAt    time.Time
+}
+
+// which ledger entries to list. Empty fields match everything
+type LedgerFilter struct {
+	Status       string
+	ResourceType string
+	PatientId    string
+	Limit        int
+}
+
+// records the outcome of an attempt. The ledger is only a record, so a failure to write it
+// is printed rather than failing the event
+func RecordEvent(ctx context.Context, entry *LedgerEntry) {
+	if s := currentSink(); s != nil {
+		s.RecordEvent(ctx, entry)
+		return
+	}
+	conn, err := llm.GetConnection(ctx)
+	if err != nil {
+		fmt.Println("Failed to record the event in the ledger:", err)
+		return
+	}
+
+	// the patient and model are kept from an earlier attempt when this one didn't get as far
+	stmt := `
+		INSERT INTO public.processing_ledger (resourceType, resourceId, versionId, action, resourceURI,
+			patientId, status, error, model, latencyMs)
+		VALUES ($1, $2, $3, $4, $5, NULLIF($6, ''), $7, NULLIF($8, ''), NULLIF($9, ''), $10)
+		ON CONFLICT (resourceType, resourceId, versionId, action) DO UPDATE SET
+			resourceURI = EXCLUDED.resourceURI,
+			patientId = COALESCE(EXCLUDED.patientId, public.processing_ledger.patientId),
+			status = EXCLUDED.status,
+			attempts = public.processing_ledger.attempts + 1,
+			error = EXCLUDED.error,
+			model = COALESCE(EXCLUDED.model, public.processing_ledger.model),
+			latencyMs = EXCLUDED.latencyMs,
+			updatedAt = now()
+	`
+	_, err = conn.Exec(ctx, stmt, entry.ResourceType, entry.ResourceId, entry.VersionId, entry.Action,
+		entry.ResourceURI, entry.PatientId, entry.Status, entry.Error, entry.Model, entry.Latency.Milliseconds())
+	if err != nil {
+		fmt.Println("Failed to record the event in the ledger:", err)
+	}
+}
+
+// lists the ledger entries matching the filter, the most recently updated first
+func ListLedger(ctx context.Context, filter LedgerFilter) ([]LedgerEntry, error) {
+	conn, err := llm.GetConnection(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var conditions []string
+	var args []interface{}
+	for _, condition := range []struct {
+		column string
+		value  string
+	}{
+		{"status", filter.Status},
+		{"resourceType", filter.ResourceType},
+		{"patientId", filter.PatientId},
+	} {
+		if condition.value != "" {
+			args = append(args, condition.value)
+			conditions = append(conditions, fmt.Sprintf("%s = $%d", condition.column, len(args)))
+		}
+	}
+	stmt := `SELECT resourceType, resourceId, versionId, action, COALESCE(resourceURI, ''), COALESCE(patientId, ''),
+			status, attempts, COALESCE(error, ''), COALESCE(model, ''), COALESCE(latencyMs, 0), updatedAt
+		FROM public.processing_ledger`
+	if len(conditions) > 0 {
+		stmt += " WHERE " + strings.Join(conditions, " AND ")
+	}
+	stmt += " ORDER BY updatedAt DESC"
+	if filter.Limit > 0 {
+		args = append(args, filter.Limit)
+		stmt += fmt.Sprintf(" LIMIT $%d", len(args))
+	}
+
+	rows, err := conn.Query(ctx, stmt, args...)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to list the ledger: %v", err)
+	}
+	defer rows.Close()
+
+	var entries []LedgerEntry
+	for rows.Next() {
+		var entry LedgerEntry
+		var latencyMs int64
+		err := rows.Scan(&entry.ResourceType, &entry.ResourceId, &entry.VersionId, &entry.Action, &entry.ResourceURI,
+			&entry.PatientId, &entry.Status, &entry.Attempts, &entry.Error, &entry.Model, &latencyMs, &entry.UpdatedAt)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to read the ledger: %v", err)
+		}
+		entry.Latency = time.Duration(latencyMs) * time.Millisecond
+		entries = append(entries, entry)
+	}
+	return entries, rows.Err()
+}
+
+// removes the dead letter of an event that was replayed successfully
+func ResolveDeadLetter(ctx context.Context, entry *LedgerEntry) error {
+	conn, err := llm.GetConnection(ctx)
+	if err != nil {
+		return err
+	}
+
+	stmt := `DELETE FROM public.dead_letters WHERE resourceType = $1 AND resourceId = $2 AND versionId = $3 AND action = $4`
+	_, err = conn.Exec(ctx, stmt, entry.ResourceType, entry.ResourceId, entry.VersionId, entry.Action)
+	if err != nil {
+		return fmt.Errorf("Unable to delete dead letter from AlloyDB: %v", err)
+	}
+	return nil
+}
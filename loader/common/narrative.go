@@ -0,0 +1,507 @@
+package common
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	dtpb "github.com/google/fhir/go/proto/google/fhir/proto/r4/core/datatypes_go_proto"
+	r4pb "github.com/google/fhir/go/proto/google/fhir/proto/r4/core/resources/bundle_and_contained_resource_go_proto"
+	obspb "github.com/google/fhir/go/proto/google/fhir/proto/r4/core/resources/observation_go_proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+)
+
+var (
+	// "model" (default) to have the model write the summaries, "narrative" to render them in the loader
+	SUMMARY_SOURCE = os.Getenv("SUMMARY_SOURCE")
+	// the narrative is stored in place of the model summary when the model call fails or returns nothing.
+	// Set to "false" to store nothing instead
+	NARRATIVE_FALLBACK = os.Getenv("NARRATIVE_FALLBACK")
+)
+
+func narrativeFallback() bool {
+	return NARRATIVE_FALLBACK != "false"
+}
+
+// a narrative is built from "Label: value." sentences, leaving out the ones without a value.
+// It is rendered from coded data only; free text that could hold names (notes, references) is left out
+type narrative struct {
+	sentences []string
+}
+
+func (n *narrative) add(label string, value string) {
+	if value = strings.TrimSpace(value); value != "" {
+		n.sentences = append(n.sentences, label+": "+strings.TrimSuffix(value, ".")+".")
+	}
+}
+
+func (n *narrative) String() string {
+	return strings.Join(n.sentences, " ")
+}
+
+func conditionNarrative(contained *r4pb.ContainedResource) string {
+	condition := contained.GetCondition()
+	var n narrative
+	n.add("Condition", conceptText(condition.GetCode()))
+	n.add("Category", conceptsText(condition.GetCategory()))
+	n.add("Clinical status", conceptText(condition.GetClinicalStatus()))
+	n.add("Verification status", conceptText(condition.GetVerificationStatus()))
+	n.add("Severity", conceptText(condition.GetSeverity()))
+	n.add("Body site", conceptsText(condition.GetBodySite()))
+	n.add("Onset", valueText(condition.GetOnset().ProtoReflect()))
+	n.add("Abatement", valueText(condition.GetAbatement().ProtoReflect()))
+	n.add("Recorded", valueText(condition.GetRecordedDate().ProtoReflect()))
+	return n.String()
+}
+
+func observationNarrative(contained *r4pb.ContainedResource) string {
+	observation := contained.GetObservation()
+	var n narrative
+	n.add("Observation", conceptText(observation.GetCode()))
+	n.add("Category", conceptsText(observation.GetCategory()))
+	n.add("Status", enumCode(observation.GetStatus().ProtoReflect()))
+	n.add("Effective", valueText(observation.GetEffective().ProtoReflect()))
+	n.add("Value", measurementText(valueText(observation.GetValue().ProtoReflect()),
+		observation.GetInterpretation(), observation.GetReferenceRange()))
+	n.add("Data absent", conceptText(observation.GetDataAbsentReason()))
+
+	// eg. the systolic and diastolic components of a blood pressure
+	var components []string
+	for _, component := range observation.GetComponent() {
+		value := measurementText(valueText(component.GetValue().ProtoReflect()),
+			component.GetInterpretation(), component.GetReferenceRange())
+		if value == "" {
+			value = conceptText(component.GetDataAbsentReason())
+		}
+		components = append(components, strings.TrimSpace(conceptText(component.GetCode())+" "+value))
+	}
+	n.add("Components", strings.Join(components, "; "))
+	n.add("Body site", conceptText(observation.GetBodySite()))
+	n.add("Method", conceptText(observation.GetMethod()))
+	return n.String()
+}
+
+func medicationRequestNarrative(contained *r4pb.ContainedResource) string {
+	request := contained.GetMedicationRequest()
+	var n narrative
+	n.add("Medication request", valueText(request.GetMedication().ProtoReflect()))
+	n.add("Status", enumCode(request.GetStatus().ProtoReflect()))
+	n.add("Intent", enumCode(request.GetIntent().ProtoReflect()))
+	n.add("Priority", enumCode(request.GetPriority().ProtoReflect()))
+	n.add("Authored", valueText(request.GetAuthoredOn().ProtoReflect()))
+	n.add("Dosage", dosagesText(request.GetDosageInstruction()))
+	n.add("Reason", conceptsText(request.GetReasonCode()))
+	return n.String()
+}
+
+func encounterNarrative(contained *r4pb.ContainedResource) string {
+	encounter := contained.GetEncounter()
+	var n narrative
+	n.add("Encounter", codingText(encounter.GetClassValue()))
+	n.add("Type", conceptsText(encounter.GetType()))
+	n.add("Service", conceptText(encounter.GetServiceType()))
+	n.add("Status", enumCode(encounter.GetStatus().ProtoReflect()))
+	n.add("Priority", conceptText(encounter.GetPriority()))
+	n.add("Period", valueText(encounter.GetPeriod().ProtoReflect()))
+	n.add("Length", valueText(encounter.GetLength().ProtoReflect()))
+	n.add("Reason", conceptsText(encounter.GetReasonCode()))
+	n.add("Discharge disposition", conceptText(encounter.GetHospitalization().GetDischargeDisposition()))
+	return n.String()
+}
+
+func allergyIntoleranceNarrative(contained *r4pb.ContainedResource) string {
+	allergy := contained.GetAllergyIntolerance()
+	var n narrative
+	n.add("Allergy or intolerance", conceptText(allergy.GetCode()))
+	n.add("Type", enumCode(allergy.GetType().ProtoReflect()))
+	var categories []string
+	for _, category := range allergy.GetCategory() {
+		categories = append(categories, enumCode(category.ProtoReflect()))
+	}
+	n.add("Category", strings.Join(categories, ", "))
+	n.add("Criticality", enumCode(allergy.GetCriticality().ProtoReflect()))
+	n.add("Clinical status", conceptText(allergy.GetClinicalStatus()))
+	n.add("Verification status", conceptText(allergy.GetVerificationStatus()))
+	n.add("Onset", valueText(allergy.GetOnset().ProtoReflect()))
+	n.add("Recorded", valueText(allergy.GetRecordedDate().ProtoReflect()))
+
+	var reactions []string
+	for _, reaction := range allergy.GetReaction() {
+		reactionText := conceptsText(reaction.GetManifestation())
+		if severity := enumCode(reaction.GetSeverity().ProtoReflect()); severity != "" {
+			reactionText += " (" + severity + ")"
+		}
+		reactions = append(reactions, reactionText)
+	}
+	n.add("Reactions", strings.Join(reactions, "; "))
+	return n.String()
+}
+
+func procedureNarrative(contained *r4pb.ContainedResource) string {
+	procedure := contained.GetProcedure()
+	var n narrative
+	n.add("Procedure", conceptText(procedure.GetCode()))
+	n.add("Category", conceptText(procedure.GetCategory()))
+	n.add("Status", enumCode(procedure.GetStatus().ProtoReflect()))
+	n.add("Performed", valueText(procedure.GetPerformed().ProtoReflect()))
+	n.add("Reason", conceptsText(procedure.GetReasonCode()))
+	n.add("Body site", conceptsText(procedure.GetBodySite()))
+	n.add("Outcome", conceptText(procedure.GetOutcome()))
+	n.add("Complications", conceptsText(procedure.GetComplication()))
+	return n.String()
+}
+
+func immunizationNarrative(contained *r4pb.ContainedResource) string {
+	immunization := contained.GetImmunization()
+	var n narrative
+	n.add("Immunization", conceptText(immunization.GetVaccineCode()))
+	n.add("Status", enumCode(immunization.GetStatus().ProtoReflect()))
+	n.add("Status reason", conceptText(immunization.GetStatusReason()))
+	n.add("Occurred", valueText(immunization.GetOccurrence().ProtoReflect()))
+	n.add("Dose", valueText(immunization.GetDoseQuantity().ProtoReflect()))
+	n.add("Site", conceptText(immunization.GetSite()))
+	n.add("Route", conceptText(immunization.GetRoute()))
+	var doses []string
+	for _, protocol := range immunization.GetProtocolApplied() {
+		dose := valueText(protocol.GetDoseNumber().ProtoReflect())
+		if series := valueText(protocol.GetSeriesDoses().ProtoReflect()); series != "" {
+			dose += " of " + series
+		}
+		doses = append(doses, dose)
+	}
+	n.add("Dose number", strings.Join(doses, ", "))
+	return n.String()
+}
+
+func carePlanNarrative(contained *r4pb.ContainedResource) string {
+	carePlan := contained.GetCarePlan()
+	var n narrative
+	n.add("Care plan", conceptsText(carePlan.GetCategory()))
+	n.add("Status", enumCode(carePlan.GetStatus().ProtoReflect()))
+	n.add("Intent", enumCode(carePlan.GetIntent().ProtoReflect()))
+	n.add("Period", valueText(carePlan.GetPeriod().ProtoReflect()))
+	var activities []string
+	for _, activity := range carePlan.GetActivity() {
+		detail := activity.GetDetail()
+		activityText := conceptText(detail.GetCode())
+		if status := enumCode(detail.GetStatus().ProtoReflect()); status != "" {
+			activityText += " (" + status + ")"
+		}
+		activities = append(activities, activityText)
+	}
+	n.add("Activities", strings.Join(activities, "; "))
+	return n.String()
+}
+
+func serviceRequestNarrative(contained *r4pb.ContainedResource) string {
+	request := contained.GetServiceRequest()
+	var n narrative
+	n.add("Service request", conceptText(request.GetCode()))
+	n.add("Category", conceptsText(request.GetCategory()))
+	n.add("Status", enumCode(request.GetStatus().ProtoReflect()))
+	n.add("Intent", enumCode(request.GetIntent().ProtoReflect()))
+	n.add("Priority", enumCode(request.GetPriority().ProtoReflect()))
+	n.add("Occurrence", valueText(request.GetOccurrence().ProtoReflect()))
+	n.add("Authored", valueText(request.GetAuthoredOn().ProtoReflect()))
+	n.add("Reason", conceptsText(request.GetReasonCode()))
+	return n.String()
+}
+
+func diagnosticReportNarrative(contained *r4pb.ContainedResource) string {
+	report := contained.GetDiagnosticReport()
+	var n narrative
+	n.add("Diagnostic report", conceptText(report.GetCode()))
+	n.add("Category", conceptsText(report.GetCategory()))
+	n.add("Status", enumCode(report.GetStatus().ProtoReflect()))
+	n.add("Effective", valueText(report.GetEffective().ProtoReflect()))
+	n.add("Issued", valueText(report.GetIssued().ProtoReflect()))
+	n.add("Conclusion", report.GetConclusion().GetValue())
+	n.add("Coded conclusion", conceptsText(report.GetConclusionCode()))
+	if results := len(report.GetResult()); results > 0 {
+		n.add("Results", fmt.Sprintf("%d observation(s)", results))
+	}
+	return n.String()
+}
+
+func documentReferenceNarrative(contained *r4pb.ContainedResource) string {
+	document := contained.GetDocumentReference()
+	var n narrative
+	n.add("Document", conceptText(document.GetType()))
+	n.add("Category", conceptsText(document.GetCategory()))
+	n.add("Status", enumCode(document.GetStatus().ProtoReflect()))
+	n.add("Document status", enumCode(document.GetDocStatus().ProtoReflect()))
+	n.add("Date", valueText(document.GetDate().ProtoReflect()))
+	n.add("Period", valueText(document.GetContext().GetPeriod().ProtoReflect()))
+	n.add("Facility type", conceptText(document.GetContext().GetFacilityType()))
+	n.add("Practice setting", conceptText(document.GetContext().GetPracticeSetting()))
+	return n.String()
+}
+
+func medicationStatementNarrative(contained *r4pb.ContainedResource) string {
+	statement := contained.GetMedicationStatement()
+	var n narrative
+	n.add("Medication statement", valueText(statement.GetMedication().ProtoReflect()))
+	n.add("Status", enumCode(statement.GetStatus().ProtoReflect()))
+	n.add("Effective", valueText(statement.GetEffective().ProtoReflect()))
+	n.add("Dosage", dosagesText(statement.GetDosage()))
+	n.add("Reason", conceptsText(statement.GetReasonCode()))
+	return n.String()
+}
+
+func goalNarrative(contained *r4pb.ContainedResource) string {
+	goal := contained.GetGoal()
+	var n narrative
+	n.add("Goal", conceptText(goal.GetDescription()))
+	n.add("Category", conceptsText(goal.GetCategory()))
+	n.add("Lifecycle status", enumCode(goal.GetLifecycleStatus().ProtoReflect()))
+	n.add("Achievement", conceptText(goal.GetAchievementStatus()))
+	n.add("Priority", conceptText(goal.GetPriority()))
+	n.add("Start", valueText(goal.GetStart().ProtoReflect()))
+	var targets []string
+	for _, target := range goal.GetTarget() {
+		targetText := strings.TrimSpace(conceptText(target.GetMeasure()) + " " + valueText(target.GetDetail().ProtoReflect()))
+		if due := valueText(target.GetDue().ProtoReflect()); due != "" {
+			targetText += " by " + due
+		}
+		targets = append(targets, targetText)
+	}
+	n.add("Targets", strings.Join(targets, "; "))
+	return n.String()
+}
+
+// the text of a FHIR datatype for the narrative. For a choice type ([x]) it's the text of the type
+// that is set. References give no text as their display is often a person's name
+func valueText(m protoreflect.Message) string {
+	if !m.IsValid() {
+		return ""
+	}
+	switch value := m.Interface().(type) {
+	case *dtpb.CodeableConcept:
+		return conceptText(value)
+	case *dtpb.Coding:
+		return codingText(value)
+	case quantity:
+		return quantityText(value)
+	case *dtpb.Range:
+		return rangeText(value.GetLow(), value.GetHigh())
+	case *dtpb.Ratio:
+		numerator, denominator := quantityText(value.GetNumerator()), quantityText(value.GetDenominator())
+		if numerator == "" || denominator == "" {
+			return numerator
+		}
+		return numerator + " per " + denominator
+	case *dtpb.Period:
+		start, end := valueText(value.GetStart().ProtoReflect()), valueText(value.GetEnd().ProtoReflect())
+		switch {
+		case start != "" && end != "":
+			return start + " to " + end
+		case start != "":
+			return "from " + start
+		case end != "":
+			return "until " + end
+		}
+		return ""
+	case *dtpb.DateTime:
+		return timeText(value.GetValueUs(), value.GetTimezone(), value.GetPrecision().String())
+	case *dtpb.Date:
+		return timeText(value.GetValueUs(), value.GetTimezone(), value.GetPrecision().String())
+	case *dtpb.Instant:
+		return timeText(value.GetValueUs(), value.GetTimezone(), value.GetPrecision().String())
+	case *dtpb.Time:
+		return time.UnixMicro(value.GetValueUs()).UTC().Format("15:04")
+	case *dtpb.String:
+		return value.GetValue()
+	case *dtpb.Code:
+		return value.GetValue()
+	case *dtpb.Boolean:
+		if value.GetValue() {
+			return "yes"
+		}
+		return "no"
+	case *dtpb.Integer:
+		return strconv.Itoa(int(value.GetValue()))
+	case *dtpb.PositiveInt:
+		return strconv.Itoa(int(value.GetValue()))
+	case *dtpb.UnsignedInt:
+		return strconv.Itoa(int(value.GetValue()))
+	case *dtpb.Decimal:
+		return value.GetValue()
+	case *dtpb.Reference:
+		return ""
+	}
+
+	// choice types hold their value in a oneof
+	if oneofs := m.Descriptor().Oneofs(); oneofs.Len() == 1 {
+		if field := m.WhichOneof(oneofs.Get(0)); field != nil && field.Kind() == protoreflect.MessageKind {
+			return valueText(m.Get(field).Message())
+		}
+	}
+	// generated code messages like the status codes
+	return enumCode(m)
+}
+
+// the text of the concept, or the display (or code) of its first coding when it has no text
+func conceptText(concept *dtpb.CodeableConcept) string {
+	if text := concept.GetText().GetValue(); text != "" {
+		return text
+	}
+	for _, coding := range concept.GetCoding() {
+		if text := codingText(coding); text != "" {
+			return text
+		}
+	}
+	return ""
+}
+
+func conceptsText(concepts []*dtpb.CodeableConcept) string {
+	var texts []string
+	for _, concept := range concepts {
+		if text := conceptText(concept); text != "" {
+			texts = append(texts, text)
+		}
+	}
+	return strings.Join(texts, ", ")
+}
+
+func codingText(coding *dtpb.Coding) string {
+	if display := coding.GetDisplay().GetValue(); display != "" {
+		return display
+	}
+	return coding.GetCode().GetValue()
+}
+
+// Quantity and its profiles (SimpleQuantity, Age, Duration...)
+type quantity interface {
+	protoreflect.ProtoMessage
+	GetValue() *dtpb.Decimal
+	GetUnit() *dtpb.String
+	GetCode() *dtpb.Code
+}
+
+var comparators = map[string]string{
+	"less-than":                "<",
+	"less-than-or-equal-to":    "<=",
+	"greater-than-or-equal-to": ">=",
+	"greater-than":             ">",
+}
+
+func quantityText(q quantity) string {
+	if !q.ProtoReflect().IsValid() || q.GetValue().GetValue() == "" {
+		return ""
+	}
+	text := q.GetValue().GetValue()
+	unit := q.GetUnit().GetValue()
+	if unit == "" {
+		unit = q.GetCode().GetValue()
+	}
+	if unit != "" {
+		text += " " + unit
+	}
+
+	m := q.ProtoReflect()
+	if field := m.Descriptor().Fields().ByName("comparator"); field != nil && m.Has(field) {
+		text = comparators[enumCode(m.Get(field).Message())] + text
+	}
+	return text
+}
+
+func rangeText(low, high *dtpb.SimpleQuantity) string {
+	lowText, highText := quantityText(low), quantityText(high)
+	switch {
+	case lowText != "" && highText != "":
+		// the unit is only given once when both ends have the same one
+		if low.GetUnit().GetValue() == high.GetUnit().GetValue() {
+			lowText = low.GetValue().GetValue()
+		}
+		return lowText + "-" + highText
+	case lowText != "":
+		return ">=" + lowText
+	case highText != "":
+		return "<=" + highText
+	}
+	return ""
+}
+
+// the value of an observation along with its interpretation and reference range.
+// eg. 145 mm[Hg] (High), reference range 90-120 mm[Hg]
+func measurementText(value string, interpretations []*dtpb.CodeableConcept, referenceRanges []*obspb.Observation_ReferenceRange) string {
+	if value == "" {
+		return ""
+	}
+	if interpretation := conceptsText(interpretations); interpretation != "" {
+		value += " (" + interpretation + ")"
+	}
+
+	var ranges []string
+	for _, referenceRange := range referenceRanges {
+		rangeText := rangeText(referenceRange.GetLow(), referenceRange.GetHigh())
+		if rangeText == "" {
+			rangeText = referenceRange.GetText().GetValue()
+		}
+		if rangeText != "" {
+			ranges = append(ranges, rangeText)
+		}
+	}
+	if len(ranges) > 0 {
+		value += ", reference range " + strings.Join(ranges, " or ")
+	}
+	return value
+}
+
+// the dosage text, or the dose and route when there is no text
+func dosagesText(dosages []*dtpb.Dosage) string {
+	var texts []string
+	for _, dosage := range dosages {
+		text := dosage.GetText().GetValue()
+		if text == "" {
+			var parts []string
+			for _, doseAndRate := range dosage.GetDoseAndRate() {
+				parts = append(parts, valueText(doseAndRate.GetDose().ProtoReflect()))
+			}
+			parts = append(parts, conceptText(dosage.GetRoute()))
+			if dosage.GetAsNeeded().GetBoolean().GetValue() {
+				parts = append(parts, "as needed")
+			}
+			text = strings.Join(strings.Fields(strings.Join(parts, " ")), " ")
+		}
+		if text != "" {
+			texts = append(texts, text)
+		}
+	}
+	return strings.Join(texts, "; ")
+}
+
+// the date or time in the precision it was given in, in its own timezone
+func timeText(valueUs int64, timezone string, precision string) string {
+	if valueUs == 0 {
+		return ""
+	}
+	t := time.UnixMicro(valueUs).In(timeLocation(timezone))
+	switch precision {
+	case "YEAR":
+		return t.Format("2006")
+	case "MONTH":
+		return t.Format("2006-01")
+	case "DAY":
+		return t.Format("2006-01-02")
+	default:
+		return t.Format("2006-01-02 15:04 MST")
+	}
+}
+
+// the location of a FHIR proto timezone, which is either a name (UTC, America/Chicago) or an offset (+05:30)
+func timeLocation(timezone string) *time.Location {
+	if timezone == "Z" {
+		return time.UTC
+	}
+	if location, err := time.LoadLocation(timezone); err == nil && timezone != "" {
+		return location
+	}
+	if offset, err := time.Parse("Z07:00", timezone); err == nil {
+		_, seconds := offset.Zone()
+		return time.FixedZone(timezone, seconds)
+	}
+	return time.UTC
+}
@@ -0,0 +1,66 @@
+package common
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	dtpb "github.com/google/fhir/go/proto/google/fhir/proto/r4/core/datatypes_go_proto"
+	r4pb "github.com/google/fhir/go/proto/google/fhir/proto/r4/core/resources/bundle_and_contained_resource_go_proto"
+)
+
+// builds a PII free summary of the Patient for context in RAG: age band and sex. Names, identifiers,
+// contact details and the birth date never leave the loader. The number of active problems is counted
+// by rag_context when the question is asked, from the Conditions the requester may see
+func summarizePatient(ctx context.Context, contained *r4pb.ContainedResource, resourceURI string) (string, error) {
+	patient := contained.GetPatient()
+
+	sex := enumCode(patient.GetGender().ProtoReflect())
+	if sex == "" {
+		sex = "unknown"
+	}
+
+	// age is taken at the time of death for deceased patients
+	asOf := time.Now()
+	deceased := patient.GetDeceased().GetBoolean().GetValue()
+	if deathDate := patient.GetDeceased().GetDateTime(); deathDate != nil {
+		deceased = true
+		asOf = time.UnixMicro(deathDate.GetValueUs())
+	}
+
+	// the age is stated with the year it was taken in, so it doesn't go stale in the stored summary.
+	// Only the year, as the month and day of a death date would be PII
+	summary := fmt.Sprintf("Patient context: age %s in %d, sex %s.", ageBand(patient.GetBirthDate(), asOf), asOf.Year(), sex)
+	if deceased {
+		summary += " The patient is deceased."
+	}
+
+	return summary, nil
+}
+
+// age in ten year bands. Ages over 89 are grouped together as required by HIPAA Safe Harbor
+func ageBand(birthDate *dtpb.Date, asOf time.Time) string {
+	if birthDate == nil {
+		return "unknown"
+	}
+	born := time.UnixMicro(birthDate.GetValueUs())
+	age := asOf.Year() - born.Year()
+	if asOf.YearDay() < born.YearDay() {
+		age--
+	}
+
+	switch {
+	case age < 0:
+		return "unknown"
+	case age >= 90:
+		return "90 or older"
+	case age < 18:
+		return "under 18"
+	default:
+		low := age / 10 * 10
+		if low < 18 {
+			low = 18
+		}
+		return fmt.Sprintf("%d-%d", low, age/10*10+9)
+	}
+}
@@ -0,0 +1,126 @@
+package common
+
+import (
+	"context"
+	"errors"
+	"fmt"
+)
+
+// FHIR store notification actions sent in the Pub/Sub message attributes
+const (
+	CREATE_ACTION = "CreateResource"
+	UPDATE_ACTION = "UpdateResource"
+	DELETE_ACTION = "DeleteResource"
+)
+
+// processes a FHIR store notification, from pubsub or replayed from the ledger. The outcome and what
+// was learned about the resource (patient, model) are set on the entry. force regenerates the summary
+// even when the same version or content is already stored
+func ProcessEvent(ctx context.Context, entry *LedgerEntry, force bool) error {
+	resourceType := entry.ResourceType
+	action := entry.Action
+	versionId := entry.VersionId
+	resourceURI := entry.ResourceURI
+
+	// Consents aren't indexed, they decide what of the patient's data is. See consent.go
+	if resourceType == "Consent" {
+		patientId, removed, err := ApplyConsent(ctx, resourceURI, action)
+		if err != nil {
+			return fmt.Errorf("Error applying the Consent: %w", err)
+		}
+		fmt.Println("Applied Consent for patient", patientId, "removed summaries:", removed)
+		entry.PatientId = patientId
+		entry.Status = LEDGER_CONSENT
+		return nil
+	}
+
+	//get resoruceId from the resourceURI
+	resourceId := ResourceIdFromURI(resourceURI)
+
+	// the resource no longer exists in the FHIR store, so there is nothing to fetch.
+	// remove its summary and embedding so that it can't be retrieved by RAG anymore. This goes for every
+	// type, one that is no longer in INCLUDED_RESOURCE_TYPES may still have rows from when it was
+	if action == DELETE_ACTION {
+		fmt.Println("Deleting Sumamry for:", resourceType, resourceId)
+		err := DeleteSummary(ctx, fhirStoreOf(resourceURI), resourceType, resourceId)
+		if err != nil {
+			return fmt.Errorf("Error deleting summary for the FHIR resource: %w", err)
+		}
+		entry.Status = LEDGER_DELETED
+		return nil
+	}
+
+	// Check if the given resource type has a handler and is enabled for indexing
+	_, included := GetHandler(resourceType)
+
+	if !included {
+		fmt.Println("Skipping processing for resource type:", resourceType)
+		entry.Status = LEDGER_SKIPPED
+		return nil
+	}
+
+	// retrieve the resource and further process it
+	fhirJSONString, err := GetFHIRResource(ctx, resourceType, resourceURI)
+	if IsGone(err) {
+		// a create or update delivered after the resource's DeleteResource. It's a stale event rather than
+		// a failure, and the delete may have been processed before this version got saved
+		fmt.Println("Resource no longer exists in the FHIR store. Removing any stored summary:", resourceType, resourceId)
+		err = DeleteSummary(ctx, fhirStoreOf(resourceURI), resourceType, resourceId)
+		if err != nil {
+			return fmt.Errorf("Error deleting summary for the FHIR resource: %w", err)
+		}
+		entry.Status = LEDGER_DELETED
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("Erorr Getting the FHIR Resource %s: %w", resourceType, err)
+	}
+	fmt.Println("Got resource..")
+
+	fmt.Println("Generating Sumamry..")
+	resourceSummary, err := GetResourceSummary(ctx, resourceType, resourceURI, versionId, fhirJSONString)
+	if errors.Is(err, ErrResourceExcluded) {
+		// the resource may have been indexed before it got excluded. eg. updated to entered-in-error
+		fmt.Println("Resource is excluded from indexing. Removing any stored summary:", resourceType, resourceId)
+		err = DeleteSummary(ctx, fhirStoreOf(resourceURI), resourceType, resourceId)
+		if err != nil {
+			return fmt.Errorf("Error deleting summary for the FHIR resource: %w", err)
+		}
+		entry.Status = LEDGER_EXCLUDED
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("Error Generating Sumamry for the FHIR Resource %s: %w", resourceType, err)
+	}
+
+	// Print the Resource Sumamry
+	fmt.Println("ResourceId:", resourceSummary.ResourceId)
+	fmt.Println("PatientId:", resourceSummary.PatientId)
+	fmt.Println("ResourceType:", resourceSummary.ResourceType)
+	fmt.Println("Timestamp:", resourceSummary.Timestamp)
+	fmt.Println("VersionId:", resourceSummary.VersionId)
+
+	entry.PatientId = resourceSummary.PatientId
+	resourceSummary.Force = force
+	err = SaveSumamry(ctx, resourceSummary)
+	if errors.Is(err, ErrResourceExcluded) {
+		// denied by a Consent that was applied while the summary was generated. Its rows are removed
+		fmt.Println("Resource is denied by a Consent of the patient:", resourceType, resourceId)
+		entry.Status = LEDGER_EXCLUDED
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("Error saving summary for the FHIR resource: %w", err)
+	}
+	if resourceSummary.Unchanged {
+		entry.Status = LEDGER_UNCHANGED
+		return nil
+	}
+	entry.Status = LEDGER_INDEXED
+	entry.Model = resourceSummary.Model
+	if entry.Model == "" {
+		entry.Model = resourceSummary.SummarySource
+	}
+
+	return nil
+}
@@ -0,0 +1,80 @@
+package common
+
+import (
+	"context"
+	"testing"
+)
+
+// keeps what processing saved and deleted instead of writing it to AlloyDB
+type recordingSink struct {
+	saved   []*FHIRResourceSumamry
+	deleted []string // {fhirStore}/{type}/{id}
+}
+
+func (s *recordingSink) SaveSummary(ctx context.Context, resourceSummary *FHIRResourceSumamry) error {
+	s.saved = append(s.saved, resourceSummary)
+	return nil
+}
+
+func (s *recordingSink) DeleteSummary(ctx context.Context, fhirStore string, resourceType string, resourceId string) error {
+	s.deleted = append(s.deleted, fhirStore+"/"+resourceType+"/"+resourceId)
+	return nil
+}
+
+func (s *recordingSink) RecordEvent(ctx context.Context, entry *LedgerEntry) {}
+
+func (s *recordingSink) SaveDeadLetter(ctx context.Context, deadLetter *DeadLetter) error {
+	return nil
+}
+
+// records the outcome of processing until the test is done
+func useRecordingSink(t *testing.T) *recordingSink {
+	s := &recordingSink{}
+	SetSink(s)
+	t.Cleanup(func() { SetSink(nil) })
+	return s
+}
+
+// a type indexed before it was left out of INCLUDED_RESOURCE_TYPES still has its rows removed on a delete
+func TestDeleteOfExcludedType(t *testing.T) {
+	defer func(configured string) { INCLUDED_RESOURCE_TYPES = configured }(INCLUDED_RESOURCE_TYPES)
+	INCLUDED_RESOURCE_TYPES = "Patient"
+	s := useRecordingSink(t)
+
+	entry := &LedgerEntry{ResourceType: "Observation", Action: DELETE_ACTION, ResourceURI: testStore + "/fhir/Observation/o1"}
+	if err := ProcessEvent(context.Background(), entry, false); err != nil {
+		t.Fatal(err)
+	}
+	if entry.Status != LEDGER_DELETED {
+		t.Errorf("the status is %s, want %s", entry.Status, LEDGER_DELETED)
+	}
+	if len(s.deleted) != 1 || s.deleted[0] != testStore+"/Observation/o1" {
+		t.Errorf("deleted %v, want the Observation", s.deleted)
+	}
+
+	// other events of the type are still skipped
+	entry = &LedgerEntry{ResourceType: "Observation", Action: UPDATE_ACTION, ResourceURI: testStore + "/fhir/Observation/o1"}
+	if err := ProcessEvent(context.Background(), entry, false); err != nil {
+		t.Fatal(err)
+	}
+	if entry.Status != LEDGER_SKIPPED {
+		t.Errorf("the status is %s, want %s", entry.Status, LEDGER_SKIPPED)
+	}
+}
+
+// a create or update that arrives after the resource was deleted removes the row instead of failing
+func TestEventAfterDelete(t *testing.T) {
+	s := useRecordingSink(t)
+	useTestSource(t, testSource{})
+
+	entry := &LedgerEntry{ResourceType: "Observation", Action: UPDATE_ACTION, ResourceURI: testStore + "/fhir/Observation/o1"}
+	if err := ProcessEvent(context.Background(), entry, false); err != nil {
+		t.Fatalf("the stale event failed: %v", err)
+	}
+	if entry.Status != LEDGER_DELETED {
+		t.Errorf("the status is %s, want %s", entry.Status, LEDGER_DELETED)
+	}
+	if len(s.deleted) != 1 || len(s.saved) != 0 {
+		t.Errorf("deleted %v and saved %d summaries, want the Observation deleted", s.deleted, len(s.saved))
+	}
+}
@@ -0,0 +1,72 @@
+package common
+
+import (
+	"context"
+	"fmt"
+
+	"fhirgen.ai/llm"
+)
+
+// what a summary template is rendered with. {{.Resource}} is the de-identified FHIR JSON, {{.ResourceType}} its type
+type SummaryPromptData struct {
+	ResourceType string
+	Resource     string
+}
+
+// renders the summary prompt for a resource with the library's template for its type, or the handler's
+// builtin template. Also returns the version of the template as {version}/{name}, stored with the summary
+func SummaryPrompt(library *llm.PromptLibrary, resourceType string, resource string) (string, string, error) {
+	name, text, version, err := summaryTemplate(library, resourceType)
+	if err != nil {
+		return "", "", err
+	}
+	prompt, err := llm.RenderPrompt(name, text, SummaryPromptData{ResourceType: resourceType, Resource: resource})
+	if err != nil {
+		return "", "", err
+	}
+	return prompt, version + "/" + name, nil
+}
+
+// the {version}/{name} of the template SummaryPrompt uses for the resource type
+func SummaryPromptVersion(library *llm.PromptLibrary, resourceType string) (string, error) {
+	name, _, version, err := summaryTemplate(library, resourceType)
+	if err != nil {
+		return "", err
+	}
+	return version + "/" + name, nil
+}
+
+func summaryTemplate(library *llm.PromptLibrary, resourceType string) (string, string, string, error) {
+	if name, text, ok := library.Lookup(llm.SUMMARY_PROMPT, resourceType); ok {
+		return name, text, library.Version, nil
+	}
+	handler, ok := GetHandler(resourceType)
+	if !ok {
+		return "", "", "", fmt.Errorf("Unhandled resource type: %v", resourceType)
+	}
+	if handler.PromptTemplate != DEFAULT_PROMPT_TEMPLATE {
+		return llm.SUMMARY_PROMPT + "." + resourceType, handler.PromptTemplate, llm.BUILTIN_PROMPT_VERSION, nil
+	}
+	return llm.SUMMARY_PROMPT, handler.PromptTemplate, llm.BUILTIN_PROMPT_VERSION, nil
+}
+
+// generates the summary with the model configured for summaries and the summary template of the library.
+// GeneratedContent, Model and PromptVersion are set on the summary, nothing is saved
+func GenerateSummaryWith(ctx context.Context, library *llm.PromptLibrary, resourceSummary *FHIRResourceSumamry) error {
+	prompt, promptVersion, err := SummaryPrompt(library, resourceSummary.ResourceType, resourceSummary.PromptInput)
+	if err != nil {
+		return err
+	}
+	generator, err := llm.GetTextGenerator(ctx, llm.SUMMARY_USE)
+	if err != nil {
+		return err
+	}
+	summary, err := generator.GenerateText(ctx, prompt)
+	if err != nil {
+		return err
+	}
+	resourceSummary.GeneratedContent = summary
+	resourceSummary.Model = generator.Model()
+	resourceSummary.PromptVersion = promptVersion
+	return nil
+}
@@ -0,0 +1,105 @@
+package common
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"time"
+)
+
+// how long an event that fails with a transient error is retried before it goes to the dead letters.
+// A Go duration, defaults to 1h
+var RETRY_MAX_AGE = os.Getenv("RETRY_MAX_AGE")
+
+// MessagePublishedData contains the full Pub/Sub message. It's the data of the Eventarc CloudEvent and
+// the body of a Pub/Sub push request alike
+// https://cloud.google.com/eventarc/docs/cloudevents#pubsub
+// https://cloud.google.com/pubsub/docs/push#receive_push
+type MessagePublishedData struct {
+	Message      PubSubMessage `json:"message"`
+	Subscription string        `json:"subscription,omitempty"`
+}
+
+// PubSubMessage is the payload of a Pub/Sub event.
+// https://cloud.google.com/pubsub/docs/reference/rest/v1/PubsubMessage
+type PubSubMessage struct {
+	Attributes struct {
+		ResourceType string `json:"resourceType"`
+		Action       string `json:"action"`
+		VersionID    string `json:"versionId"`
+	} `json:"attributes"`
+	Data        []byte    `json:"data"`
+	MessageID   string    `json:"messageId,omitempty"`
+	PublishTime time.Time `json:"publishTime"`
+}
+
+// processes a FHIR store notification as it came from Pub/Sub, the CloudEvent trigger, push requests and
+// the replay command alike. Every attempt is recorded in the ledger. A transient error is returned for
+// Pub/Sub to deliver the event again, until it's older than RETRY_MAX_AGE. An event that fails for good
+// goes to the dead letters with the payload it came in, and nil is returned unless that fails
+func ProcessMessage(ctx context.Context, msg *MessagePublishedData, payload []byte, published time.Time) error {
+	fmt.Printf("Received:, %s\n", msg.Message)
+
+	var resourceType = string(msg.Message.Attributes.ResourceType)
+	var action = string(msg.Message.Attributes.Action) //CreateResource, UpdateResource, DeleteResource
+	var versionId = string(msg.Message.Attributes.VersionID)
+	var resourceURI = string(msg.Message.Data) //eg. projects/X/locations/X/datasets/X/fhirStores/X/fhir/resoruceTyep/id
+
+	// every attempt is recorded in the ledger with its outcome
+	entry := &LedgerEntry{
+		ResourceType: resourceType,
+		ResourceId:   ResourceIdFromURI(resourceURI),
+		VersionId:    versionId,
+		Action:       action,
+		ResourceURI:  resourceURI,
+	}
+	start := time.Now()
+	err := ProcessEvent(ctx, entry, false)
+	entry.Latency = time.Since(start)
+	if err == nil {
+		RecordEvent(ctx, entry)
+		return nil
+	}
+	entry.Error = err.Error()
+
+	// returning the error has Pub/Sub deliver the event again, until it's too old
+	if !IsPermanent(err) && !expired(published) {
+		fmt.Println("Failed to process the event, it will be retried:", err)
+		entry.Status = LEDGER_RETRYING
+		RecordEvent(ctx, entry)
+		return err
+	}
+	fmt.Println("Failed to process the event, saving it as a dead letter:", err)
+	entry.Status = LEDGER_FAILED
+	RecordEvent(ctx, entry)
+	return SaveMessageDeadLetter(ctx, &DeadLetter{
+		MessageId:    msg.Message.MessageID,
+		ResourceType: resourceType,
+		ResourceId:   entry.ResourceId,
+		VersionId:    versionId,
+		Action:       action,
+		ResourceURI:  resourceURI,
+		Payload:      payload,
+		Reason:       err.Error(),
+	})
+}
+
+// saves the dead letter of a message. When that fails the error is returned, so the message is
+// delivered again rather than lost
+func SaveMessageDeadLetter(ctx context.Context, deadLetter *DeadLetter) error {
+	if err := SaveDeadLetter(ctx, deadLetter); err != nil {
+		return fmt.Errorf("Failed to save the dead letter: %w", err)
+	}
+	return nil
+}
+
+// whether the event was published longer than RETRY_MAX_AGE ago
+func expired(published time.Time) bool {
+	maxAge := time.Hour
+	if RETRY_MAX_AGE != "" {
+		if configured, err := time.ParseDuration(RETRY_MAX_AGE); err == nil {
+			maxAge = configured
+		}
+	}
+	return !published.IsZero() && time.Since(published) > maxAge
+}
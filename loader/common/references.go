@@ -0,0 +1,283 @@
+package common
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	r4pb "github.com/google/fhir/go/proto/google/fhir/proto/r4/core/resources/bundle_and_contained_resource_go_proto"
+)
+
+// how many references deep the loader follows. eg. 2 resolves the PractitionerRole of a MedicationRequest
+// and then its Organization. 0 turns reference resolution off. Defaults to 2
+var REFERENCE_DEPTH = os.Getenv("REFERENCE_DEPTH")
+
+const (
+	// at most this many references are resolved for a resource, so a long list can't fan out into many requests
+	MAX_REFERENCES = 10
+	// resolved resources are cached for a while, as many resources point to the same Medication or Encounter
+	REFERENCE_CACHE_SIZE = 1000
+	REFERENCE_CACHE_TTL  = 10 * time.Minute
+)
+
+// the resource types that are resolved, with what is taken from them. Only coded, non-PII facts:
+// the drug and its strength, the type and dates of an encounter, a specialty rather than a practitioner's name
+var referenceFacts = map[string]func(contained *r4pb.ContainedResource) string{
+	"Medication":       medicationFacts,
+	"Encounter":        encounterNarrative,
+	"Condition":        conditionNarrative,
+	"PractitionerRole": practitionerRoleFacts,
+	"Practitioner":     practitionerFacts,
+	"Organization":     organizationFacts,
+}
+
+func medicationFacts(contained *r4pb.ContainedResource) string {
+	medication := contained.GetMedication()
+	var n narrative
+	n.add("Medication", conceptText(medication.GetCode()))
+	var ingredients []string
+	for _, ingredient := range medication.GetIngredient() {
+		ingredientText := valueText(ingredient.GetItem().ProtoReflect())
+		if strength := valueText(ingredient.GetStrength().ProtoReflect()); strength != "" {
+			ingredientText = strings.TrimSpace(ingredientText + " " + strength)
+		}
+		ingredients = append(ingredients, ingredientText)
+	}
+	n.add("Ingredients", strings.Join(ingredients, ", "))
+	n.add("Form", conceptText(medication.GetForm()))
+	return n.String()
+}
+
+func practitionerRoleFacts(contained *r4pb.ContainedResource) string {
+	role := contained.GetPractitionerRole()
+	var n narrative
+	n.add("Practitioner role", conceptsText(role.GetCode()))
+	n.add("Specialty", conceptsText(role.GetSpecialty()))
+	return n.String()
+}
+
+func practitionerFacts(contained *r4pb.ContainedResource) string {
+	var qualifications []string
+	for _, qualification := range contained.GetPractitioner().GetQualification() {
+		qualifications = append(qualifications, conceptText(qualification.GetCode()))
+	}
+	var n narrative
+	n.add("Practitioner qualification", strings.Join(qualifications, ", "))
+	return n.String()
+}
+
+func organizationFacts(contained *r4pb.ContainedResource) string {
+	var n narrative
+	n.add("Organization", conceptsText(contained.GetOrganization().GetType()))
+	return n.String()
+}
+
+// a reference found in a resource, with the element it was found in. eg. medicationReference
+type reference struct {
+	element string
+	target  string
+}
+
+// resolves the references of the resource to the types in referenceFacts and returns what was learned
+// from them, one line per resource. References that can't be resolved are skipped
+func ResolveReferences(ctx context.Context, fhirJSONString string, resourceURI string) []string {
+	depth := 2
+	if REFERENCE_DEPTH != "" {
+		if configured, err := strconv.Atoi(REFERENCE_DEPTH); err == nil {
+			depth = configured
+		}
+	}
+
+	var facts []string
+	seen := map[string]bool{}
+	resolveReferences(ctx, fhirJSONString, nil, resourceURI, "", depth, seen, &facts)
+	return facts
+}
+
+func resolveReferences(ctx context.Context, fhirJSONString string, contained map[string]string, resourceURI string,
+	path string, depth int, seen map[string]bool, facts *[]string) {
+	if depth <= 0 {
+		return
+	}
+
+	var resource map[string]interface{}
+	if err := json.Unmarshal([]byte(fhirJSONString), &resource); err != nil {
+		return
+	}
+	// contained resources are referenced with #id and are resolved from the resource itself
+	if contained == nil {
+		contained = map[string]string{}
+		if list, ok := resource["contained"].([]interface{}); ok {
+			for _, item := range list {
+				if containedResource, ok := item.(map[string]interface{}); ok {
+					if id, ok := containedResource["id"].(string); ok {
+						containedJSON, _ := json.Marshal(containedResource)
+						contained["#"+id] = string(containedJSON)
+					}
+				}
+			}
+		}
+	}
+
+	for _, ref := range findReferences(resource) {
+		if len(seen) >= MAX_REFERENCES {
+			return
+		}
+		resourceType := referenceType(ref.target)
+		factsOf, ok := referenceFacts[resourceType]
+		if !ok && !strings.HasPrefix(ref.target, "#") {
+			continue
+		}
+		key, ok := referenceURI(ref.target, resourceURI)
+		if !ok || seen[key] {
+			continue
+		}
+		seen[key] = true
+
+		var referencedJSON string
+		if strings.HasPrefix(ref.target, "#") {
+			referencedJSON = contained[ref.target]
+		} else {
+			var err error
+			referencedJSON, err = getReferencedResource(ctx, resourceType, key)
+			if err != nil {
+				fmt.Println("Skipping reference", ref.element, resourceType, "that can't be resolved:", err)
+				continue
+			}
+		}
+		if referencedJSON == "" {
+			continue
+		}
+
+		// references are resolved in the store of the resource, so they are of its FHIR version
+		referenced, err := UnmarshalResource(referencedJSON, resourceURI)
+		if err != nil {
+			fmt.Println("Skipping reference", ref.element, "that can't be parsed:", err)
+			continue
+		}
+		if factsOf == nil {
+			// a contained resource
+			if factsOf, ok = referenceFacts[resourceTypeOf(referenced)]; !ok {
+				continue
+			}
+		}
+
+		element := strings.TrimPrefix(path+"."+ref.element, ".")
+		if text := factsOf(referenced); text != "" {
+			*facts = append(*facts, text+" (from "+element+")")
+		}
+		resolveReferences(ctx, referencedJSON, contained, resourceURI, element, depth-1, seen, facts)
+	}
+}
+
+// the references of the resource (not those of its contained resources) with the top level element
+// they are in. References to the patient are left out, the summary is about the patient already
+func findReferences(resource map[string]interface{}) []reference {
+	var references []reference
+	var find func(element string, node interface{})
+	find = func(element string, node interface{}) {
+		switch value := node.(type) {
+		case map[string]interface{}:
+			if target, ok := value["reference"].(string); ok && referenceType(target) != "Patient" {
+				references = append(references, reference{element: element, target: target})
+			}
+			for _, child := range value {
+				find(element, child)
+			}
+		case []interface{}:
+			for _, child := range value {
+				find(element, child)
+			}
+		}
+	}
+
+	// sorted so that the same references are resolved first every time
+	elements := make([]string, 0, len(resource))
+	for element := range resource {
+		if element != "contained" && element != "subject" && element != "patient" {
+			elements = append(elements, element)
+		}
+	}
+	sort.Strings(elements)
+	for _, element := range elements {
+		find(element, resource[element])
+	}
+	return references
+}
+
+// the URI of the referenced resource in the FHIR store of the resource, or the #id of a contained one.
+// Like attachment urls, absolute references are only followed into the same store
+func referenceURI(target string, resourceURI string) (string, bool) {
+	if strings.HasPrefix(target, "#") {
+		return target, true
+	}
+	storeURI := fhirStoreURI(resourceURI)
+	if strings.Contains(target, "://") {
+		storeURL := "https://healthcare.googleapis.com/v1/" + storeURI + "/"
+		if !strings.HasPrefix(target, storeURL) {
+			return "", false
+		}
+		return strings.TrimPrefix(target, "https://healthcare.googleapis.com/v1/"), true
+	}
+	if strings.HasPrefix(target, "urn:") {
+		return "", false
+	}
+	return storeURI + "/" + strings.TrimPrefix(target, "/"), true
+}
+
+// the resource type of a relative (Medication/123), versioned (Medication/123/_history/2)
+// or absolute reference
+func referenceType(target string) string {
+	parts := strings.Split(strings.TrimSuffix(target, "/"), "/")
+	if i := len(parts) - 4; i >= 0 && parts[len(parts)-2] == "_history" {
+		return parts[i]
+	}
+	if len(parts) >= 2 {
+		return parts[len(parts)-2]
+	}
+	return ""
+}
+
+var referenceCache = struct {
+	sync.Mutex
+	entries map[string]cachedResource
+}{entries: map[string]cachedResource{}}
+
+type cachedResource struct {
+	json    string
+	expires time.Time
+}
+
+// gets the referenced resource from the cache or the FHIR store
+func getReferencedResource(ctx context.Context, resourceType string, referenceURI string) (string, error) {
+	referenceCache.Lock()
+	cached, ok := referenceCache.entries[referenceURI]
+	referenceCache.Unlock()
+	if ok && time.Now().Before(cached.expires) {
+		return cached.json, nil
+	}
+
+	referencedJSON, err := GetFHIRResource(ctx, resourceType, referenceURI)
+	if err != nil {
+		return "", err
+	}
+
+	referenceCache.Lock()
+	defer referenceCache.Unlock()
+	if len(referenceCache.entries) >= REFERENCE_CACHE_SIZE {
+		now := time.Now()
+		for uri, entry := range referenceCache.entries {
+			if now.After(entry.expires) || len(referenceCache.entries) >= REFERENCE_CACHE_SIZE {
+				delete(referenceCache.entries, uri)
+			}
+		}
+	}
+	referenceCache.entries[referenceURI] = cachedResource{json: referencedJSON, expires: time.Now().Add(REFERENCE_CACHE_TTL)}
+	return referencedJSON, nil
+}
@@ -0,0 +1,273 @@
+package common
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"fhirgen.ai/llm"
+)
+
+// what the rows are reindexed to: the model and prompt templates summaries are generated with, and the
+// embedding model. With a shadow embedding model (a migration) rows are embedded with it into the shadow
+// columns, otherwise rows of another embedding model are embedded again in place
+type ReindexTarget struct {
+	SummaryModel         string
+	PromptVersions       map[string]string // the {version}/{name} of the summary template by resource type
+	EmbeddingModel       string
+	ShadowEmbeddingModel string
+}
+
+// the target of the loader's configuration: SUMMARY_LLM_*, PROMPT_VERSION, EMBEDDING_* and SHADOW_EMBEDDING_*
+func GetReindexTarget(ctx context.Context) (*ReindexTarget, error) {
+	generator, err := llm.GetTextGenerator(ctx, llm.SUMMARY_USE)
+	if err != nil {
+		return nil, err
+	}
+	library, err := llm.GetPromptLibrary(ctx)
+	if err != nil {
+		return nil, err
+	}
+	embedder, err := llm.GetEmbedder()
+	if err != nil {
+		return nil, err
+	}
+	shadowEmbedder, err := llm.GetShadowEmbedder()
+	if err != nil {
+		return nil, err
+	}
+
+	target := &ReindexTarget{SummaryModel: generator.Model(), PromptVersions: map[string]string{}, EmbeddingModel: embedder.Model()}
+	for resourceType := range handlers {
+		if _, ok := GetHandler(resourceType); !ok {
+			continue
+		}
+		if target.PromptVersions[resourceType], err = SummaryPromptVersion(library, resourceType); err != nil {
+			return nil, err
+		}
+	}
+	if shadowEmbedder != nil {
+		target.ShadowEmbeddingModel = shadowEmbedder.Model()
+	}
+	return target, nil
+}
+
+// the key of a summary row. The same id can be in more than one FHIR store
+type RowKey struct {
+	FHIRStore    string
+	ResourceType string
+	Id           string
+}
+
+// a row that isn't indexed the way the target is, a resource or a chunk of one
+type ReindexRow struct {
+	RowKey
+	ParentId             string
+	VersionId            string
+	Summary              string
+	SummarySource        string
+	SummaryModel         string
+	PromptVersion        string
+	EmbeddingModel       string
+	ShadowEmbeddingModel string
+	Data                 string // the FHIR JSON, empty for chunks and resources stored without it
+}
+
+// the summary was generated by another model or prompt template than the target's. Only summaries the
+// model wrote are generated again, of the resource types the loader handles
+func (row *ReindexRow) SummaryStale(target *ReindexTarget) bool {
+	promptVersion, handled := target.PromptVersions[row.ResourceType]
+	return row.SummarySource == MODEL_SUMMARY && row.ParentId == "" && handled &&
+		(row.SummaryModel != target.SummaryModel || row.PromptVersion != promptVersion)
+}
+
+// the row has no embedding of the model being migrated to, or without a migration its embedding is of another model
+func (row *ReindexRow) EmbeddingStale(target *ReindexTarget) bool {
+	if target.ShadowEmbeddingModel != "" {
+		return row.EmbeddingModel != target.ShadowEmbeddingModel && row.ShadowEmbeddingModel != target.ShadowEmbeddingModel
+	}
+	return row.EmbeddingModel != target.EmbeddingModel
+}
+
+// the rows SummaryStale or EmbeddingStale for the target as SQL. $1 to $4 are the target, see reindexArgs
+const reindexCondition = `summary IS NOT NULL AND (
+		(summarySource = 'model' AND parentId IS NULL AND $2::jsonb ->> type IS NOT NULL
+			AND (summaryModel IS DISTINCT FROM $1 OR promptVersion IS DISTINCT FROM $2::jsonb ->> type))
+		OR ($4 = '' AND embeddingModel IS DISTINCT FROM $3)
+		OR ($4 <> '' AND embeddingModel IS DISTINCT FROM $4 AND shadowEmbeddingModel IS DISTINCT FROM $4))`
+
+// the columns reindexCondition and ListReindexRows read
+const reindexColumns = `fhirStore, id, parentId, type, versionId, summary, summarySource, summaryModel, promptVersion,
+	embeddingModel, shadowEmbeddingModel, data`
+
+// the rows of the patient and the non-patient tables with the columns
+func allResourceRows(columns string) string {
+	var selects []string
+	for _, table := range RESOURCE_TABLES {
+		selects = append(selects, "SELECT "+columns+" FROM "+table)
+	}
+	return "(" + strings.Join(selects, " UNION ALL ") + ") AS rows"
+}
+
+func reindexArgs(target *ReindexTarget) ([]interface{}, error) {
+	promptVersions, err := json.Marshal(target.PromptVersions)
+	if err != nil {
+		return nil, err
+	}
+	return []interface{}{target.SummaryModel, string(promptVersions), target.EmbeddingModel, target.ShadowEmbeddingModel}, nil
+}
+
+// the next rows to reindex after the key, in the order of their keys. The zero key starts at the first row.
+// Rows that are done no longer match, so a reindex that is started again picks up where the last one stopped
+func ListReindexRows(ctx context.Context, target *ReindexTarget, after RowKey, limit int) ([]ReindexRow, error) {
+	conn, err := llm.GetConnection(ctx)
+	if err != nil {
+		return nil, err
+	}
+	args, err := reindexArgs(target)
+	if err != nil {
+		return nil, err
+	}
+
+	stmt := `SELECT fhirStore, id, COALESCE(parentId, ''), type, COALESCE(versionId, ''), summary, COALESCE(summarySource, ''),
+			COALESCE(summaryModel, ''), COALESCE(promptVersion, ''), COALESCE(embeddingModel, ''),
+			COALESCE(shadowEmbeddingModel, ''), COALESCE(data::text, '')
+		FROM ` + allResourceRows(reindexColumns) + ` WHERE (fhirStore, type, id) > ($5, $6, $7) AND ` + reindexCondition + `
+		ORDER BY fhirStore, type, id LIMIT $8`
+	rows, err := conn.Query(ctx, stmt, append(args, after.FHIRStore, after.ResourceType, after.Id, limit)...)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to list the rows to reindex: %v", err)
+	}
+	defer rows.Close()
+
+	var reindexRows []ReindexRow
+	for rows.Next() {
+		var r ReindexRow
+		err := rows.Scan(&r.FHIRStore, &r.Id, &r.ParentId, &r.ResourceType, &r.VersionId, &r.Summary, &r.SummarySource,
+			&r.SummaryModel, &r.PromptVersion, &r.EmbeddingModel, &r.ShadowEmbeddingModel, &r.Data)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to read the rows to reindex: %v", err)
+		}
+		reindexRows = append(reindexRows, r)
+	}
+	return reindexRows, rows.Err()
+}
+
+// the number of rows left to reindex
+func CountReindexRows(ctx context.Context, target *ReindexTarget) (int64, error) {
+	conn, err := llm.GetConnection(ctx)
+	if err != nil {
+		return 0, err
+	}
+	args, err := reindexArgs(target)
+	if err != nil {
+		return 0, err
+	}
+	var count int64
+	err = conn.QueryRow(ctx, `SELECT count(*) FROM `+allResourceRows(reindexColumns)+` WHERE `+reindexCondition, args...).Scan(&count)
+	if err != nil {
+		return 0, fmt.Errorf("Unable to count the rows to reindex: %v", err)
+	}
+	return count, nil
+}
+
+// embeds the summaries of the rows for the target, into the shadow columns during a migration. A row is
+// only updated when its summary is still the one embedded, the loader may have saved a new version meanwhile.
+// Returns the number of rows updated
+func ReindexEmbeddings(ctx context.Context, target *ReindexTarget, rows []ReindexRow) (int, error) {
+	if len(rows) == 0 {
+		return 0, nil
+	}
+	conn, err := llm.GetConnection(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	texts := make([]string, len(rows))
+	for i, row := range rows {
+		texts[i] = row.Summary
+	}
+	embed, set := llm.EmbedTexts, `embedding = $2::vector, embeddingModel = $3`
+	if target.ShadowEmbeddingModel != "" {
+		embed, set = llm.EmbedShadowTexts, `shadowEmbedding = $2::vector, shadowEmbeddingModel = $3`
+	}
+	embeddings, model, err := embed(ctx, texts)
+	if err != nil {
+		return 0, err
+	}
+
+	// the row is in one of the tables
+	var updated int
+	for i, row := range rows {
+		for _, table := range RESOURCE_TABLES {
+			stmt := `UPDATE ` + table + ` SET ` + set + ` WHERE fhirStore = $5 AND type = $6 AND id = $1 AND summary = $4`
+			tag, err := conn.Exec(ctx, stmt, row.Id, llm.VectorText(embeddings[i]), model, row.Summary, row.FHIRStore,
+				row.ResourceType)
+			if err != nil {
+				return updated, fmt.Errorf("Unable to save the embedding of %s: %v", row.Id, err)
+			}
+			updated += int(tag.RowsAffected())
+		}
+	}
+	return updated, nil
+}
+
+// the number of rows with the same models and prompt template
+type IndexCount struct {
+	EmbeddingModel       string
+	ShadowEmbeddingModel string
+	SummaryModel         string
+	PromptVersion        string
+	Rows                 int64
+}
+
+// counts the rows of both tables by what they were indexed with
+func ListIndexCounts(ctx context.Context) ([]IndexCount, error) {
+	conn, err := llm.GetConnection(ctx)
+	if err != nil {
+		return nil, err
+	}
+	stmt := `SELECT COALESCE(embeddingModel, ''), COALESCE(shadowEmbeddingModel, ''), COALESCE(summaryModel, ''),
+			COALESCE(promptVersion, ''), count(*)
+		FROM ` + allResourceRows("embeddingModel, shadowEmbeddingModel, summaryModel, promptVersion") + `
+		GROUP BY 1, 2, 3, 4 ORDER BY 1, 2, 3, 4`
+	rows, err := conn.Query(ctx, stmt)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to count the rows: %v", err)
+	}
+	defer rows.Close()
+
+	var counts []IndexCount
+	for rows.Next() {
+		var c IndexCount
+		if err := rows.Scan(&c.EmbeddingModel, &c.ShadowEmbeddingModel, &c.SummaryModel, &c.PromptVersion, &c.Rows); err != nil {
+			return nil, fmt.Errorf("Unable to count the rows: %v", err)
+		}
+		counts = append(counts, c)
+	}
+	return counts, rows.Err()
+}
+
+// makes the shadow embeddings of the model the embeddings of their rows, at most limit rows of each table at a time.
+// Returns the number of rows promoted, 0 once there are none left
+func PromoteShadowEmbeddings(ctx context.Context, model string, limit int) (int64, error) {
+	conn, err := llm.GetConnection(ctx)
+	if err != nil {
+		return 0, err
+	}
+	var promoted int64
+	for _, table := range RESOURCE_TABLES {
+		stmt := `
+			UPDATE ` + table + ` SET embedding = shadowEmbedding, embeddingModel = shadowEmbeddingModel,
+				shadowEmbedding = NULL, shadowEmbeddingModel = NULL
+			WHERE (fhirStore, type, id) IN (SELECT fhirStore, type, id FROM ` + table + ` WHERE shadowEmbeddingModel = $1 LIMIT $2)
+		`
+		tag, err := conn.Exec(ctx, stmt, model, limit)
+		if err != nil {
+			return promoted, fmt.Errorf("Unable to promote the shadow embeddings: %v", err)
+		}
+		promoted += tag.RowsAffected()
+	}
+	return promoted, nil
+}
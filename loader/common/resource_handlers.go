@@ -0,0 +1,200 @@
+package common
+
+import (
+	dtpb "github.com/google/fhir/go/proto/google/fhir/proto/r4/core/datatypes_go_proto"
+	r4pb "github.com/google/fhir/go/proto/google/fhir/proto/r4/core/resources/bundle_and_contained_resource_go_proto"
+)
+
+// builtin template of the summary prompt for any resource type, used when the prompt library has no summary template
+const DEFAULT_PROMPT_TEMPLATE = "You are a clinician and also an expert on Healthcare data especially FHIR JSON." +
+	"And you are also very sensitive about patient privacy and protecting PII like their names," +
+	"emails, phone numbers, addresses and date of birth. " +
+	"I would like you to summarize the below FHIR JSON into a short paragraph that includes the following info:" +
+	"- the dates of the data as absolute dates (eg. 2023-06-01). Never say how long ago something was or use " +
+	"words like recently, today or last year, the summary is stored and read long after it is written " +
+	"- Any other relationships to other resources based on the references if there are and a " +
+	"- A clinical narrative of what the resource data is all about." +
+	"Include data values and units. " +
+	"Do not include any Personally Identifiable Information like names, emails,phone , addresses and date of birth. " +
+	"Make the final conent to be a paragraph of text so I can use that for" +
+	"generating Emebeddings out of it " +
+	"here is the JOSN:{{.Resource}}" +
+	"important:  Do not include any names of patient's and practitioners in the final content"
+
+// handlers for the resource types the loader supports.
+// To support a new type, register a handler for it here with a sample resource
+func init() {
+	RegisterHandler(&ResourceHandler{
+		ResourceType:   "Condition",
+		ClinicalTime:   clinicalTime("onset", "recordedDate"),
+		Metadata:       clinicalMetadata("code"),
+		PromptTemplate: DEFAULT_PROMPT_TEMPLATE,
+		Narrative:      conditionNarrative,
+		Include: func(contained *r4pb.ContainedResource) bool {
+			return !hasCode(contained.GetCondition().GetVerificationStatus(), "entered-in-error")
+		},
+		Sample: `{"resourceType":"Condition","id":"sample","meta":{"lastUpdated":"2024-01-02T03:04:05Z"},
+			"code":{"text":"Hypertension"},"onsetDateTime":"2015","subject":{"reference":"Patient/example"}}`,
+	})
+
+	RegisterHandler(&ResourceHandler{
+		ResourceType:   "Observation",
+		ClinicalTime:   clinicalTime("effective", "issued"),
+		Metadata:       clinicalMetadata("code"),
+		PromptTemplate: DEFAULT_PROMPT_TEMPLATE,
+		Narrative:      observationNarrative,
+		Include:        notEnteredInError,
+		Sample: `{"resourceType":"Observation","id":"sample","meta":{"lastUpdated":"2024-01-02T03:04:05Z"},
+			"status":"final","code":{"text":"Heart rate"},"effectiveDateTime":"2023-12-30T10:00:00Z","subject":{"reference":"Patient/example"}}`,
+	})
+
+	RegisterHandler(&ResourceHandler{
+		ResourceType:   "MedicationRequest",
+		ClinicalTime:   clinicalTime("authoredOn"),
+		Metadata:       clinicalMetadata("medication"),
+		PromptTemplate: DEFAULT_PROMPT_TEMPLATE,
+		Narrative:      medicationRequestNarrative,
+		Include:        notEnteredInError,
+		Sample: `{"resourceType":"MedicationRequest","id":"sample","meta":{"lastUpdated":"2024-01-02T03:04:05Z"},
+			"status":"active","intent":"order","medicationCodeableConcept":{"text":"Lisinopril 10 MG"},"authoredOn":"2023-12-30",
+			"subject":{"reference":"Patient/example"}}`,
+	})
+
+	RegisterHandler(&ResourceHandler{
+		ResourceType:   "Encounter",
+		ClinicalTime:   clinicalTime("period"),
+		Metadata:       clinicalMetadata("type"),
+		PromptTemplate: DEFAULT_PROMPT_TEMPLATE,
+		Narrative:      encounterNarrative,
+		Include:        notEnteredInError,
+		Sample: `{"resourceType":"Encounter","id":"sample","meta":{"lastUpdated":"2024-01-02T03:04:05Z"},
+			"status":"finished","class":{"code":"AMB"},"period":{"start":"2023-12-30T09:00:00Z"},"subject":{"reference":"Patient/example"}}`,
+	})
+
+	RegisterHandler(&ResourceHandler{
+		ResourceType:   "AllergyIntolerance",
+		ClinicalTime:   clinicalTime("onset", "recordedDate"),
+		Metadata:       clinicalMetadata("code"),
+		PromptTemplate: DEFAULT_PROMPT_TEMPLATE,
+		Narrative:      allergyIntoleranceNarrative,
+		Include: func(contained *r4pb.ContainedResource) bool {
+			return !hasCode(contained.GetAllergyIntolerance().GetVerificationStatus(), "entered-in-error")
+		},
+		Sample: `{"resourceType":"AllergyIntolerance","id":"sample","meta":{"lastUpdated":"2024-01-02T03:04:05Z"},
+			"code":{"text":"Penicillin"},"recordedDate":"2010-06","patient":{"reference":"Patient/example"}}`,
+	})
+
+	RegisterHandler(&ResourceHandler{
+		ResourceType:   "Procedure",
+		ClinicalTime:   clinicalTime("performed"),
+		Metadata:       clinicalMetadata("code"),
+		PromptTemplate: DEFAULT_PROMPT_TEMPLATE,
+		Narrative:      procedureNarrative,
+		Include:        notEnteredInError,
+		Sample: `{"resourceType":"Procedure","id":"sample","meta":{"lastUpdated":"2024-01-02T03:04:05Z"},
+			"status":"completed","code":{"text":"Appendectomy"},"performedDateTime":"2001-04-12","subject":{"reference":"Patient/example"}}`,
+	})
+
+	RegisterHandler(&ResourceHandler{
+		ResourceType:   "Immunization",
+		ClinicalTime:   clinicalTime("occurrence", "recorded"),
+		Metadata:       clinicalMetadata("vaccineCode"),
+		PromptTemplate: DEFAULT_PROMPT_TEMPLATE,
+		Narrative:      immunizationNarrative,
+		Include:        notEnteredInError,
+		Sample: `{"resourceType":"Immunization","id":"sample","meta":{"lastUpdated":"2024-01-02T03:04:05Z"},
+			"status":"completed","vaccineCode":{"text":"Influenza"},"patient":{"reference":"Patient/example"},
+			"occurrenceDateTime":"2023-10-01"}`,
+	})
+
+	RegisterHandler(&ResourceHandler{
+		ResourceType:   "CarePlan",
+		ClinicalTime:   clinicalTime("period", "created"),
+		Metadata:       clinicalMetadata(),
+		PromptTemplate: DEFAULT_PROMPT_TEMPLATE,
+		Narrative:      carePlanNarrative,
+		Include:        notEnteredInError,
+		Sample: `{"resourceType":"CarePlan","id":"sample","meta":{"lastUpdated":"2024-01-02T03:04:05Z"},
+			"status":"active","intent":"plan","period":{"start":"2024-01-01"},"subject":{"reference":"Patient/example"}}`,
+	})
+
+	RegisterHandler(&ResourceHandler{
+		ResourceType:   "ServiceRequest",
+		ClinicalTime:   clinicalTime("occurrence", "authoredOn"),
+		Metadata:       clinicalMetadata("code"),
+		PromptTemplate: DEFAULT_PROMPT_TEMPLATE,
+		Narrative:      serviceRequestNarrative,
+		Include:        notEnteredInError,
+		Sample: `{"resourceType":"ServiceRequest","id":"sample","meta":{"lastUpdated":"2024-01-02T03:04:05Z"},
+			"status":"active","intent":"order","code":{"text":"Lipid panel"},"authoredOn":"2023-12-30","subject":{"reference":"Patient/example"}}`,
+	})
+
+	RegisterHandler(&ResourceHandler{
+		ResourceType:   "DiagnosticReport",
+		ClinicalTime:   clinicalTime("effective", "issued"),
+		Metadata:       clinicalMetadata("code"),
+		PromptTemplate: DEFAULT_PROMPT_TEMPLATE,
+		Narrative:      diagnosticReportNarrative,
+		Include:        notEnteredInError,
+		Attachments: func(contained *r4pb.ContainedResource) []*dtpb.Attachment {
+			return contained.GetDiagnosticReport().GetPresentedForm()
+		},
+		Sample: `{"resourceType":"DiagnosticReport","id":"sample","meta":{"lastUpdated":"2024-01-02T03:04:05Z"},
+			"status":"final","code":{"text":"Basic metabolic panel"},"effectiveDateTime":"2023-12-30","subject":{"reference":"Patient/example"}}`,
+	})
+
+	RegisterHandler(&ResourceHandler{
+		ResourceType:   "DocumentReference",
+		ClinicalTime:   clinicalTime("context.period", "date"),
+		Metadata:       clinicalMetadata("type"),
+		PromptTemplate: DEFAULT_PROMPT_TEMPLATE,
+		Narrative:      documentReferenceNarrative,
+		Include:        notEnteredInError,
+		Attachments: func(contained *r4pb.ContainedResource) []*dtpb.Attachment {
+			var attachments []*dtpb.Attachment
+			for _, content := range contained.GetDocumentReference().GetContent() {
+				attachments = append(attachments, content.GetAttachment())
+			}
+			return attachments
+		},
+		Sample: `{"resourceType":"DocumentReference","id":"sample","meta":{"lastUpdated":"2024-01-02T03:04:05Z"},
+			"status":"current","type":{"text":"Discharge summary"},"date":"2023-12-31T12:00:00Z","subject":{"reference":"Patient/example"},
+			"content":[{"attachment":{"contentType":"text/plain","data":"RGlzY2hhcmdlZCBob21lLg=="}}]}`,
+	})
+
+	RegisterHandler(&ResourceHandler{
+		ResourceType:   "MedicationStatement",
+		ClinicalTime:   clinicalTime("effective", "dateAsserted"),
+		Metadata:       clinicalMetadata("medication"),
+		PromptTemplate: DEFAULT_PROMPT_TEMPLATE,
+		Narrative:      medicationStatementNarrative,
+		Include:        notEnteredInError,
+		Sample: `{"resourceType":"MedicationStatement","id":"sample","meta":{"lastUpdated":"2024-01-02T03:04:05Z"},
+			"status":"active","medicationCodeableConcept":{"text":"Metformin 500 MG"},"effectivePeriod":{"start":"2019-03"},"subject":{"reference":"Patient/example"}}`,
+	})
+
+	RegisterHandler(&ResourceHandler{
+		ResourceType:   "Goal",
+		ClinicalTime:   clinicalTime("start", "statusDate"),
+		Metadata:       clinicalMetadata("description"),
+		PromptTemplate: DEFAULT_PROMPT_TEMPLATE,
+		Narrative:      goalNarrative,
+		Include: func(contained *r4pb.ContainedResource) bool {
+			return enumCode(contained.GetGoal().GetLifecycleStatus().ProtoReflect()) != "entered-in-error"
+		},
+		Sample: `{"resourceType":"Goal","id":"sample","meta":{"lastUpdated":"2024-01-02T03:04:05Z"},
+			"lifecycleStatus":"active","description":{"text":"HbA1c below 7%"},"startDate":"2023-11-01","subject":{"reference":"Patient/example"}}`,
+	})
+
+	// the Patient is summarized locally without any PII and its JSON isn't stored,
+	// it gives the RAG model context like age band and sex for the patient's other resources
+	RegisterHandler(&ResourceHandler{
+		ResourceType:   "Patient",
+		PromptTemplate: DEFAULT_PROMPT_TEMPLATE,
+		Include:        func(contained *r4pb.ContainedResource) bool { return true },
+		Summarize:      summarizePatient,
+		OmitData:       true,
+		Sample: `{"resourceType":"Patient","id":"example","meta":{"lastUpdated":"2024-01-02T03:04:05Z"},
+			"gender":"female","birthDate":"1970-05-06"}`,
+	})
+}
@@ -0,0 +1,94 @@
+package common
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	r4pb "github.com/google/fhir/go/proto/google/fhir/proto/r4/core/resources/bundle_and_contained_resource_go_proto"
+)
+
+// what the loader does with resources by their meta.security labels, as {code}:{action} separated with ;
+// eg. 42CFRPart2:exclude;ETH:exclude;N:tag. The actions are
+//
+//	exclude  the resource isn't indexed, a stored summary is removed
+//	segment  indexed, retrieval only returns it to requesters cleared for the label (sofhir *_ROLE_CLEARANCE
+//	         and the securityClearance claim)
+//	tag      indexed with the label, anyone can retrieve it
+//
+// The confidentiality codes R and V and the sensitivity codes of DEFAULT_SEGMENTED_LABELS are segmented
+// unless the policy says otherwise, any other label is a tag
+var SECURITY_LABEL_POLICY = os.Getenv("SECURITY_LABEL_POLICY")
+
+const (
+	SECURITY_EXCLUDE = "exclude"
+	SECURITY_SEGMENT = "segment"
+	SECURITY_TAG     = "tag"
+)
+
+// restricted (R) and very restricted (V) confidentiality, and the HL7 v3 sensitivity codes of substance use
+// (42 CFR Part 2), behavioral and mental health, HIV and other sensitive conditions
+var DEFAULT_SEGMENTED_LABELS = []string{"R", "V", "42CFRPart2", "ETH", "SUD", "BH", "MH", "PSY", "PSYTHPN",
+	"HIV", "STD", "SDV", "SEX", "GDIS", "SICKLE"}
+
+// the security labels of a resource, their codes as in meta.security
+type SecurityLabels struct {
+	Labels     []string // every label of the resource
+	Restricted []string // the segmented ones, retrieval needs clearance for all of them
+	Excluded   []string // the ones that keep the resource out of the index
+}
+
+// the meta.security labels of the resource sorted by what SECURITY_LABEL_POLICY does with them
+func securityLabelsOf(contained *r4pb.ContainedResource) (SecurityLabels, error) {
+	policy, err := securityPolicy()
+	if err != nil {
+		return SecurityLabels{}, err
+	}
+	var labels SecurityLabels
+	resource, ok := resourceOf(contained).(metaResource)
+	if !ok {
+		return labels, nil
+	}
+	for _, coding := range resource.GetMeta().GetSecurity() {
+		code := coding.GetCode().GetValue()
+		if code == "" || contains(labels.Labels, code) {
+			continue
+		}
+		labels.Labels = append(labels.Labels, code)
+		switch policy[code] {
+		case SECURITY_EXCLUDE:
+			labels.Excluded = append(labels.Excluded, code)
+		case SECURITY_SEGMENT:
+			labels.Restricted = append(labels.Restricted, code)
+		}
+	}
+	return labels, nil
+}
+
+// the action of each label the policy or the defaults name
+func securityPolicy() (map[string]string, error) {
+	policy := map[string]string{}
+	for _, label := range DEFAULT_SEGMENTED_LABELS {
+		policy[label] = SECURITY_SEGMENT
+	}
+	for _, setting := range strings.Split(SECURITY_LABEL_POLICY, ";") {
+		if strings.TrimSpace(setting) == "" {
+			continue
+		}
+		code, action, ok := strings.Cut(strings.TrimSpace(setting), ":")
+		switch action = strings.ToLower(strings.TrimSpace(action)); {
+		case !ok || code == "":
+			return nil, fmt.Errorf("Invalid SECURITY_LABEL_POLICY setting, expected {code}:{action}: %s", setting)
+		case action != SECURITY_EXCLUDE && action != SECURITY_SEGMENT && action != SECURITY_TAG:
+			return nil, fmt.Errorf("Invalid SECURITY_LABEL_POLICY action for %s: %s", code, action)
+		}
+		policy[strings.TrimSpace(code)] = action
+	}
+	return policy, nil
+}
+
+// checks SECURITY_LABEL_POLICY
+func VerifySecurityPolicy() error {
+	_, err := securityPolicy()
+	return err
+}
@@ -0,0 +1,34 @@
+package common
+
+import (
+	"context"
+	"sync"
+)
+
+// where the outcome of processing goes: the summaries, the ledger and the dead letters
+type Sink interface {
+	SaveSummary(ctx context.Context, resourceSummary *FHIRResourceSumamry) error
+	DeleteSummary(ctx context.Context, fhirStore string, resourceType string, resourceId string) error
+	RecordEvent(ctx context.Context, entry *LedgerEntry)
+	SaveDeadLetter(ctx context.Context, deadLetter *DeadLetter) error
+}
+
+// the sink set with SetSink, nil saves to AlloyDB
+var sink struct {
+	sync.Mutex
+	sink Sink
+}
+
+// sends the outcome of processing to the sink rather than AlloyDB, eg. to a file in the replay command.
+// nil saves to AlloyDB again
+func SetSink(s Sink) {
+	sink.Lock()
+	defer sink.Unlock()
+	sink.sink = s
+}
+
+func currentSink() Sink {
+	sink.Lock()
+	defer sink.Unlock()
+	return sink.sink
+}
@@ -0,0 +1,32 @@
+package common
+
+import (
+	"context"
+	"sync"
+)
+
+// where the loader reads FHIR resources from. Searches (eg. Consent?patient=1) are read from it as well,
+// as a searchset Bundle
+type FHIRSource interface {
+	GetResource(ctx context.Context, resourceType string, resourceURI string) (string, error)
+}
+
+// the source set with SetFHIRSource, nil reads from the Cloud Healthcare API
+var fhirSource struct {
+	sync.Mutex
+	source FHIRSource
+}
+
+// reads the resources from the source rather than the Cloud Healthcare API, eg. local files in the
+// replay command. nil reads from the API again
+func SetFHIRSource(source FHIRSource) {
+	fhirSource.Lock()
+	defer fhirSource.Unlock()
+	fhirSource.source = source
+}
+
+func currentFHIRSource() FHIRSource {
+	fhirSource.Lock()
+	defer fhirSource.Unlock()
+	return fhirSource.source
+}
@@ -0,0 +1,46 @@
+package common
+
+import (
+	"context"
+	"fmt"
+
+	r4pb "github.com/google/fhir/go/proto/google/fhir/proto/r4/core/resources/bundle_and_contained_resource_go_proto"
+)
+
+// rows are stamped with the organization (tenant) of their patient and the FHIR store they come from.
+// Row-level security in AlloyDB only lets sofhir's user see the rows of the organization it set in
+// app.organization_id, from the organizationId claim of the caller. The loader reads and writes the rows of
+// every organization, it connects as its own IAM user (ADB_IAM_USER) that the policies let through
+
+// the id of the managingOrganization of the resource's patient, the Patient's own for a Patient. Empty when
+// the resource isn't in a patient's compartment or the patient has no managing organization, the rows are
+// then only seen by the loader
+func PatientOrganizationId(ctx context.Context, contained *r4pb.ContainedResource, resourceURI string,
+	patientId string) (string, error) {
+	patient := contained.GetPatient()
+	if patient == nil && patientId != "" {
+		patientURI := fhirStoreURI(resourceURI) + "/Patient/" + patientId
+		patientJSON, err := getReferencedResource(ctx, "Patient", patientURI)
+		if IsPermanent(err) {
+			fmt.Println("Patient of the resource can't be read for its organization:", err)
+			return "", nil
+		}
+		if err != nil {
+			return "", fmt.Errorf("Failed to get the Patient for the organization: %w", err)
+		}
+		referenced, err := UnmarshalResource(patientJSON, patientURI)
+		if err != nil {
+			return "", err
+		}
+		patient = referenced.GetPatient()
+	}
+
+	if patient.GetManagingOrganization() == nil {
+		return "", nil
+	}
+	_, target := referenceTarget(patient.GetManagingOrganization())
+	if target == "" || target[0] == '#' {
+		return "", nil
+	}
+	return referenceId(target), nil
+}
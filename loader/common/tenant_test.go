@@ -0,0 +1,40 @@
+package common
+
+import (
+	"context"
+	"testing"
+)
+
+// the rows are stamped with the id of the Patient's managingOrganization. sofhir puts the same id in the
+// organizationId claim of the patient and of the providers with a PractitionerRole in the organization
+// (see TestOrganizationClaims in sofhir), so this has to stay org-1 for row-level security to let them see the rows
+func TestPatientOrganizationId(t *testing.T) {
+	// a patient of its own for each reference, the Patients that are looked up are cached
+	for patientId, reference := range map[string]string{
+		"org-patient-1": "Organization/org-1",
+		"org-patient-2": "https://example.com/fhir/Organization/org-1",
+	} {
+		patient := `{"resourceType":"Patient","id":"` + patientId + `","managingOrganization":{"reference":"` + reference + `"}}`
+		useTestSource(t, testSource{"Patient/" + patientId: patient})
+
+		t.Run(reference, func(t *testing.T) {
+			for resourceURI, json := range map[string]string{
+				testStore + "/fhir/Patient/" + patientId: patient,
+				testStore + "/fhir/Observation/o1": `{"resourceType":"Observation","id":"o1","status":"final",
+					"code":{"text":"Heart rate"},"subject":{"reference":"Patient/` + patientId + `"}}`,
+			} {
+				contained, err := UnmarshalResource(json, resourceURI)
+				if err != nil {
+					t.Fatal(err)
+				}
+				orgId, err := PatientOrganizationId(context.Background(), contained, resourceURI, patientId)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if orgId != "org-1" {
+					t.Errorf("%s is stamped with %q, want org-1", resourceURI, orgId)
+				}
+			}
+		})
+	}
+}
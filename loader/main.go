@@ -2,108 +2,88 @@ package loader
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
+	"io"
 	"log"
-	"strings"
+	"net/http"
 
+	"fhirgen.ai/llm"
 	"fhirgen.ai/loader/common"
 
 	"github.com/GoogleCloudPlatform/functions-framework-go/functions"
 	"github.com/cloudevents/sdk-go/v2/event"
 )
 
-// "FHIRPubSub" is the entrypoint for the Cloud Function
+// "FHIRPubSub" is the entrypoint for the Cloud Function triggered by Eventarc, "FHIRPubSubPush" for
+// a Pub/Sub push subscription over plain HTTP
 func init() {
+	// a configuration problem fails the events it affects. It's logged on startup as well, rather than
+	// taking the instance down
+	if err := common.VerifyConfig(); err != nil {
+		log.Printf("Invalid configuration: %v", err)
+	}
 	functions.CloudEvent("FHIRPubSub", fhirPubSub)
-}
+	functions.HTTP("FHIRPubSubPush", fhirPubSubPush)
 
-// MessagePublishedData contains the full Pub/Sub message
-// https://cloud.google.com/eventarc/docs/cloudevents#pubsub
-type MessagePublishedData struct {
-	Message PubSubMessage
+	// the AlloyDB pool shared with the llm package is closed when Cloud Functions shuts the instance down
+	llm.CloseConnectionOnShutdown()
 }
 
-// PubSubMessage is the payload of a Pub/Sub event.
-// https://cloud.google.com/pubsub/docs/reference/rest/v1/PubsubMessage
-type PubSubMessage struct {
-	Attributes struct {
-		ResourceType string `json:"resourceType"`
-		Action       string `json:"action"`
-		VersionID    string `json:"versionId"`
-	} `json:"attributes"`
-	Data []byte `json:"data"`
-}
+// max size of a push request body. The notifications only carry the resource name
+const MAX_PUSH_BYTES = 1024 * 1024
 
 // fhirPubSub consumes a CloudEvent message and extracts the Pub/Sub message.
 func fhirPubSub(ctx context.Context, e event.Event) error {
-	var msg MessagePublishedData
+	var msg common.MessagePublishedData
 	if err := e.DataAs(&msg); err != nil {
-		return fmt.Errorf("event.DataAs: %w", err)
+		// a malformed event won't parse on a redelivery either. The id of a Pub/Sub event is its messageId
+		log.Printf("Failed to parse the event, saving it as a dead letter: %v", err)
+		return common.SaveMessageDeadLetter(ctx, &common.DeadLetter{MessageId: e.ID(), Payload: e.Data(), Reason: fmt.Sprintf("event.DataAs: %v", err)})
 	}
-	log.Printf("Received:, %s", msg.Message)
-
-	var resourceType = string(msg.Message.Attributes.ResourceType)
-	var action = string(msg.Message.Attributes.Action) //CreateResource, UpdateResource, DeleteResource
-	var resourceURI = string(msg.Message.Data)         //eg. projects/X/locations/X/datasets/X/fhirStores/X/fhir/resoruceTyep/id
-
-	process(ctx, resourceType, action, resourceURI)
-
-	return nil
+	return common.ProcessMessage(ctx, &msg, e.Data(), e.Time())
 }
 
-// process the resoruce data received in the pubsub
-func process(ctx context.Context, resourceType string, action string, resourceURI string) error {
-
-	// List of included FHIR resource types
-	includedResourceTypes := []string{
-		"Condition", "Observation", "MedicationRequest", "Encounter",
-		"AllergyIntolerance", "Procedure", "Immunization", "CarePlan", "ServiceRequest"}
-
-	// Check if the given resource type is included
-	var included bool
-	for _, rType := range includedResourceTypes {
-		if resourceType == rType {
-			included = true
-			break
-		}
+// fhirPubSubPush consumes the envelope of a Pub/Sub push subscription, the same message as the CloudEvent
+// without Eventarc. A 2xx status acknowledges the message, any other has Pub/Sub push it again
+func fhirPubSubPush(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	payload, err := io.ReadAll(io.LimitReader(r.Body, MAX_PUSH_BYTES))
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to read the request: %v", err), http.StatusBadRequest)
+		return
 	}
 
-	// If the resource type is included, retrieve and further process it
-	if included {
-		fhirJSONString, err := common.GetFHIRResource(ctx, resourceType, resourceURI)
-		if err != nil {
-			fmt.Println("Erorr Getting the FHIR Resource:", resourceType)
-		}
-		fmt.Println("Got resource..")
-
-		fmt.Println("Generating Sumamry..")
-		//get resoruceId from the resourceURI
-		parts := strings.Split(resourceURI, "/")
-		resourceId := parts[len(parts)-1]
-		resourceSummary, err := common.GetResourceSummary(ctx, resourceType, resourceId, fhirJSONString)
-		if err != nil {
-			fmt.Println(err)
-			fmt.Println("Error Generating Sumamry for the FHIR Resource:", resourceType)
-			return nil
-		}
-
-		// Print the Resource Sumamry
-		fmt.Println("ResourceId:", resourceSummary.ResourceId)
-		fmt.Println("PatientId:", resourceSummary.PatientId)
-		fmt.Println("ResourceType:", resourceSummary.ResourceType)
-		fmt.Println("Timestamp:", resourceSummary.Timestamp)
-		fmt.Println("GeneratedContent:", resourceSummary.GeneratedContent)
-		fmt.Println("OriginalFHIRJSON:", resourceSummary.OriginalFHIRJSON)
-
-		err = common.SaveSumamry(ctx, resourceSummary)
-		if err != nil {
-			fmt.Printf("Error saving summary for the FHIR resource: %v\n", err)
-			return nil
-		}
-
+	var msg common.MessagePublishedData
+	if parseErr := json.Unmarshal(payload, &msg); parseErr != nil {
+		// a malformed envelope won't parse on a redelivery either
+		log.Printf("Failed to parse the push request, saving it as a dead letter: %v", parseErr)
+		err = common.SaveMessageDeadLetter(r.Context(), &common.DeadLetter{
+			MessageId: pushMessageId(payload),
+			Payload:   payload,
+			Reason:    fmt.Sprintf("push envelope: %v", parseErr),
+		})
 	} else {
-		fmt.Println("Skipping processing for resource type:", resourceType)
+		err = common.ProcessMessage(r.Context(), &msg, payload, msg.Message.PublishTime)
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
 	}
+	w.WriteHeader(http.StatusNoContent)
+}
 
-	return nil
+// the messageId of an envelope that didn't parse as a whole (eg. its data isn't base64), to key its dead letter by.
+// Empty when the request isn't JSON at all, the dead letter is keyed by its payload then
+func pushMessageId(payload []byte) string {
+	var envelope struct {
+		Message struct {
+			MessageID string `json:"messageId"`
+		} `json:"message"`
+	}
+	json.Unmarshal(payload, &envelope)
+	return envelope.Message.MessageID
 }
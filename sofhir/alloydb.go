@@ -2,117 +2,186 @@ package sofhir
 
 import (
 	"context"
-	"encoding/json"
 	"fmt"
-	"net"
-	"strconv"
+	"strings"
+	"time"
 
-	"cloud.google.com/go/alloydbconn"
-	"github.com/jackc/pgx/v5/pgxpool"
+	"fhirgen.ai/llm"
 )
 
-func ExecuteRagFunction(ctx context.Context, patientId string, prompt string) (*RagFunctionResponse, error) {
+// retrieves the patient's summaries closest to the prompt with the rag_context function in AlloyDB
+// and answers the prompt from them with the model configured for RAG. The RAG prompt is rendered with the
+// prompt library's template for the role of the user. The filters are optional. Summaries with restricted
+// security labels are only retrieved when clearance has all of them. Only the summaries of the caller's
+// organization are seen, row-level security keeps the other tenants' out even when their patient ids collide,
+// and of the patient in sofhir's FHIR store
+func ExecuteRagFunction(ctx context.Context, role string, organizationId string, patientId string, prompt string,
+	filters *RagFilters, clearance []string) (*RagFunctionResponse, error) {
 
 	fmt.Println("Executing rag Function in  AlloyDB..")
+	fmt.Println("OrganizationId: ", organizationId)
 	fmt.Println("PatientId: ", patientId)
+	if organizationId == "" {
+		return nil, fmt.Errorf("The user has no organization to retrieve the summaries of")
+	}
+	// the patient id is of sofhir's FHIR store, the same id can be another patient in another store
+	if FHIR_STORE == "" {
+		return nil, fmt.Errorf("GCP_FHIR_API_URL has no FHIR store to retrieve the summaries of")
+	}
 	fmt.Println("Prompt: ", prompt)
 
-	conn, err := getConnection(ctx)
+	filterArgs, err := filters.args()
 	if err != nil {
-		return nil, fmt.Errorf("Unable to connect to AlloyDB: %v", err)
+		return nil, err
 	}
-	defer conn.Close()
-
-	//run SQL to execure the function
-	query := fmt.Sprintf("select * from rag('%s', '%s')", patientId, prompt)
 
-	fmt.Println("Executing the Query: ", query)
+	conn, err := llm.GetConnection(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to connect to AlloyDB: %v", err)
+	}
 
-	// Execute the query
-	rows, err := conn.Query(ctx, query)
+	// the prompt is embedded with the same provider and model as the summaries
+	embeddings, embeddingModel, err := llm.EmbedTexts(ctx, []string{prompt})
 	if err != nil {
 		return nil, err
 	}
-	defer rows.Close()
 
-	// Check if there's a row
-	if !rows.Next() {
-		return nil, fmt.Errorf("No rows returned from the query")
+	// the organization is set for the transaction only, pooled connections don't carry it to the next request
+	tx, err := conn.Begin(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to begin the RAG transaction: %v", err)
+	}
+	defer tx.Rollback(ctx)
+	_, err = tx.Exec(ctx, "SELECT set_config('app.organization_id', $1, true)", organizationId)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to set the organization: %v", err)
 	}
 
-	// Initialize RagFunctionResponse
-	var response RagFunctionResponse
+	// rag_context retrieves the Patient summary and the summaries that pass the filters and the clearance
+	var patientContext, summaries *string
+	args := ragContextArgs(patientId, prompt, llm.VectorText(embeddings[0]), embeddingModel, filterArgs, clearance)
+	err = tx.QueryRow(ctx, RAG_CONTEXT_QUERY, args...).Scan(&patientContext, &summaries)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to retrieve the RAG context: %v", err)
+	}
+	if err := tx.Commit(ctx); err != nil {
+		return nil, fmt.Errorf("Failed to retrieve the RAG context: %v", err)
+	}
 
-	// Scan the entire JSON response into a single variable
-	var jsonResult json.RawMessage
-	if err := rows.Scan(&jsonResult); err != nil {
-		return nil, fmt.Errorf("Failed to scan JSON result: %v", err)
+	library, err := llm.GetPromptLibrary(ctx)
+	if err != nil {
+		return nil, err
 	}
+	ragPrompt, promptVersion, err := RagPrompt(library, RagPromptData{
+		Role:           role,
+		Today:          time.Now().UTC().Format("2006-01-02"),
+		PatientContext: valueOf(patientContext),
+		Summaries:      valueOf(summaries),
+		Question:       prompt,
+	})
+	if err != nil {
+		return nil, err
+	}
+	fmt.Println("RAG prompt template:", promptVersion)
 
-	// Unmarshal the raw JSON data into RagFunctionResponse
-	if err := json.Unmarshal(jsonResult, &response); err != nil {
-		return nil, fmt.Errorf("Failed to unmarshal JSON result: %v", err)
+	generator, err := llm.GetTextGenerator(ctx, llm.RAG_USE)
+	if err != nil {
+		return nil, err
+	}
+	content, err := generator.GenerateText(ctx, ragPrompt)
+	if err != nil {
+		return nil, err
 	}
 
 	fmt.Println("Executed rag Function in AlloyDB")
 
-	return &response, nil
+	return &RagFunctionResponse{Predictions: []Prediction{{Content: content}}}, nil
 }
 
-func getConnection(ctx context.Context) (*pgxpool.Pool, error) {
+// rag_context(patient_id, input_prompt, query_embedding, embedding_model, resource_types, from_time, to_time,
+// active_only, code_systems, codes, categories, clearance, fhir_store)
+const RAG_CONTEXT_QUERY = "SELECT patient_context, summaries FROM rag_context($1, $2, $3::vector, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13)"
 
-	fmt.Println("Getting the AlloyDB Connection with pgx pool..")
+// the arguments of RAG_CONTEXT_QUERY, in the order of its parameters. filterArgs are the ones of RagFilters.args
+func ragContextArgs(patientId string, prompt string, embedding interface{}, embeddingModel string,
+	filterArgs []interface{}, clearance []string) []interface{} {
+	args := append([]interface{}{patientId, prompt, embedding, embeddingModel}, filterArgs...)
+	return append(args, nonEmpty(clearance), FHIR_STORE)
+}
 
-	dialer, err := alloydbconn.NewDialer(ctx, alloydbconn.WithIAMAuthN())
-	if err != nil {
-		return nil, fmt.Errorf("Failed to init Dialer: %v", err)
+// the resource_types, from_time, to_time, active_only, code_systems, codes and categories arguments of
+// rag_context. What is not set is NULL, which doesn't filter
+func (filters *RagFilters) args() ([]interface{}, error) {
+	if filters == nil {
+		filters = &RagFilters{}
 	}
-
-	fmt.Println("Got the New Dialer")
-
-	port, err := strconv.Atoi(ADB_PORT)
+	from, err := filterTime("from", filters.From, false)
 	if err != nil {
-		return &pgxpool.Pool{}, fmt.Errorf("Invalid Port: %v", err)
+		return nil, err
 	}
-
-	//get the accesstoken for the default cloud fucntion service accont: {PROJECT-ID}@appspot.gserviceaccount.com
-	accessToken, err := GetAccessToken(ctx)
+	to, err := filterTime("to", filters.To, true)
 	if err != nil {
-		return &pgxpool.Pool{}, fmt.Errorf("failed to obtain access token: %v", err)
+		return nil, err
 	}
 
-	fmt.Println("Got the Access Token")
-
-	dsn := fmt.Sprintf(
-		"host=%s port=%d user=%s password=%s dbname=%s sslmode=require",
-		ADB_IP, port, ADB_IAM_USER, accessToken, ADB_DATABASE)
-
-	config, err := pgxpool.ParseConfig(dsn)
-	if err != nil {
-		return &pgxpool.Pool{}, fmt.Errorf("Failed to parse pgx config: %v", err)
+	var codeSystems []string
+	for _, codeSystem := range filters.CodeSystems {
+		if strings.Contains(codeSystem, ":") {
+			codeSystems = append(codeSystems, codeSystem)
+			continue
+		}
+		systems, ok := CODE_SYSTEMS[strings.ToLower(codeSystem)]
+		if !ok {
+			return nil, fmt.Errorf("Unknown code system: %s", codeSystem)
+		}
+		codeSystems = append(codeSystems, systems...)
 	}
 
-	fmt.Println("Parsed the Config")
+	return []interface{}{nonEmpty(filters.ResourceTypes), from, to, filters.ActiveOnly,
+		nonEmpty(codeSystems), nonEmpty(filters.Codes), nonEmpty(filters.Categories)}, nil
+}
 
-	// Tell the driver to use the AlloyDB Go Connector to create connections
-	config.ConnConfig.DialFunc = func(ctx context.Context, _ string, instance string) (net.Conn, error) {
-		dbInstance := fmt.Sprintf("projects/%s/locations/%s/clusters/%s/instances/%s",
-			PROJECT_ID, REGION, ADB_CLUSTER, ADB_INSTANCE)
-		return dialer.Dial(ctx, dbInstance)
+// parses a FHIR date or dateTime filter. A date (2023, 2023-06 or 2023-06-01) starts the range at its
+// beginning, or ends it at its end when it's the end of the range
+func filterTime(name string, value string, end bool) (*time.Time, error) {
+	if value == "" {
+		return nil, nil
 	}
-	fmt.Println("Defined the DialFunc")
-
-	// Create a DSN string from the config
-	dsnString := config.ConnString()
-	fmt.Println("Created the DSN String")
-
-	conn, err := pgxpool.New(ctx, dsnString)
-	if err != nil {
-		fmt.Println("Failed to get the connection")
-		return &pgxpool.Pool{}, fmt.Errorf("Failed to Connect to AlloyDB: %v", err)
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return &t, nil
 	}
+	for _, layout := range []struct {
+		layout              string
+		years, months, days int
+	}{
+		{"2006-01-02", 0, 0, 1},
+		{"2006-01", 0, 1, 0},
+		{"2006", 1, 0, 0},
+	} {
+		t, err := time.Parse(layout.layout, value)
+		if err != nil {
+			continue
+		}
+		if end {
+			t = t.AddDate(layout.years, layout.months, layout.days)
+		}
+		return &t, nil
+	}
+	return nil, fmt.Errorf("Invalid %s filter, expected a date or dateTime: %s", name, value)
+}
 
-	fmt.Println("Got the AlloyDB Connection")
+// the value of a nullable column, empty for NULL
+func valueOf(value *string) string {
+	if value == nil {
+		return ""
+	}
+	return *value
+}
 
-	return conn, nil
+// nil (NULL) for an empty list
+func nonEmpty(values []string) []string {
+	if len(values) == 0 {
+		return nil
+	}
+	return values
 }
@@ -0,0 +1,121 @@
+package sofhir
+
+import (
+	"reflect"
+	"regexp"
+	"testing"
+	"time"
+)
+
+func date(year int, month time.Month, day int) *time.Time {
+	t := time.Date(year, month, day, 0, 0, 0, 0, time.UTC)
+	return &t
+}
+
+func TestFilterTime(t *testing.T) {
+	for _, test := range []struct {
+		value string
+		end   bool
+		want  *time.Time
+	}{
+		{"", false, nil},
+		{"", true, nil},
+		{"2023", false, date(2023, 1, 1)},
+		{"2023", true, date(2024, 1, 1)},
+		{"2023-06", false, date(2023, 6, 1)},
+		{"2023-06", true, date(2023, 7, 1)},
+		{"2023-12", true, date(2024, 1, 1)},
+		{"2023-06-01", false, date(2023, 6, 1)},
+		{"2023-06-01", true, date(2023, 6, 2)},
+		{"2023-12-31", true, date(2024, 1, 1)},
+		// a dateTime is the instant itself, at either end
+		{"2023-06-01T10:00:00Z", false, func() *time.Time { t := date(2023, 6, 1).Add(10 * time.Hour); return &t }()},
+		{"2023-06-01T10:00:00Z", true, func() *time.Time { t := date(2023, 6, 1).Add(10 * time.Hour); return &t }()},
+		{"2023-06-01T12:00:00+02:00", false, func() *time.Time { t := date(2023, 6, 1).Add(10 * time.Hour); return &t }()},
+	} {
+		got, err := filterTime("from", test.value, test.end)
+		if err != nil {
+			t.Errorf("filterTime(%q, %v): %v", test.value, test.end, err)
+			continue
+		}
+		if (got == nil) != (test.want == nil) || (got != nil && !got.Equal(*test.want)) {
+			t.Errorf("filterTime(%q, %v) is %v, want %v", test.value, test.end, got, test.want)
+		}
+	}
+
+	for _, value := range []string{"06/01/2023", "2023-13", "2023-06-31", "23", "yesterday"} {
+		if _, err := filterTime("to", value, true); err == nil {
+			t.Errorf("filterTime(%q) didn't fail", value)
+		}
+	}
+}
+
+func TestRagFiltersArgs(t *testing.T) {
+	var noTime *time.Time
+	var none []string
+	for _, test := range []struct {
+		name    string
+		filters *RagFilters
+		want    []interface{}
+	}{
+		{"no filters", nil, []interface{}{none, noTime, noTime, false, none, none, none}},
+		{"empty filters", &RagFilters{}, []interface{}{none, noTime, noTime, false, none, none, none}},
+		{"empty lists", &RagFilters{ResourceTypes: []string{}, Codes: []string{}},
+			[]interface{}{none, noTime, noTime, false, none, none, none}},
+		{"resource types", &RagFilters{ResourceTypes: []string{"Observation", "Condition"}},
+			[]interface{}{[]string{"Observation", "Condition"}, noTime, noTime, false, none, none, none}},
+		{"from only", &RagFilters{From: "2023"},
+			[]interface{}{none, date(2023, 1, 1), noTime, false, none, none, none}},
+		{"to only", &RagFilters{To: "2023-06"},
+			[]interface{}{none, noTime, date(2023, 7, 1), false, none, none, none}},
+		{"active only", &RagFilters{ActiveOnly: true},
+			[]interface{}{none, noTime, noTime, true, none, none, none}},
+		{"code systems by name and URI", &RagFilters{CodeSystems: []string{"LOINC", "icd10", "urn:oid:2.16.840.1.113883.6.96"}},
+			[]interface{}{none, noTime, noTime, false, []string{"http://loinc.org", "http://hl7.org/fhir/sid/icd-10",
+				"http://hl7.org/fhir/sid/icd-10-cm", "urn:oid:2.16.840.1.113883.6.96"}, none, none}},
+		{"codes and categories", &RagFilters{Codes: []string{"8480-6"}, Categories: []string{"vital-signs"}},
+			[]interface{}{none, noTime, noTime, false, none, []string{"8480-6"}, []string{"vital-signs"}}},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := test.filters.args()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("got %v, want %v", got, test.want)
+			}
+		})
+	}
+
+	for _, filters := range []*RagFilters{{From: "June"}, {To: "2023-02-30"}, {CodeSystems: []string{"cpt"}}} {
+		if _, err := filters.args(); err == nil {
+			t.Errorf("the filters %+v didn't fail", filters)
+		}
+	}
+}
+
+// every parameter of the rag_context call gets an argument, with or without filters
+func TestRagContextArgs(t *testing.T) {
+	placeholders := len(regexp.MustCompile(`\$\d+`).FindAllString(RAG_CONTEXT_QUERY, -1))
+	if placeholders != 13 {
+		t.Fatalf("RAG_CONTEXT_QUERY has %d parameters, want the 13 of rag_context", placeholders)
+	}
+
+	for _, filters := range []*RagFilters{nil, {}, {From: "2023", CodeSystems: []string{"snomed"}}} {
+		filterArgs, err := filters.args()
+		if err != nil {
+			t.Fatal(err)
+		}
+		args := ragContextArgs("p1", "any allergies?", nil, "", filterArgs, nil)
+		if len(args) != placeholders {
+			t.Errorf("the filters %+v give %d arguments, want %d", filters, len(args), placeholders)
+			continue
+		}
+		if clearance, ok := args[11].([]string); !ok || clearance != nil {
+			t.Errorf("the clearance argument is %v, want NULL", args[11])
+		}
+		if args[12] != FHIR_STORE {
+			t.Errorf("the last argument is %v, want the FHIR store", args[12])
+		}
+	}
+}
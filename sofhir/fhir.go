@@ -110,6 +110,66 @@ func GetPractitionerByEmail(ctx context.Context, email string) (*Practitioner, e
 	return &searchResults.Entry[0].Practitioner, nil
 }
 
+// Get the active PractitionerRoles of the Practitioner
+func GetPractitionerRoles(ctx context.Context, practitionerId string) ([]PractitionerRole, error) {
+
+	// Authenticate with the FHIR server to obtain an access token
+	accessToken, err := GetAccessToken(ctx)
+	if err != nil {
+		return nil, err
+	}
+	resourceURI := "/PractitionerRole?active=true&_count=100&practitioner=Practitioner/" + practitionerId
+	responseBody, _, err := SendFHIRRequest(ctx, accessToken, "GET", resourceURI, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var searchResults PractitionerRoleSearchResults
+	if err := json.Unmarshal([]byte(responseBody), &searchResults); err != nil {
+		return nil, fmt.Errorf("Error parsing responseBody: %v", err)
+	}
+
+	var roles []PractitionerRole
+	for _, entry := range searchResults.Entry {
+		roles = append(roles, entry.PractitionerRole)
+	}
+	return roles, nil
+}
+
+// the id of the Organization resource a reference points to, eg. org-1 of Organization/org-1 or of
+// https://.../fhir/Organization/org-1/_history/2. The loader stamps the rows with the same id of the
+// Patient's managingOrganization, so it's what the organizationId claim holds for patients and providers alike
+func OrganizationIdOf(org Organization) string {
+	parts := strings.Split(strings.TrimSuffix(org.Reference, "/"), "/")
+	if len(parts) >= 4 && parts[len(parts)-2] == "_history" {
+		parts = parts[:len(parts)-2]
+	}
+	if len(parts) < 2 || parts[len(parts)-2] != "Organization" {
+		return ""
+	}
+	return parts[len(parts)-1]
+}
+
+// the organization of a provider: the one organization of their active PractitionerRoles. Roles in more than
+// one organization are refused, a claim holds a single organization
+func PractitionerOrganizationId(roles []PractitionerRole) (string, error) {
+	var orgId string
+	for _, role := range roles {
+		id := OrganizationIdOf(role.Organization)
+		if id == "" {
+			continue
+		}
+		if orgId != "" && orgId != id {
+			return "", fmt.Errorf("Practitioner has roles in more than one organization: %s and %s", orgId, id)
+		}
+		orgId = id
+	}
+	if orgId == "" {
+		return "", fmt.Errorf("Practitioner has no active PractitionerRole with an organization")
+	}
+	return orgId, nil
+}
+
 // get a identifier vlaue for a specific system in an array of identifiers
 func GetIdentifier(syetem string, identifiers []Identifier) string {
 
@@ -34,6 +34,21 @@ type Practitioner struct {
 	Identifier []Identifier `json:"identifier"`
 }
 
+type PractitionerRoleSearchResults struct {
+	Entry []PractitionerRoleEntry `json:"entry"`
+	Total int                     `json:"total"`
+}
+
+type PractitionerRoleEntry struct {
+	FullURL          string           `json:"fullUrl"`
+	PractitionerRole PractitionerRole `json:"resource"`
+}
+
+type PractitionerRole struct {
+	Id           string       `json:"id"`
+	Organization Organization `json:"organization"`
+}
+
 type Identifier struct {
 	System string `json:"system"`
 	Value  string `json:"value"`
@@ -0,0 +1,101 @@
+package sofhir
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+// the loader stamps the rows of this Patient with org-1, the id of its managingOrganization
+// (see TestPatientOrganizationId in loader/common), and a provider of the same organization has to get
+// org-1 in their organizationId claim to see them
+const organizationPatient = `{"resourceType":"Patient","id":"p1",
+	"managingOrganization":{"reference":"Organization/org-1","display":"Good Health Clinic"}}`
+
+const organizationRoles = `{"resourceType":"Bundle","type":"searchset","total":3,"entry":[
+	{"fullUrl":"https://example.com/fhir/PractitionerRole/r1","resource":{"resourceType":"PractitionerRole","id":"r1",
+		"practitioner":{"reference":"Practitioner/dr1"},"organization":{"reference":"Organization/org-1"}}},
+	{"fullUrl":"https://example.com/fhir/PractitionerRole/r2","resource":{"resourceType":"PractitionerRole","id":"r2",
+		"practitioner":{"reference":"Practitioner/dr1"},
+		"organization":{"reference":"https://example.com/fhir/Organization/org-1/_history/3"}}},
+	{"fullUrl":"https://example.com/fhir/PractitionerRole/r3","resource":{"resourceType":"PractitionerRole","id":"r3",
+		"practitioner":{"reference":"Practitioner/dr1"}}}]}`
+
+func TestOrganizationClaims(t *testing.T) {
+	var patient Patient
+	if err := json.Unmarshal([]byte(organizationPatient), &patient); err != nil {
+		t.Fatal(err)
+	}
+	var searchResults PractitionerRoleSearchResults
+	if err := json.Unmarshal([]byte(organizationRoles), &searchResults); err != nil {
+		t.Fatal(err)
+	}
+	var roles []PractitionerRole
+	for _, entry := range searchResults.Entry {
+		roles = append(roles, entry.PractitionerRole)
+	}
+
+	providerOrgId, err := PractitionerOrganizationId(roles)
+	if err != nil {
+		t.Fatal(err)
+	}
+	patientOrgId := OrganizationIdOf(patient.Org)
+	if providerOrgId != "org-1" || patientOrgId != "org-1" {
+		t.Errorf("the provider's claim is %q and the patient's %q, want the id of the rows' organization org-1",
+			providerOrgId, patientOrgId)
+	}
+}
+
+func TestPractitionerOrganizationId(t *testing.T) {
+	for _, test := range []struct {
+		name  string
+		roles []PractitionerRole
+		want  string
+	}{
+		{"one organization", []PractitionerRole{{Organization: Organization{Reference: "Organization/org-1"}}}, "org-1"},
+		{"no roles", nil, ""},
+		{"no organization", []PractitionerRole{{Id: "r1"}}, ""},
+		{"two organizations", []PractitionerRole{
+			{Organization: Organization{Reference: "Organization/org-1"}},
+			{Organization: Organization{Reference: "Organization/org-2"}},
+		}, ""},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := PractitionerOrganizationId(test.roles)
+			if got != test.want {
+				t.Errorf("the organization is %q, want %q", got, test.want)
+			}
+			if (err == nil) != (test.want != "") {
+				t.Errorf("unexpected error: %v", err)
+			}
+		})
+	}
+}
+
+func TestOrganizationIdOf(t *testing.T) {
+	for reference, want := range map[string]string{
+		"Organization/org-1":                           "org-1",
+		"Organization/org-1/_history/2":                "org-1",
+		"https://example.com/fhir/Organization/org-1":  "org-1",
+		"https://example.com/fhir/Organization/org-1/": "org-1",
+		"Location/loc-1":                               "",
+		"#contained":                                   "",
+		"":                                             "",
+	} {
+		if got := OrganizationIdOf(Organization{Reference: reference}); got != want {
+			t.Errorf("OrganizationIdOf(%q) is %q, want %q", reference, got, want)
+		}
+	}
+}
+
+// the store the rows of sofhir's patients are stamped with
+func TestFHIRStoreOf(t *testing.T) {
+	for fhirURL, want := range map[string]string{
+		"https://healthcare.googleapis.com/v1/projects/p/locations/l/datasets/d/fhirStores/s/fhir":  "projects/p/locations/l/datasets/d/fhirStores/s",
+		"https://healthcare.googleapis.com/v1/projects/p/locations/l/datasets/d/fhirStores/s/fhir/": "projects/p/locations/l/datasets/d/fhirStores/s",
+		"https://example.com/fhir": "",
+	} {
+		if got := fhirStoreOf(fhirURL); got != want {
+			t.Errorf("fhirStoreOf(%q) is %q, want %q", fhirURL, got, want)
+		}
+	}
+}
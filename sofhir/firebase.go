@@ -34,7 +34,7 @@ func IsUserEligible(ctx context.Context, user *auth.UserRecord) (bool, map[strin
 			return false, nil
 		}
 		log.Print("Got Patient By Email")
-		orgId := strings.Split(patient.Org.Reference, "/")[1]
+		orgId := OrganizationIdOf(patient.Org)
 		claims := map[string]interface{}{PATIENT_ID_CLAIM: patient.Id, ORGANIZATION_ID_CLAIM: orgId, ROLE_CLAIM: PATIENT_ROLE}
 
 		return true, claims
@@ -47,7 +47,17 @@ func IsUserEligible(ctx context.Context, user *auth.UserRecord) (bool, map[strin
 			return false, nil
 		}
 		log.Print("Got Practitioner By Email")
-		orgId := GetIdentifier(ORG_IDENTIFIER_SYSTEM, practitioner.Identifier) //get organization id from the identifiers
+		//the organization of the practitioner's roles, the same Organization id the loader stamps the rows with
+		roles, err := GetPractitionerRoles(ctx, practitioner.Id)
+		if err != nil {
+			log.Print("GetPractitionerRoles Error occurred: ", err)
+			return false, nil
+		}
+		orgId, err := PractitionerOrganizationId(roles)
+		if err != nil {
+			log.Print("PractitionerOrganizationId Error occurred: ", err)
+			return false, nil
+		}
 		claims := map[string]interface{}{PROVIDER_ID_CLAIM: practitioner.Id, ORGANIZATION_ID_CLAIM: orgId, ROLE_CLAIM: PROVIDER_ROLE}
 
 		return true, claims
@@ -3,8 +3,9 @@ module fhirgen.ai/sofhir
 go 1.21.8
 
 require (
-	cloud.google.com/go/alloydbconn v1.8.0
 	cloud.google.com/go/compute/metadata v0.3.0
+	fhirgen.ai/llm v0.0.0
+	firebase.google.com/go/v4 v4.14.0
 	github.com/google/generative-ai-go v0.10.0
 	github.com/jackc/pgx/v5 v5.5.5
 	google.golang.org/api v0.170.0
@@ -14,13 +15,13 @@ require (
 	cloud.google.com/go v0.112.1 // indirect
 	cloud.google.com/go/ai v0.3.0 // indirect
 	cloud.google.com/go/alloydb v1.10.0 // indirect
+	cloud.google.com/go/alloydbconn v1.8.0 // indirect
 	cloud.google.com/go/compute v1.24.0 // indirect
 	cloud.google.com/go/firestore v1.15.0 // indirect
 	cloud.google.com/go/functions v1.16.1 // indirect
 	cloud.google.com/go/iam v1.1.7 // indirect
 	cloud.google.com/go/longrunning v0.5.5 // indirect
 	cloud.google.com/go/storage v1.40.0 // indirect
-	firebase.google.com/go/v4 v4.14.0 // indirect
 	github.com/GoogleCloudPlatform/functions-framework-go v1.8.1 // indirect
 	github.com/MicahParks/keyfunc v1.9.0 // indirect
 	github.com/cloudevents/sdk-go/v2 v2.14.0 // indirect
@@ -65,3 +66,5 @@ require (
 	google.golang.org/grpc v1.62.1 // indirect
 	google.golang.org/protobuf v1.33.0 // indirect
 )
+
+replace fhirgen.ai/llm => ../llm
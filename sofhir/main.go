@@ -8,9 +8,16 @@ import (
 	"log"
 	"net/http"
 
+	"fhirgen.ai/llm"
+
 	"firebase.google.com/go/v4/auth"
 )
 
+// the AlloyDB pool shared with the llm package is closed when Cloud Functions shuts the instance down
+func init() {
+	llm.CloseConnectionOnShutdown()
+}
+
 // cloud fucntion for : "GET /fhir/{type}/{id}" HTTP request
 func Read(w http.ResponseWriter, r *http.Request) {
 	ctx := r.Context()
@@ -122,7 +129,7 @@ func Rag(w http.ResponseWriter, r *http.Request) {
 	}
 	log.Printf("RAG Request Authorized")
 
-	responseJSON, err := ProcessRagRequest(ctx, r, claims, requestData.PatientId, requestData.Prompt)
+	responseJSON, err := ProcessRagRequest(ctx, r, claims, requestData.PatientId, requestData.Prompt, requestData.Filters)
 	if err != nil {
 		http.Error(w, "Error executing RAG function:"+err.Error(), http.StatusBadRequest)
 		return
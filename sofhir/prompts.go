@@ -0,0 +1,37 @@
+package sofhir
+
+import "fhirgen.ai/llm"
+
+// builtin template of the RAG prompt, used when the prompt library has no rag template
+const RAG_PROMPT_TEMPLATE = `you are a clinician that can udnerstand patient electronic records and be able to answer users questions.
+            Based on the patient request we have retrieved a list of records closely related to users prompt.
+            The retrieved list is a pipe de-limited text of summaries derived from FHIR resources associated to the patient.Important note: hide any PII incvluding, Names, DOB, Address, Email and Phone numbers of Patients from the answer.
+            Today is {{.Today}}. Each summary starts with the date of the record and how long ago that was,
+            use those when the answer depends on when something happened.
+            {{.PatientContext}}
+            Here is the list of summaries from the search:{{.Summaries}}. And the question is: {{.Question}}`
+
+// what a rag template is rendered with
+type RagPromptData struct {
+	Role           string // the role of the user asking, patient or user (a provider)
+	Today          string // YYYY-MM-DD
+	PatientContext string // the PII free summary of the Patient, eg. age band and sex
+	Summaries      string // the retrieved summaries, pipe delimited, most recent first
+	Question       string
+}
+
+// renders the RAG prompt with the library's template for the role, or the builtin template.
+// Also returns the version of the template as {version}/{name}
+func RagPrompt(library *llm.PromptLibrary, data RagPromptData) (string, string, error) {
+	name, text, ok := library.Lookup(llm.RAG_PROMPT, data.Role)
+	version := library.Version
+	if !ok {
+		name, text, version = llm.RAG_PROMPT, RAG_PROMPT_TEMPLATE, llm.BUILTIN_PROMPT_VERSION
+	}
+
+	prompt, err := llm.RenderPrompt(name, text, data)
+	if err != nil {
+		return "", "", err
+	}
+	return prompt, version + "/" + name, nil
+}
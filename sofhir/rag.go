@@ -6,10 +6,12 @@ import (
 	"fmt"
 	"log"
 	"net/http"
+	"slices"
+	"strings"
 )
 
 // this will handle the rag request
-func ProcessRagRequest(ctx context.Context, r *http.Request, userClaims map[string]interface{}, patientId string, prompt string) ([]byte, error) {
+func ProcessRagRequest(ctx context.Context, r *http.Request, userClaims map[string]interface{}, patientId string, prompt string, filters *RagFilters) ([]byte, error) {
 
 	granted, err := AuthorizeRAGRequest(userClaims, patientId)
 	if !granted {
@@ -17,7 +19,11 @@ func ProcessRagRequest(ctx context.Context, r *http.Request, userClaims map[stri
 	}
 	log.Printf("Access granted for RAG Request")
 
-	ragFunctionResponse, err := ExecuteRagFunction(ctx, patientId, prompt)
+	role, _ := userClaims[ROLE_CLAIM].(string)
+	organizationId, _ := userClaims[ORGANIZATION_ID_CLAIM].(string)
+	clearance := RequesterClearance(userClaims)
+	log.Printf("Security clearance: %v", clearance)
+	ragFunctionResponse, err := ExecuteRagFunction(ctx, role, organizationId, patientId, prompt, filters, clearance)
 	if err != nil {
 		return nil, fmt.Errorf("Error executing RAG function: %v", err)
 	}
@@ -35,6 +41,35 @@ func ProcessRagRequest(ctx context.Context, r *http.Request, userClaims map[stri
 	return responseJSON, nil
 }
 
+// the security labels the user is cleared for: those of their role and of the securityClearance claim
+func RequesterClearance(userClaims map[string]interface{}) []string {
+	var labels []string
+	role, _ := userClaims[ROLE_CLAIM].(string)
+	if role == PATIENT_ROLE {
+		labels = append(labels, PATIENT_ROLE_CLEARANCE...)
+	} else if role == PROVIDER_ROLE {
+		labels = append(labels, PROVIDER_ROLE_CLEARANCE...)
+	}
+	switch claim := userClaims[CLEARANCE_CLAIM].(type) {
+	case []interface{}:
+		for _, label := range claim {
+			if label, ok := label.(string); ok {
+				labels = append(labels, label)
+			}
+		}
+	case string:
+		labels = append(labels, strings.Split(claim, ";")...)
+	}
+
+	var clearance []string
+	for _, label := range labels {
+		if label = strings.TrimSpace(label); label != "" && !slices.Contains(clearance, label) {
+			clearance = append(clearance, label)
+		}
+	}
+	return clearance
+}
+
 func AuthorizeRAGRequest(userClaims map[string]interface{}, requestedPatientId string) (bool, error) {
 
 	role := userClaims[ROLE_CLAIM].(string)
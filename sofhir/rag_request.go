@@ -2,6 +2,18 @@ package sofhir
 
 // Request Body
 type RagRequest struct {
-	PatientId string `json:"patientId"`
-	Prompt    string `json:"prompt"`
+	PatientId string      `json:"patientId"`
+	Prompt    string      `json:"prompt"`
+	Filters   *RagFilters `json:"filters,omitempty"`
+}
+
+// narrows the summaries the answer is based on. Fields that are not set don't filter
+type RagFilters struct {
+	ResourceTypes []string `json:"resourceTypes,omitempty"` // eg. Observation
+	From          string   `json:"from,omitempty"`          // a date or dateTime, eg. 2023, 2023-06 or 2023-06-01T10:00:00Z
+	To            string   `json:"to,omitempty"`            // a date includes the whole year, month or day
+	ActiveOnly    bool     `json:"activeOnly,omitempty"`    // only active conditions, allergies, medications, plans and so on
+	CodeSystems   []string `json:"codeSystems,omitempty"`   // loinc, snomed, rxnorm, icd10, cvx or a system URI
+	Codes         []string `json:"codes,omitempty"`         // eg. 8480-6
+	Categories    []string `json:"categories,omitempty"`    // eg. vital-signs or laboratory
 }
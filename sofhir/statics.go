@@ -11,11 +11,27 @@ var (
 	PATIENTS_TENANT_ID  = os.Getenv("PATIENTS_TENANT_ID")
 	API_GATEWAY_HOST    = "https://" + os.Getenv("API_GATEWAY_HOST")
 
-	PATIENT_ROLE_SCOPES   = strings.Split(os.Getenv("PATIENT_ROLE_SCOPES"), ";")
-	PROVIDER_ROLE_SCOPES  = strings.Split(os.Getenv("PROVIDER_ROLE_SCOPES"), ";")
-	ORG_IDENTIFIER_SYSTEM = "https://fhirgen.ai/fhir/identifiers/organization"
+	// the FHIR store of GCP_FHIR_API_URL as the loader stamps the rows with it, projects/X/locations/X/datasets/X/fhirStores/X
+	FHIR_STORE = fhirStoreOf(os.Getenv("GCP_FHIR_API_URL"))
+
+	PATIENT_ROLE_SCOPES  = strings.Split(os.Getenv("PATIENT_ROLE_SCOPES"), ";")
+	PROVIDER_ROLE_SCOPES = strings.Split(os.Getenv("PROVIDER_ROLE_SCOPES"), ";")
+
+	// the security labels each role is cleared for in RAG retrieval, eg. R;HIV. Rows the loader segmented by
+	// their labels (SECURITY_LABEL_POLICY) are only retrieved for a user cleared for all of them
+	PATIENT_ROLE_CLEARANCE  = strings.Split(os.Getenv("PATIENT_ROLE_CLEARANCE"), ";")
+	PROVIDER_ROLE_CLEARANCE = strings.Split(os.Getenv("PROVIDER_ROLE_CLEARANCE"), ";")
 )
 
+// the code systems of the RAG codeSystems filter by their short names
+var CODE_SYSTEMS = map[string][]string{
+	"loinc":  {"http://loinc.org"},
+	"snomed": {"http://snomed.info/sct"},
+	"rxnorm": {"http://www.nlm.nih.gov/research/umls/rxnorm"},
+	"icd10":  {"http://hl7.org/fhir/sid/icd-10", "http://hl7.org/fhir/sid/icd-10-cm"},
+	"cvx":    {"http://hl7.org/fhir/sid/cvx"},
+}
+
 const (
 	ALL_RESOURCES          = "all"
 	PATIENT_RESOURCE_TYPE  = "Patient"
@@ -25,6 +41,7 @@ const (
 	PATIENT_ID_CLAIM       = "patientId"
 	PROVIDER_ID_CLAIM      = "providerId"
 	ORGANIZATION_ID_CLAIM  = "organizationId"
+	CLEARANCE_CLAIM        = "securityClearance" // labels the user is cleared for on top of their role's
 	ID_SEARCH_PARM         = "_id"
 	PATIENT_ID_SEARCH_PARM = "patient"
 	SUBJECT_SEARCH_PARM    = "subject"
@@ -35,14 +52,11 @@ const (
 	UNAUTHORIZED_STATUS    = 401
 )
 
-// alloy-db stuff
-var (
-	REGION       = os.Getenv("REGION")
-	PROJECT_ID   = os.Getenv("PROJECT_ID")
-	ADB_IAM_USER = os.Getenv("ADB_IAM_USER")
-	ADB_CLUSTER  = os.Getenv("ADB_CLUSTER")
-	ADB_INSTANCE = os.Getenv("ADB_INSTANCE")
-	ADB_IP       = os.Getenv("ADB_IP")
-	ADB_PORT     = os.Getenv("ADB_PORT")
-	ADB_DATABASE = os.Getenv("ADB_DATABASE")
-)
+// the projects/X/locations/X/datasets/X/fhirStores/X part of a FHIR API URL, empty when it has none
+func fhirStoreOf(fhirURL string) string {
+	start := strings.Index(fhirURL, "projects/")
+	if start < 0 {
+		return ""
+	}
+	return strings.TrimSuffix(strings.TrimSuffix(fhirURL[start:], "/"), "/fhir")
+}